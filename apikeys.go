@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// What a key may do: submit covers every request that changes something outside /admin, read every one that
+// doesn't, and admin everything under /admin. Admin keys can do all three
+const (
+	scopeSubmit = "submit"
+	scopeRead   = "read"
+	scopeAdmin  = "admin"
+)
+
+var apiKeyScopes = []string{scopeSubmit, scopeRead, scopeAdmin}
+
+// Keys created here start with the prefix, followed by 32 random bytes in hex
+const apiKeyPrefix = "rpk_"
+
+// A key to the API for one tenant. Only its SHA-256 is kept, the key itself is shown once when it is created
+type apiKey struct {
+	Id         string     `json:"id" xml:"id" yaml:"id"`
+	Name       string     `json:"name" xml:"name" yaml:"name"`
+	TenantId   string     `json:"tenantId" xml:"tenantId" yaml:"tenantId"`
+	Scopes     []string   `json:"scopes" xml:"scopes>scope" yaml:"scopes"`
+	Prefix     string     `json:"prefix,omitempty" xml:"prefix,omitempty" yaml:"prefix,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" xml:"lastUsedAt,omitempty" yaml:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" xml:"revokedAt,omitempty" yaml:"revokedAt,omitempty"`
+
+	hash [sha256.Size]byte
+}
+
+func (key apiKey) allows(scope string) bool {
+	return slices.Contains(key.Scopes, scope) || slices.Contains(key.Scopes, scopeAdmin)
+}
+
+// The tenant a request made with the key belongs to. Keys only work for their own tenant, naming another is refused
+func (key apiKey) tenantFor(requested string) (string, bool) {
+	if requested == "" {
+		return key.TenantId, true
+	}
+	return requested, requested == key.TenantId
+}
+
+func (key *apiKey) copy() apiKey {
+	copied := *key
+	copied.Scopes = slices.Clone(key.Scopes)
+	return copied
+}
+
+// Keys by ID and by hash. Keys are long random strings, so a fast hash is as safe to store as a slow one and lets
+// every request be checked with one lookup
+type apiKeyStore struct {
+	mu       sync.Mutex
+	required bool
+	keys     map[string]*apiKey
+	byHash   map[[sha256.Size]byte]*apiKey
+}
+
+var apiKeys = newAPIKeyStore()
+
+func newAPIKeyStore() *apiKeyStore {
+	return &apiKeyStore{keys: map[string]*apiKey{}, byHash: map[[sha256.Size]byte]*apiKey{}}
+}
+
+var errDuplicateAPIKey = errors.New("the key is already in use")
+
+func (s *apiKeyStore) add(added apiKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byHash[added.hash]; ok {
+		return errDuplicateAPIKey
+	}
+	s.keys[added.Id] = &added
+	s.byHash[added.hash] = &added
+	return nil
+}
+
+// Creates a key for the tenant, returning it with the secret to hand to its user
+func (s *apiKeyStore) create(name string, tenantId string, scopes []string) (apiKey, string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return apiKey{}, "", err
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(random)
+
+	created := apiKey{
+		Id:        uuid.New().String(),
+		Name:      name,
+		TenantId:  tenantId,
+		Scopes:    slices.Clone(scopes),
+		Prefix:    secret[:len(apiKeyPrefix)+8],
+		CreatedAt: time.Now().UTC(),
+		hash:      sha256.Sum256([]byte(secret)),
+	}
+	if err := s.add(created); err != nil {
+		return apiKey{}, "", err
+	}
+	return created, secret, nil
+}
+
+// The unrevoked key with the secret, marked as used now
+func (s *apiKeyStore) authenticate(secret string, now time.Time) (apiKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, ok := s.byHash[sha256.Sum256([]byte(secret))]
+	if !ok || found.RevokedAt != nil {
+		return apiKey{}, false
+	}
+	found.LastUsedAt = &now
+	return found.copy(), true
+}
+
+// The tenant's keys, oldest first
+func (s *apiKeyStore) list(tenantId string) []apiKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []apiKey{}
+	for _, key := range s.keys {
+		if key.TenantId == tenantId {
+			keys = append(keys, key.copy())
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+func (s *apiKeyStore) get(tenantId string, id string) (apiKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, ok := s.keys[id]
+	if !ok || found.TenantId != tenantId {
+		return apiKey{}, false
+	}
+	return found.copy(), true
+}
+
+// Revokes the tenant's key for good. Revoking it again keeps when it was first revoked
+func (s *apiKeyStore) revoke(tenantId string, id string, now time.Time) (apiKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, ok := s.keys[id]
+	if !ok || found.TenantId != tenantId {
+		return apiKey{}, false
+	}
+	if found.RevokedAt == nil {
+		found.RevokedAt = &now
+	}
+	return found.copy(), true
+}
+
+func (s *apiKeyStore) isRequired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.required
+}
+
+func (s *apiKeyStore) setRequired(required bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.required = required
+}
+
+// A key as written in API_KEYS_FILE, with the SHA-256 of the key in hex instead of the key
+type apiKeyConfig struct {
+	Name     string   `json:"name"`
+	TenantId string   `json:"tenantId"`
+	Scopes   []string `json:"scopes"`
+	Sha256   string   `json:"sha256"`
+}
+
+// Adds the keys in the file, a JSON array of key configs, and from then on requires a key on every request. Any
+// mistake in it fails the whole file. Tenants have to be loaded first
+func loadAPIKeys(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []apiKeyConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var loaded []apiKey
+	for i, config := range configs {
+		configured, err := newConfiguredAPIKey(config)
+		if err != nil {
+			return fmt.Errorf("%s: key %d: %w", path, i, err)
+		}
+		loaded = append(loaded, configured)
+	}
+	for i, configured := range loaded {
+		if err := apiKeys.add(configured); err != nil {
+			return fmt.Errorf("%s: key %d: %w", path, i, err)
+		}
+	}
+	apiKeys.setRequired(true)
+	return nil
+}
+
+func newConfiguredAPIKey(config apiKeyConfig) (apiKey, error) {
+	if config.TenantId == "" {
+		config.TenantId = defaultTenantId
+	}
+	if _, ok := tenants.get(config.TenantId); !ok {
+		return apiKey{}, fmt.Errorf("no tenant %q", config.TenantId)
+	}
+	if err := checkScopes(config.Scopes); err != nil {
+		return apiKey{}, err
+	}
+
+	configured := apiKey{Id: uuid.New().String(), Name: config.Name, TenantId: config.TenantId, Scopes: config.Scopes, CreatedAt: time.Now().UTC()}
+	hash, err := hex.DecodeString(config.Sha256)
+	if err != nil || len(hash) != sha256.Size {
+		return apiKey{}, errors.New("sha256 must be the key's SHA-256 in hex")
+	}
+	copy(configured.hash[:], hash)
+	return configured, nil
+}
+
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("a key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return fmt.Errorf("unknown scope %q, scopes are %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	return nil
+}
+
+var (
+	unauthorizedV2 = apiErrorV2{Code: "unauthorized", Message: "A valid API key or bearer token is required."}
+	forbiddenV2    = apiErrorV2{Code: "forbidden", Message: "The credentials' scopes don't allow that."}
+)
+
+// The API contract and its docs are public
+func publicPath(path string) bool {
+	return path == "/openapi.yml" || path == "/openapi.json" || path == "/docs" || strings.HasPrefix(path, "/docs/")
+}
+
+// Whether a write only touches receipts: submitting, scoring, parsing, importing or deleting them. Claiming one credits
+// a customer, so it isn't
+func receiptWritePath(p string) bool {
+	for _, prefix := range []string{"/receipts/", "/v1/receipts/", "/v2/receipts/"} {
+		if strings.HasPrefix(p, prefix) {
+			return !strings.HasSuffix(p, "/claim")
+		}
+	}
+	return false
+}
+
+// Scope a request needs, by where it goes and whether it changes anything. GraphQL only reads. Writes other than to
+// receipts move points or change who holds them, like claims, redemptions, orders and groups, so they are for admins
+func requiredScope(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return scopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.URL.Path == "/graphql":
+		return scopeRead
+	case receiptWritePath(r.URL.Path):
+		return scopeSubmit
+	default:
+		return scopeAdmin
+	}
+}
+
+const apiKeyContextKey = "apiKey"
+
+// Whether requests need an API key or token, once either is configured
+func credentialsRequired() bool {
+	return apiKeys.isRequired() || bearerTokens.Load() != nil
+}
+
+// Checks the bearer token or X-API-Key header and that its scopes cover the request. Credentials are optional until
+// API_KEYS_FILE or JWT_JWKS is loaded, but any that are sent are always checked
+func authenticate(c *gin.Context) {
+	if publicPath(c.Request.URL.Path) {
+		return
+	}
+	if token, ok := bearerToken(c.GetHeader("Authorization")); ok {
+		authenticateToken(c, token)
+		return
+	}
+
+	secret := c.GetHeader("X-API-Key")
+	if secret == "" {
+		if credentialsRequired() {
+			abortWithError(c, http.StatusUnauthorized, unauthorizedV2)
+		}
+		return
+	}
+
+	key, ok := apiKeys.authenticate(secret, time.Now().UTC())
+	if !ok {
+		abortWithError(c, http.StatusUnauthorized, unauthorizedV2)
+		return
+	}
+	if !key.allows(requiredScope(c.Request)) {
+		abortWithError(c, http.StatusForbidden, forbiddenV2)
+		return
+	}
+	c.Set(apiKeyContextKey, key)
+}
+
+// The key authenticate accepted for the request, if it had one
+func requestAPIKey(c *gin.Context) (apiKey, bool) {
+	key, ok := c.Get(apiKeyContextKey)
+	if !ok {
+		return apiKey{}, false
+	}
+	return key.(apiKey), true
+}
+
+// Scope each gRPC method needs, scoring is a submission like over HTTP
+var grpcScopes = map[string]string{
+	receiptsv1.ReceiptService_ProcessReceipt_FullMethodName: scopeSubmit,
+	receiptsv1.ReceiptService_ScoreReceipt_FullMethodName:   scopeSubmit,
+	receiptsv1.ReceiptService_GetPoints_FullMethodName:      scopeRead,
+	receiptsv1.ReceiptService_StreamReceipts_FullMethodName: scopeRead,
+}
+
+type apiKeyKey struct{}
+
+// Checks the authorization or x-api-key metadata of a gRPC call like authenticate does the headers, adding the token's
+// caller or the key to the context
+func authenticateGrpc(ctx context.Context, method string) (context.Context, error) {
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		if token, ok := bearerToken(values[0]); ok {
+			return authenticateGrpcToken(ctx, method, token)
+		}
+	}
+
+	var secret string
+	if values := metadata.ValueFromIncomingContext(ctx, "x-api-key"); len(values) > 0 {
+		secret = values[0]
+	}
+	if secret == "" {
+		if credentialsRequired() {
+			return nil, status.Error(codes.Unauthenticated, unauthorizedV2.Message)
+		}
+		return ctx, nil
+	}
+
+	key, ok := apiKeys.authenticate(secret, time.Now().UTC())
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, unauthorizedV2.Message)
+	}
+	scope, ok := grpcScopes[method]
+	if !ok || !key.allows(scope) {
+		return nil, status.Error(codes.PermissionDenied, forbiddenV2.Message)
+	}
+	return context.WithValue(ctx, apiKeyKey{}, key), nil
+}
+
+func authenticateUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := authenticateGrpc(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authenticateStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticateGrpc(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// A server stream whose context carries its key
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcAPIKey(ctx context.Context) (apiKey, bool) {
+	key, ok := ctx.Value(apiKeyKey{}).(apiKey)
+	return key, ok
+}
+
+var adminNotConfiguredV2 = apiErrorV2{Code: "forbidden", Message: "The admin APIs can only be used once API_KEYS_FILE or JWT_JWKS is configured."}
+
+// Until credentials are required nobody could be told apart from an admin, so a key created then would let anyone
+// make themselves one and a webhook would let anyone make the server call any URL. The first admin key comes from
+// API_KEYS_FILE instead, and every /admin route waits for it
+func requireConfiguredCredentials(c *gin.Context) {
+	if !credentialsRequired() {
+		abortWithError(c, http.StatusForbidden, adminNotConfiguredV2)
+	}
+}
+
+var (
+	invalidAPIKeyV2  = apiErrorV2{Code: "invalid_request", Message: "The API key is invalid."}
+	apiKeyNotFoundV2 = apiErrorV2{Code: "api_key_not_found", Message: "No API key found for that ID."}
+)
+
+func setupAPIKeyAdminAPI(group *gin.RouterGroup) {
+	admin := group.Group("/keys", validateRequests(func(c *gin.Context, err error) {
+		respondErrorV2(c, http.StatusBadRequest, invalidAPIKeyV2)
+	}))
+	admin.POST("", createAPIKey)
+	admin.GET("", listAPIKeys)
+	admin.GET("/:id", getAPIKey)
+	admin.POST("/:id/revoke", revokeAPIKey)
+}
+
+// A key as returned when it is created, the only time its secret is shown
+type createdAPIKey struct {
+	XMLName xml.Name `json:"-" xml:"apiKey" yaml:"-"`
+	apiKey  `yaml:",inline"`
+	Key     string `json:"key" xml:"key" yaml:"key"`
+}
+
+// POST /admin/keys creates a key for the tenant of the request
+func createAPIKey(c *gin.Context) {
+	var request struct {
+		Name   string   `json:"name" binding:"required"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || checkScopes(request.Scopes) != nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidAPIKeyV2)
+		return
+	}
+
+	created, secret, err := apiKeys.create(request.Name, tenantOf(c).id, request.Scopes)
+	if err != nil {
+		respondErrorV2(c, http.StatusInternalServerError, apiErrorV2{Code: "api_key_failed", Message: "The API key could not be created."})
+		return
+	}
+
+	c.Header("Location", "/admin/keys/"+created.Id)
+	respond(c, http.StatusCreated, createdAPIKey{apiKey: created, Key: secret})
+}
+
+func listAPIKeys(c *gin.Context) {
+	respond(c, http.StatusOK, apiKeys.list(tenantOf(c).id))
+}
+
+func getAPIKey(c *gin.Context) {
+	found, ok := apiKeys.get(tenantOf(c).id, c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, apiKeyNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, found)
+}
+
+// POST /admin/keys/{id}/revoke stops the key working, it stays listed with when it was revoked
+func revokeAPIKey(c *gin.Context) {
+	revoked, ok := apiKeys.revoke(tenantOf(c).id, c.Param("id"), time.Now().UTC())
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, apiKeyNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, revoked)
+}
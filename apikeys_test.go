@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Adds an admin key for the tenant like API_KEYS_FILE would and requires keys until the test ends, returning the key
+func bootstrapAPIKeys(t *testing.T, tenantId string) string {
+	_, secret, err := apiKeys.create("bootstrap", tenantId, []string{scopeAdmin})
+	assert.NoError(t, err)
+	apiKeys.setRequired(true)
+	t.Cleanup(func() { apiKeys.setRequired(false) })
+	return secret
+}
+
+// Creates a key through the admin API with the admin key, in the admin key's tenant
+func newTestAPIKey(t *testing.T, admin string, scopes string) createdAPIKey {
+	w := sendJSON("POST", "/admin/keys", `{"name": "`+t.Name()+`", "scopes": `+scopes+`}`, "X-API-Key", admin)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created createdAPIKey
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "/admin/keys/"+created.Id, w.Header().Get("Location"))
+	return created
+}
+
+// Sends a request to the admin APIs with an admin key, requiring credentials only for that request so the rest of the
+// test can stay anonymous
+func sendAdmin(t *testing.T, method string, path string, body string, header ...string) *httptest.ResponseRecorder {
+	_, secret, err := apiKeys.create("admin", defaultTenantId, []string{scopeAdmin})
+	assert.NoError(t, err)
+
+	required := apiKeys.isRequired()
+	apiKeys.setRequired(true)
+	defer apiKeys.setRequired(required)
+	return sendJSON(method, path, body, append(header, "X-API-Key", secret)...)
+}
+
+func TestAdminNeedsBootstrap(t *testing.T) {
+	// Without configured keys anyone could make themselves an admin
+	w := sendJSON("POST", "/admin/keys", `{"name": "mine", "scopes": ["admin"]}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = sendJSON("GET", "/admin/keys", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// or point the server's webhooks anywhere and read what they carry
+	w = sendJSON("POST", "/admin/webhooks", `{"url": "http://169.254.169.254/", "secret": "shh"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = sendJSON("GET", "/admin/webhooks/dead-letters", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = sendJSON("GET", "/admin/rewards", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, adminNotConfiguredV2, body.Error)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	bootstrap := bootstrapAPIKeys(t, defaultTenantId)
+	reader := newTestAPIKey(t, bootstrap, `["read"]`)
+	assert.Regexp(t, `^rpk_[0-9a-f]{64}$`, reader.Key)
+	assert.Equal(t, reader.Key[:12], reader.Prefix)
+	assert.Equal(t, defaultTenantId, reader.TenantId)
+	assert.Nil(t, reader.LastUsedAt)
+
+	w := sendJSON("GET", "/v2/receipts/missing", "", "X-API-Key", reader.Key)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "X-API-Key", reader.Key)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, forbiddenV2, body.Error)
+	w = sendJSON("GET", "/admin/keys", "", "X-API-Key", reader.Key)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Admin keys can do anything
+	admin := newTestAPIKey(t, bootstrap, `["admin"]`)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "X-API-Key", admin.Key)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = sendJSON("GET", "/admin/keys/"+reader.Id, "", "X-API-Key", admin.Key)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found apiKey
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	assert.NotNil(t, found.LastUsedAt)
+	assert.NotContains(t, w.Body.String(), reader.Key)
+
+	w = sendJSON("POST", "/admin/keys", `{"name": "nothing", "scopes": []}`, "X-API-Key", admin.Key)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = sendJSON("POST", "/admin/keys", `{"name": "everything", "scopes": ["write"]}`, "X-API-Key", admin.Key)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAPIKeyPointsNeedAdmin(t *testing.T) {
+	customerPath := "/v2/customers/" + newTestCustomer(t)
+	bootstrap := bootstrapAPIKeys(t, defaultTenantId)
+	submitter := newTestAPIKey(t, bootstrap, `["submit"]`)
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "X-API-Key", submitter.Key)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+
+	// Submit keys only write receipts. Anything that moves points or changes who holds them is for admins, even
+	// outside /admin
+	for _, write := range [][2]string{
+		{customerPath + "/adjustments", `{"points": 10, "memo": "Goodwill"}`},
+		{"/v2/ledger/entries/missing/reversal", ""},
+		{customerPath + "/redemptions", `{"points": 1}`},
+		{customerPath + "/orders", `{"rewardId": "missing"}`},
+		{"/v2/receipts/" + submitted.Id + "/claim", `{"customerId": "missing"}`},
+		{"/v2/groups", `{"name": "Household", "ownerId": "missing"}`},
+		{"/v2/customers", `{"name": "Pat"}`},
+	} {
+		w = sendJSON("POST", write[0], write[1], "X-API-Key", submitter.Key)
+		assert.Equal(t, http.StatusForbidden, w.Code, write[0])
+	}
+
+	w = sendJSON("POST", customerPath+"/adjustments", `{"points": 10, "memo": "Goodwill"}`, "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = sendJSON("POST", customerPath+"/redemptions", `{"points": 1}`, "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestRevokedAPIKey(t *testing.T) {
+	bootstrap := bootstrapAPIKeys(t, defaultTenantId)
+	created := newTestAPIKey(t, bootstrap, `["read"]`)
+
+	w := sendJSON("POST", "/admin/keys/"+created.Id+"/revoke", "", "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var revoked apiKey
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &revoked))
+	assert.NotNil(t, revoked.RevokedAt)
+
+	w = sendJSON("GET", "/v2/receipts/missing", "", "X-API-Key", created.Key)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, unauthorizedV2, body.Error)
+	w = sendJSON("GET", "/receipts/missing/points", "", "X-API-Key", "rpk_unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"description": "A valid API key or bearer token is required."}`, w.Body.String())
+
+	w = sendJSON("POST", "/admin/keys/missing/revoke", "", "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAPIKeysRequired(t *testing.T) {
+	submitter := newTestAPIKey(t, bootstrapAPIKeys(t, defaultTenantId), `["submit"]`)
+
+	// A key created through the API is required like the configured ones
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON("POST", "/admin/keys", `{"name": "mine", "scopes": ["admin"]}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "X-API-Key", submitter.Key)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// The contract stays public
+	w = sendJSON("GET", "/openapi.yml", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	client := newGrpcClient(t)
+	_, err := client.GetPoints(context.Background(), &receiptsv1.GetPointsRequest{Id: "missing"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", submitter.Key)
+	_, err = client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: "missing"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.ScoreReceipt(ctx, &receiptsv1.ScoreReceiptRequest{Receipt: &receiptsv1.Receipt{
+		Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "13:13", Total: "1.25",
+		Items: []*receiptsv1.Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+	}})
+	assert.NoError(t, err)
+}
+
+func TestAPIKeyTenant(t *testing.T) {
+	other := newTestTenant(t, `{}`)
+	bootstrap := bootstrapAPIKeys(t, defaultTenantId)
+	otherAdmin := bootstrapAPIKeys(t, other.id)
+
+	// Admin keys only create keys in their own tenant
+	w := sendJSON("POST", "/admin/keys", `{"name": "elsewhere", "scopes": ["read"]}`, "X-API-Key", bootstrap, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	created := newTestAPIKey(t, otherAdmin, `["submit", "read"]`)
+	assert.Equal(t, other.id, created.TenantId)
+
+	// The key's requests are its tenant's without naming it
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "X-API-Key", created.Key)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "X-API-Key", created.Key, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "X-API-Key", created.Key, "Tenant-Id", defaultTenantId)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Keys are only listed to their own tenant
+	w = sendJSON("GET", "/admin/keys/"+created.Id, "", "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("GET", "/admin/keys", "", "X-API-Key", otherAdmin)
+	var keys []apiKey
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &keys))
+	assert.Len(t, keys, 2)
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	t.Cleanup(func() { apiKeys.setRequired(false) })
+
+	secret := "rpk_" + t.Name()
+	hash := sha256.Sum256([]byte(secret))
+	for name, config := range map[string]string{
+		"not json":       `{`,
+		"unknown tenant": `[{"name": "a", "tenantId": "missing", "scopes": ["read"], "sha256": "` + hex.EncodeToString(hash[:]) + `"}]`,
+		"no scopes":      `[{"name": "a", "scopes": [], "sha256": "` + hex.EncodeToString(hash[:]) + `"}]`,
+		"unknown scope":  `[{"name": "a", "scopes": ["write"], "sha256": "` + hex.EncodeToString(hash[:]) + `"}]`,
+		"not a hash":     `[{"name": "a", "scopes": ["read"], "sha256": "` + secret + `"}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+		assert.Error(t, loadAPIKeys(path), name)
+	}
+	assert.False(t, apiKeys.isRequired())
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "bootstrap", "scopes": ["admin"], "sha256": "`+hex.EncodeToString(hash[:])+`"}]`), 0o600))
+	assert.NoError(t, loadAPIKeys(path))
+	assert.True(t, apiKeys.isRequired())
+
+	w := sendJSON("POST", "/admin/keys", `{"name": "created", "scopes": ["read"]}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON("POST", "/admin/keys", `{"name": "created", "scopes": ["read"]}`, "X-API-Key", secret)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// The same key can't be loaded twice
+	assert.ErrorIs(t, loadAPIKeys(path), errDuplicateAPIKey)
+}
+
+func TestAPIKeyAdminErrorsAndFormats(t *testing.T) {
+	bootstrap := bootstrapAPIKeys(t, defaultTenantId)
+
+	w := sendJSON("GET", "/admin/keys/missing", "", "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, apiKeyNotFoundV2, body.Error)
+
+	w = sendJSON("POST", "/admin/keys", `{"scopes": ["read"]}`, "X-API-Key", bootstrap)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, invalidAPIKeyV2, body.Error)
+
+	w = sendJSON("POST", "/admin/keys", `{"name": "yaml", "scopes": ["read"]}`, "X-API-Key", bootstrap, "Accept", "application/yaml")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), "name: yaml")
+	assert.Contains(t, w.Body.String(), "key: rpk_")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const DefaultWorkers = 4
+const QueueSize = 1024
+
+type queuedReceipt struct {
+	tenant      *tenant
+	id          string
+	receipt     Receipt
+	submittedAt time.Time
+	customerId  string
+}
+
+var receiptQueue chan queuedReceipt
+var startWorkersOnce sync.Once
+
+// Starts the worker pool once, size from env or default
+func startWorkers() {
+	startWorkersOnce.Do(func() {
+		workers, err := strconv.Atoi(os.Getenv("WORKERS"))
+		if err != nil || workers < 1 {
+			workers = DefaultWorkers
+		}
+
+		receiptQueue = make(chan queuedReceipt, QueueSize)
+		for i := 0; i < workers; i++ {
+			go scoreQueuedReceipts()
+		}
+	})
+}
+
+// Stores the receipt as pending and queues it for scoring, false if the queue is full
+func (t *tenant) enqueueReceipt(id string, receipt Receipt, customerId string) (storedReceipt, bool) {
+	queued := queuedReceipt{tenant: t, id: id, receipt: receipt, submittedAt: time.Now().UTC(), customerId: customerId}
+	pending := storedReceipt{Receipt: receipt, Status: statusPending, Async: true, SubmittedAt: queued.submittedAt, CustomerId: customerId}
+	t.receipts.Store(id, pending)
+
+	select {
+	case receiptQueue <- queued:
+		return pending, true
+	default:
+		t.receipts.Delete(id)
+		return storedReceipt{}, false
+	}
+}
+
+func scoreQueuedReceipts() {
+	for queued := range receiptQueue {
+		queued.tenant.scoreQueued(queued)
+	}
+}
+
+// Scores a receipt taken off the queue. A receipt deleted while it waited is dropped rather than stored again
+func (t *tenant) scoreQueued(queued queuedReceipt) {
+	processing := storedReceipt{Receipt: queued.receipt, Status: statusProcessing, Async: true, SubmittedAt: queued.submittedAt, CustomerId: queued.customerId}
+	if !t.updateStoredReceipt(queued.id, func() { t.receipts.Store(queued.id, processing) }) {
+		return
+	}
+
+	result, err := t.score(queued.receipt)
+	if err != nil {
+		failed := storedReceipt{Receipt: queued.receipt, Status: statusFailed, Err: err, Async: true, SubmittedAt: queued.submittedAt, CustomerId: queued.customerId}
+		if t.updateStoredReceipt(queued.id, func() { t.receipts.Store(queued.id, failed) }) {
+			t.publishWebhookEvent(eventReceiptRejected, gin.H{"id": queued.id, "receipt": queued.receipt})
+		}
+		return
+	}
+
+	// A receipt that couldn't be credited fails, so it isn't reported as done without its points
+	scored := storedReceipt{Receipt: queued.receipt, Status: statusDone, Points: result.Points, Breakdown: result.Breakdown, Async: true, SubmittedAt: queued.submittedAt, CustomerId: queued.customerId}
+	scored, err = t.creditScoredReceipt(queued.id, scored)
+	if err != nil {
+		failed := storedReceipt{Receipt: queued.receipt, Status: statusFailed, Err: err, Async: true, SubmittedAt: queued.submittedAt, CustomerId: queued.customerId}
+		t.updateStoredReceipt(queued.id, func() { t.receipts.Store(queued.id, failed) })
+		return
+	}
+
+	// Only the write waits for receiptsMu. Points credited to a receipt deleted meanwhile are kept, as they would be
+	// had it been deleted just after, but it isn't announced
+	if t.updateStoredReceipt(queued.id, func() { t.receipts.Store(queued.id, scored) }) {
+		t.announceScoredReceipt(queued.id, scored)
+	}
+}
+
+// Runs update if the receipt is still stored, holding receiptsMu so it can't be deleted meanwhile. False if it was
+// deleted
+func (t *tenant) updateStoredReceipt(id string, update func()) bool {
+	t.receiptsMu.Lock()
+	defer t.receiptsMu.Unlock()
+	if _, ok := t.receipts.Load(id); !ok {
+		return false
+	}
+	update()
+	return true
+}
+
+// Whether the Prefer header (RFC 7240) contains the respond-async preference
+func prefersAsync(prefer string) bool {
+	for _, preference := range strings.Split(prefer, ",") {
+		// Preferences may carry parameters, e.g. `respond-async; wait=10`
+		token, _, _ := strings.Cut(preference, ";")
+		if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
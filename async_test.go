@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type statusResponse struct {
+	Status string `json:"status"`
+	Points int    `json:"points"`
+}
+
+// Polls the points endpoint until the receipt leaves the pending/processing states
+func pollReceiptStatus(t *testing.T, id string) (int, statusResponse) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/"+id+"/points", nil))
+
+		var response statusResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+		if w.Code != http.StatusAccepted || time.Now().After(deadline) {
+			return w.Code, response
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAsyncReceiptScored(t *testing.T) {
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewBufferString(`{
+  "retailer": "M&M Corner Market",
+  "purchaseDate": "2022-03-20",
+  "purchaseTime": "14:33",
+  "items": [
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" }
+  ],
+  "total": "9.00"
+}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async, wait=5")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// Accepted immediately with the ID and applied preference
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "respond-async", w.Header().Get("Preference-Applied"))
+
+	var response postResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "/receipts/"+response.Id+"/points", w.Header().Get("Location"))
+
+	code, status := pollReceiptStatus(t, response.Id)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "done", status.Status)
+	assert.Equal(t, 109, status.Points)
+}
+
+func TestAsyncReceiptFailed(t *testing.T) {
+	// Passes binding but fails validation in the worker
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewBufferString(`{
+  "retailer": "!!!@@@###",
+  "purchaseDate": "2025-01-15",
+  "purchaseTime": "15:30",
+  "items": [{ "shortDescription": "B", "price": "1.00" }],
+  "total": "1.00"
+}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var response postResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	code, status := pollReceiptStatus(t, response.Id)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "failed", status.Status)
+}
+
+func TestAsyncReceiptDeletedWhileQueued(t *testing.T) {
+	tenant := defaultTenant()
+	var receipt Receipt
+	assert.NoError(t, json.Unmarshal([]byte(simpleReceiptPayload), &receipt))
+
+	// Stored as pending without reaching the workers, then deleted before one picks it up
+	queued := queuedReceipt{tenant: tenant, id: t.Name(), receipt: receipt, submittedAt: time.Now().UTC()}
+	tenant.receipts.Store(queued.id, storedReceipt{Receipt: receipt, Status: statusPending, Async: true, SubmittedAt: queued.submittedAt})
+	w := sendJSON("DELETE", "/receipts/"+queued.id, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	tenant.scoreQueued(queued)
+	_, ok := tenant.receipts.Load(queued.id)
+	assert.False(t, ok)
+}
+
+func TestPrefersAsync(t *testing.T) {
+	assert.True(t, prefersAsync("respond-async"))
+	assert.True(t, prefersAsync("return=minimal, Respond-Async; wait=10"))
+	assert.False(t, prefersAsync(""))
+	assert.False(t, prefersAsync("return=representation"))
+}
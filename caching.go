@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version of the scoring rules in Score, bump whenever a rule changes so cached points are invalidated
+const RulesVersion = "1"
+
+// How long clients may keep points that can no longer change
+const settledMaxAge = 24 * 60 * 60
+
+// Strong ETag over the rule set version, the stored score and who it was credited to, distinct per response format
+func pointsETag(stored storedReceipt, format string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d:%s:%s", RulesVersion, stored.Status, stored.Points, stored.CustomerId, format)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// Points of queued receipts will still change, and so will those of unclaimed ones once a claim adds the customer's
+// tier and streak bonuses. Everything else is settled under the current rules
+func canRescore(stored storedReceipt) bool {
+	return stored.Status == statusPending || stored.Status == statusProcessing || stored.Status == statusDone && stored.CustomerId == ""
+}
+
+// Sets ETag and Cache-Control for the stored points, answering 304 Not Modified if the client's copy is current
+func notModified(c *gin.Context, stored storedReceipt) bool {
+	etag := pointsETag(stored, responseFormat(c))
+	c.Header("ETag", etag)
+
+	// Unsettled points must be revalidated on every use. Settled ones are private since receipts belong to a tenant
+	// and often a customer, so a shared cache mustn't serve them to another caller
+	if canRescore(stored) {
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", settledMaxAge))
+	}
+
+	if !etagMatches(c.GetHeader("If-None-Match"), etag) {
+		return false
+	}
+
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// If-None-Match uses weak comparison (RFC 9110 13.1.2), so W/ prefixes are ignored
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
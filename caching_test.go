@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPointsConditionalGet(t *testing.T) {
+	id := submitReceipt(t, simpleReceiptPayload)
+	w := sendJSON("POST", "/v2/receipts/"+id+"/claim", `{"customerId": "`+newTestCustomer(t)+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/"+id+"/points", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "private, max-age=86400", w.Header().Get("Cache-Control"))
+
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+	// Matching ETag, in a list or weak, is not modified
+	for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		req := httptest.NewRequest("GET", "/receipts/"+id+"/points", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+	}
+
+	req := httptest.NewRequest("GET", "/receipts/"+id+"/points", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"points": 31}`, w.Body.String())
+}
+
+func TestPointsETagChangesWithScore(t *testing.T) {
+	pending := storedReceipt{Status: statusPending}
+	done := storedReceipt{Status: statusDone, Points: 31}
+
+	assert.NotEqual(t, pointsETag(pending, formatJSON), pointsETag(done, formatJSON))
+	assert.NotEqual(t, pointsETag(done, formatJSON), pointsETag(storedReceipt{Status: statusDone, Points: 32}, formatJSON))
+	assert.Equal(t, pointsETag(done, formatJSON), pointsETag(storedReceipt{Status: statusDone, Points: 31}, formatJSON))
+
+	// Each representation gets its own strong validator
+	assert.NotEqual(t, pointsETag(done, formatJSON), pointsETag(done, formatXML))
+
+	// Only queued or unclaimed receipts can still be rescored
+	claimed := storedReceipt{Status: statusDone, Points: 31, CustomerId: "customer"}
+	assert.NotEqual(t, pointsETag(done, formatJSON), pointsETag(claimed, formatJSON))
+	assert.True(t, canRescore(pending))
+	assert.True(t, canRescore(done))
+	assert.False(t, canRescore(claimed))
+	assert.False(t, canRescore(storedReceipt{Status: statusFailed}))
+}
+
+func TestClaimInvalidatesCachedPoints(t *testing.T) {
+	id := submitReceipt(t, simpleReceiptPayload)
+
+	// Unclaimed points aren't fresh, since a claim adds the customer's bonuses
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/receipts/"+id+"/points", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+
+	w = sendJSON("POST", "/v2/receipts/"+id+"/claim", `{"customerId": "`+newTestCustomer(t)+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req := httptest.NewRequest("GET", "/v2/receipts/"+id+"/points", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "private, max-age=86400", w.Header().Get("Cache-Control"))
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"receipt-processor-api/client"
+
+	"github.com/gin-gonic/gin"
+)
+
+const DefaultServer = "http://localhost:8080"
+
+const cliUsage = `Usage: receiptctl <command> [flags] [args]
+
+Commands:
+  serve                 run the HTTP and gRPC APIs (the default without a command)
+  submit <file|->       submit a receipt and print its points
+  points <id>           print the points of a submitted receipt
+  score <file|->        score a receipt without storing it, --offline scores it without a server
+  batch <dir>           submit every .json receipt in a directory
+  breakdown [file|dir]  score receipt files offline, examples/ by default, and print their breakdowns
+  export                print every stored receipt as JSON lines or --format csv
+  import <file|->       import a CSV or XLSX file of receipts, --offline scores it without a server
+
+Commands that talk to a server use --server, default $RECEIPTCTL_SERVER or ` + DefaultServer + `, and send
+--api-key, default $RECEIPTCTL_API_KEY, if set.
+--json prints the server's response instead of a README-style breakdown.
+`
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+var errUsage = errors.New("usage")
+
+// Runs receiptctl with the arguments after the program name and returns its exit code
+func runCLI(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	commands := map[string]func(cli *cliCommand) error{
+		"serve":     serveCommand,
+		"submit":    submitCommand,
+		"points":    pointsCommand,
+		"score":     scoreCommand,
+		"batch":     batchCommand,
+		"breakdown": breakdownCommand,
+		"export":    exportCommand,
+		"import":    importCommand,
+	}
+
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprint(stderr, cliUsage)
+		if command == "help" || command == "-h" || command == "--help" {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	cli := newCLICommand(command, stdin, stdout, stderr)
+	if err := cli.flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if err := run(cli); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(stderr, cliUsage)
+			return exitUsage
+		}
+		fmt.Fprintln(stderr, "receiptctl:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// Flags and streams shared by every command
+type cliCommand struct {
+	flags   *flag.FlagSet
+	server  *string
+	apiKey  *string
+	json    *bool
+	offline *bool
+	format  *string
+	columns *string
+	stdin   io.Reader
+	stdout  io.Writer
+}
+
+func newCLICommand(name string, stdin io.Reader, stdout io.Writer, stderr io.Writer) *cliCommand {
+	server := os.Getenv("RECEIPTCTL_SERVER")
+	if server == "" {
+		server = DefaultServer
+	}
+
+	flags := flag.NewFlagSet("receiptctl "+name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	return &cliCommand{
+		flags:   flags,
+		server:  flags.String("server", server, "base URL of the receipt processor"),
+		apiKey:  flags.String("api-key", os.Getenv("RECEIPTCTL_API_KEY"), "API key to send with requests"),
+		json:    flags.Bool("json", false, "print JSON instead of a breakdown"),
+		offline: flags.Bool("offline", false, "score locally without a server (score only)"),
+		format:  flags.String("format", "json", "export format, json or csv (export only)"),
+		columns: flags.String("columns", "", "import column headers that differ from field names, e.g. price=Amount,total=Total Paid (import only)"),
+		stdin:   stdin,
+		stdout:  stdout,
+	}
+}
+
+func (cli *cliCommand) client() *client.Client {
+	return client.New(*cli.server, client.WithAPIKey(*cli.apiKey))
+}
+
+// The single positional argument, or a usage error
+func (cli *cliCommand) arg() (string, error) {
+	if cli.flags.NArg() != 1 {
+		return "", errUsage
+	}
+	return cli.flags.Arg(0), nil
+}
+
+// Reads the receipt JSON in the named file, or stdin for -
+func (cli *cliCommand) readReceipt(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(cli.stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func (cli *cliCommand) printJSON(value any) error {
+	encoder := json.NewEncoder(cli.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func serveCommand(cli *cliCommand) error {
+	if cli.flags.NArg() != 0 {
+		return errUsage
+	}
+	return serve()
+}
+
+func submitCommand(cli *cliCommand) error {
+	name, err := cli.arg()
+	if err != nil {
+		return err
+	}
+
+	var receipt client.Receipt
+	if err := decodeReceiptFile(cli, name, &receipt); err != nil {
+		return err
+	}
+
+	result, err := cli.client().Process(context.Background(), receipt)
+	if err != nil {
+		return err
+	}
+	if *cli.json {
+		return cli.printJSON(result)
+	}
+
+	fmt.Fprintln(cli.stdout, "ID:", result.ID)
+	return printResult(cli.stdout, result)
+}
+
+func pointsCommand(cli *cliCommand) error {
+	id, err := cli.arg()
+	if err != nil {
+		return err
+	}
+
+	result, err := cli.client().Points(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	if *cli.json {
+		return cli.printJSON(result)
+	}
+	return printResult(cli.stdout, result)
+}
+
+func scoreCommand(cli *cliCommand) error {
+	name, err := cli.arg()
+	if err != nil {
+		return err
+	}
+
+	if !*cli.offline {
+		var receipt client.Receipt
+		if err := decodeReceiptFile(cli, name, &receipt); err != nil {
+			return err
+		}
+
+		score, err := cli.client().Score(context.Background(), receipt)
+		if err != nil {
+			return err
+		}
+		if *cli.json {
+			return cli.printJSON(score)
+		}
+		return printBreakdown(cli.stdout, receipt.Retailer, Result{Points: score.Points, Breakdown: awardsFromClient(score.Breakdown)})
+	}
+
+	var receipt Receipt
+	if err := decodeReceiptFile(cli, name, &receipt); err != nil {
+		return err
+	}
+
+	result, err := Score(receipt)
+	if err != nil {
+		return err
+	}
+	if *cli.json {
+		return cli.printJSON(client.Score{Points: result.Points, Breakdown: awardsToClient(result.Breakdown)})
+	}
+	return printBreakdown(cli.stdout, receipt.Retailer, result)
+}
+
+func batchCommand(cli *cliCommand) error {
+	dir, err := cli.arg()
+	if err != nil {
+		return err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	receipts := make([]client.Receipt, len(names))
+	for i, name := range names {
+		if err := decodeReceiptFile(cli, name, &receipts[i]); err != nil {
+			return err
+		}
+	}
+
+	results := cli.client().Batch(context.Background(), receipts)
+
+	failed := 0
+	for i, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+
+		if *cli.json {
+			line := struct {
+				File   string         `json:"file"`
+				Result *client.Result `json:"result,omitempty"`
+				Error  string         `json:"error,omitempty"`
+			}{File: names[i], Result: result.Result}
+			if result.Err != nil {
+				line.Error = result.Err.Error()
+			}
+			if err := json.NewEncoder(cli.stdout).Encode(line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if result.Err != nil {
+			fmt.Fprintf(cli.stdout, "%s: %v\n", names[i], result.Err)
+		} else {
+			fmt.Fprintf(cli.stdout, "%s: %s %d points\n", names[i], result.Result.ID, result.Result.Points)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d receipts failed", failed, len(results))
+	}
+	return nil
+}
+
+// Scores receipt files offline and prints their breakdowns separated like the README examples.
+// Receipts that fail validation are reported in place and fail the command once every file is printed
+func breakdownCommand(cli *cliCommand) error {
+	args := cli.flags.Args()
+	if len(args) == 0 {
+		args = []string{"examples"}
+	}
+
+	var names []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			names = append(names, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.json"))
+		if err != nil {
+			return err
+		}
+		names = append(names, matches...)
+	}
+
+	failed := 0
+	for i, name := range names {
+		if i > 0 {
+			fmt.Fprint(cli.stdout, "\n---\n\n")
+		}
+		if len(names) > 1 {
+			fmt.Fprintf(cli.stdout, "%s\n\n", name)
+		}
+
+		var receipt Receipt
+		if err := decodeReceiptFile(cli, name, &receipt); err != nil {
+			return err
+		}
+
+		result, err := Score(receipt)
+		if err != nil {
+			failed++
+			fmt.Fprintf(cli.stdout, "%s: %v\n", name, err)
+			continue
+		}
+		if err := printBreakdown(cli.stdout, receipt.Retailer, result); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d receipts are invalid", failed, len(names))
+	}
+	return nil
+}
+
+// Imports a CSV or XLSX file on the server, or scores it locally with --offline, and reports every row that failed
+func importCommand(cli *cliCommand) error {
+	name, err := cli.arg()
+	if err != nil {
+		return err
+	}
+
+	columns, err := parseImportColumns(*cli.columns)
+	if err != nil {
+		return err
+	}
+
+	file, err := cli.readReceipt(name)
+	if err != nil {
+		return err
+	}
+	contentType := importContentType(name)
+
+	report := importReport{Receipts: []importedReceipt{}, Errors: []importRowError{}}
+	if *cli.offline {
+		rows, err := readImportRows(contentType, bytes.NewReader(file))
+		if err != nil {
+			return err
+		}
+		report, err = importReceipts(rows, columns, contentType == mimeXLSX, func(receipt Receipt) (string, Result, error) {
+			result, err := Score(receipt)
+			return "", result, err
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// Only send the headers that were mapped
+		mapped := map[string]string{}
+		for field, header := range columns {
+			if header != field {
+				mapped[field] = header
+			}
+		}
+
+		imported, err := cli.client().Import(context.Background(), file, contentType, mapped)
+		if err != nil {
+			return err
+		}
+		for _, receipt := range imported.Receipts {
+			report.Receipts = append(report.Receipts, importedReceipt{Rows: receipt.Rows, Id: receipt.ID, Points: receipt.Points})
+		}
+		for _, rowError := range imported.Errors {
+			report.Errors = append(report.Errors, importRowError(rowError))
+		}
+	}
+
+	if *cli.json {
+		if err := cli.printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		for _, receipt := range report.Receipts {
+			rows := make([]string, len(receipt.Rows))
+			for i, row := range receipt.Rows {
+				rows[i] = strconv.Itoa(row)
+			}
+			fmt.Fprintf(cli.stdout, "rows %s: %s\n", strings.Join(rows, ", "), strings.TrimSpace(receipt.Id+" "+strconv.Itoa(receipt.Points)+" points"))
+		}
+		for _, rowError := range report.Errors {
+			fmt.Fprintf(cli.stdout, "row %d: %s\n", rowError.Row, rowError.Message)
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d rows could not be imported", len(report.Errors))
+	}
+	return nil
+}
+
+// Receipts per GraphQL page, small enough to stay under GraphqlMaxComplexity with items and breakdowns
+const exportPageSize = 25
+
+// Pages through the GraphQL API, which lists receipts oldest first
+func exportCommand(cli *cliCommand) error {
+	if cli.flags.NArg() != 0 || (*cli.format != "json" && *cli.format != "csv") {
+		return errUsage
+	}
+
+	writer := csv.NewWriter(cli.stdout)
+	if *cli.format == "csv" {
+		writer.Write([]string{"id", "status", "points", "retailer", "purchaseDate", "purchaseTime", "total", "items"})
+	}
+
+	for offset := 0; ; offset += exportPageSize {
+		page, err := fetchReceiptPage(*cli.server, *cli.apiKey, offset)
+		if err != nil {
+			return err
+		}
+
+		for _, receipt := range page {
+			if *cli.format == "json" {
+				if err := json.NewEncoder(cli.stdout).Encode(receipt); err != nil {
+					return err
+				}
+				continue
+			}
+
+			points := ""
+			if receipt.Points != nil {
+				points = strconv.Itoa(*receipt.Points)
+			}
+			writer.Write([]string{receipt.Id, receipt.Status, points, receipt.Retailer, receipt.PurchaseDate,
+				receipt.PurchaseTime, receipt.Total, strconv.Itoa(len(receipt.Items))})
+		}
+
+		if len(page) < exportPageSize {
+			break
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+const exportQuery = `query ($limit: Int!, $offset: Int!) {
+  receipts(limit: $limit, offset: $offset) {
+    id status points submittedAt retailer purchaseDate purchaseTime total
+    items { shortDescription price }
+    breakdown { rule points description }
+  }
+}`
+
+func fetchReceiptPage(server string, apiKey string, offset int) ([]receiptNode, error) {
+	body, err := json.Marshal(gin.H{"query": exportQuery, "variables": gin.H{"limit": exportPageSize, "offset": offset}})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+"/graphql", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Refused requests, like a bad API key or query, answer with an error body rather than a page
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("export: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result struct {
+		Data struct {
+			Receipts []receiptNode `json:"receipts"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("export: %s: %w", resp.Status, err)
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("export: %s", result.Errors[0].Message)
+	}
+	return result.Data.Receipts, nil
+}
+
+func decodeReceiptFile(cli *cliCommand, name string, receipt any) error {
+	data, err := cli.readReceipt(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, receipt); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func printResult(w io.Writer, result *client.Result) error {
+	switch result.Status {
+	case client.StatusDone:
+		retailer := ""
+		if result.Receipt != nil {
+			retailer = result.Receipt.Retailer
+		}
+		return printBreakdown(w, retailer, Result{Points: result.Points, Breakdown: awardsFromClient(result.Breakdown)})
+	case client.StatusFailed:
+		_, err := fmt.Fprintln(w, "Status:", result.Status, "-", result.Error)
+		return err
+	default:
+		_, err := fmt.Fprintln(w, "Status:", result.Status)
+		return err
+	}
+}
+
+// Prints the points in the layout of the README examples. Item descriptions continue with the price calculation on a
+// second line, and the retailer's non-alphanumeric characters are noted when the retailer is known
+func printBreakdown(w io.Writer, retailer string, result Result) error {
+	const continuation = "                "
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "Total Points: %d\nBreakdown:\n", result.Points)
+	for _, award := range result.Breakdown {
+		description := award.Description
+		if award.Rule == ruleItemDescription {
+			if first, rest, ok := strings.Cut(description, "), "); ok {
+				description = first + ")\n" + continuation + rest
+			}
+		}
+		fmt.Fprintf(&out, "%6d points - %s\n", award.Points, description)
+
+		if award.Rule == ruleRetailerName {
+			if note := nonAlphanumericNote(retailer); note != "" {
+				fmt.Fprintf(&out, "%snote: %s\n", continuation, note)
+			}
+		}
+	}
+	fmt.Fprintf(&out, "  + ---------\n  = %d points\n", result.Points)
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// e.g. "'&' is not alphanumeric" for M&M Corner Market, spaces go without saying
+func nonAlphanumericNote(retailer string) string {
+	var quoted []string
+	for _, char := range retailer {
+		if isAlphanumeric(char) || char == ' ' || slices.Contains(quoted, "'"+string(char)+"'") {
+			continue
+		}
+		quoted = append(quoted, "'"+string(char)+"'")
+	}
+
+	switch len(quoted) {
+	case 0:
+		return ""
+	case 1:
+		return quoted[0] + " is not alphanumeric"
+	default:
+		return strings.Join(quoted, ", ") + " are not alphanumeric"
+	}
+}
+
+func awardsFromClient(awards []client.Award) []pointsAward {
+	breakdown := make([]pointsAward, len(awards))
+	for i, award := range awards {
+		breakdown[i] = pointsAward(award)
+	}
+	return breakdown
+}
+
+func awardsToClient(breakdown []pointsAward) []client.Award {
+	awards := make([]client.Award, len(breakdown))
+	for i, award := range breakdown {
+		awards[i] = client.Award(award)
+	}
+	return awards
+}
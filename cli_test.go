@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs receiptctl against the test router, returning its exit code, stdout and stderr
+func runReceiptctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI(append(args[:1:1], append([]string{"--server", server.URL}, args[1:]...)...), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLIScoreOffline(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"score", "--offline", "examples/mm-corner-market-example.json"}, nil, &stdout, &stderr)
+	assert.Equal(t, exitOK, code)
+	assert.True(t, strings.HasPrefix(stdout.String(), "Total Points: 109\nBreakdown:\n"))
+	assert.Contains(t, stdout.String(), "    50 points - total is a round dollar amount\n")
+	assert.True(t, strings.HasSuffix(stdout.String(), "  + ---------\n  = 109 points\n"))
+
+	code, _, stderr2 := runReceiptctl(t, `{"retailer": "!!!"}`, "score", "--offline", "-")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr2, "receipt field")
+}
+
+func TestCLISubmitAndPoints(t *testing.T) {
+	code, stdout, _ := runReceiptctl(t, simpleReceiptPayload, "submit", "-")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "Total Points: 31\n")
+
+	id := strings.TrimPrefix(strings.SplitN(stdout, "\n", 2)[0], "ID: ")
+	code, stdout, _ = runReceiptctl(t, "", "points", "--json", id)
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, `"points": 31`)
+
+	code, _, stderr := runReceiptctl(t, "", "points", "missing")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "No receipt found for that ID.")
+}
+
+func TestCLIBatchAndExport(t *testing.T) {
+	code, stdout, _ := runReceiptctl(t, "", "batch", "examples")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "examples/target-example.json: ")
+	assert.Contains(t, stdout, " 28 points\n")
+
+	code, stdout, _ = runReceiptctl(t, "", "export", "--format", "csv")
+	assert.Equal(t, exitOK, code)
+
+	rows, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, "id", rows[0][0])
+
+	retailers := map[string]bool{}
+	for _, row := range rows[1:] {
+		retailers[row[3]] = true
+	}
+	assert.True(t, retailers["M&M Corner Market"])
+
+	code, stdout, stderr := runReceiptctl(t, "", "export", "--api-key", "not-a-key")
+	assert.Equal(t, exitError, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "export: 401 Unauthorized: ")
+}
+
+func TestCLIUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, exitUsage, runCLI([]string{"frobnicate"}, nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "Usage: receiptctl")
+
+	assert.Equal(t, exitUsage, runCLI([]string{"points"}, nil, &stdout, &stderr))
+	assert.Equal(t, exitUsage, runCLI([]string{"export", "--format", "xlsx"}, nil, &stdout, &stderr))
+}
+
+func TestCLIBreakdownLayout(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"breakdown", "examples/target-example.json"}, nil, &stdout, &stderr)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, `Total Points: 28
+Breakdown:
+     6 points - retailer name (Target) has 6 alphanumeric characters
+    10 points - 5 items (2 pairs @ 5 points each)
+     3 points - "Emils Cheese Pizza" is 18 characters (a multiple of 3)
+                item price of 12.25 * 0.2 = 2.45, rounded up is 3 points
+     3 points - "Klarbrunn 12-PK 12 FL OZ" is 24 characters (a multiple of 3)
+                item price of 12.00 * 0.2 = 2.4, rounded up is 3 points
+     6 points - purchase day is odd
+  + ---------
+  = 28 points
+`, stdout.String())
+
+	stdout.Reset()
+	assert.Equal(t, exitOK, runCLI([]string{"breakdown"}, nil, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "examples/mm-corner-market-example.json\n\nTotal Points: 109\n")
+	assert.Contains(t, stdout.String(), "                note: '&' is not alphanumeric\n")
+	assert.Contains(t, stdout.String(), "\n---\n\n")
+}
+
+func TestCLIImport(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"import", "--offline", "examples/receipts.csv"}, nil, &stdout, &stderr)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "rows 2, 3, 4, 5, 6: 28 points\nrows 7, 8, 9, 10: 109 points\n", stdout.String())
+
+	code, stdout2, stderr2 := runReceiptctl(t, "retailer,purchaseDate,purchaseTime,total,shortDescription,cost\nTarget,2022-01-02,13:13,1.25,Pepsi,1.2\n",
+		"import", "--columns", "price=cost", "-")
+	assert.Equal(t, exitError, code)
+	assert.Equal(t, "row 2: cost is invalid.\n", stdout2)
+	assert.Contains(t, stderr2, "1 rows could not be imported")
+}
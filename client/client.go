@@ -0,0 +1,379 @@
+// Package client is a typed Go client for the receipt processor's v2 HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 200 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+
+	// Receipts submitted at once by Batch
+	DefaultBatchConcurrency = 8
+)
+
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+}
+
+type Receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+}
+
+type Status string
+
+const (
+	StatusPending    Status = "pending"
+	StatusProcessing Status = "processing"
+	StatusDone       Status = "done"
+	StatusFailed     Status = "failed"
+)
+
+// Points awarded to a receipt by a single rule
+type Award struct {
+	Rule        string `json:"rule"`
+	Points      int    `json:"points"`
+	Description string `json:"description"`
+}
+
+// A stored receipt, Points and Breakdown are only set once Status is StatusDone
+type Result struct {
+	ID          string    `json:"id"`
+	Status      Status    `json:"status"`
+	Points      int       `json:"points"`
+	Breakdown   []Award   `json:"breakdown"`
+	Error       *Error    `json:"error"`
+	Receipt     *Receipt  `json:"receipt"`
+	SubmittedAt time.Time `json:"submittedAt"`
+}
+
+// Points and breakdown of a receipt scored without storing it
+type Score struct {
+	Points    int     `json:"points"`
+	Breakdown []Award `json:"breakdown"`
+}
+
+var (
+	// The server rejected the request or the receipt in it, see Error.Field
+	ErrInvalid = errors.New("receipt processor: invalid request")
+	// No receipt has the ID
+	ErrNotFound = errors.New("receipt processor: not found")
+)
+
+// Error returned by the API. Use errors.Is with ErrInvalid and ErrNotFound to tell them apart
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Field      string `json:"field,omitempty"`
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("receipt processor: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+	if e.Field != "" {
+		message += ": " + e.Field
+	}
+	return message
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrInvalid:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+type Client struct {
+	baseURL          string
+	httpClient       *http.Client
+	maxRetries       int
+	backoff          time.Duration
+	maxBackoff       time.Duration
+	batchConcurrency int
+	apiKey           string
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// Retries requests answered with 5xx or 429, or that failed to connect, up to maxRetries times. Waits are
+// drawn at random up to backoff, doubling every attempt up to maxBackoff, unless the server sent Retry-After
+func WithRetries(maxRetries int, backoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+func WithBatchConcurrency(concurrency int) Option {
+	return func(c *Client) { c.batchConcurrency = max(concurrency, 1) }
+}
+
+// Sends the API key with every request, servers loaded with API keys refuse requests without one
+func WithAPIKey(apiKey string) Option {
+	return func(c *Client) { c.apiKey = apiKey }
+}
+
+// Client for the service at baseURL, e.g. http://localhost:8080
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:          strings.TrimSuffix(baseURL, "/"),
+		httpClient:       http.DefaultClient,
+		maxRetries:       DefaultMaxRetries,
+		backoff:          DefaultBackoff,
+		maxBackoff:       DefaultMaxBackoff,
+		batchConcurrency: DefaultBatchConcurrency,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Submits the receipt and returns it scored. Retries reuse a generated Idempotency-Key so they can't store it twice
+func (c *Client) Process(ctx context.Context, receipt Receipt) (*Result, error) {
+	var result Result
+	header := http.Header{"Idempotency-Key": {uuid.NewString()}}
+	if err := c.do(ctx, http.MethodPost, "/v2/receipts/process", header, receipt, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Status and points of a stored receipt
+func (c *Client) Points(ctx context.Context, id string) (*Result, error) {
+	var result Result
+	if err := c.do(ctx, http.MethodGet, "/v2/receipts/"+url.PathEscape(id)+"/points", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	result.ID = id
+	return &result, nil
+}
+
+// Scores the receipt without storing it
+func (c *Client) Score(ctx context.Context, receipt Receipt) (*Score, error) {
+	var score Score
+	if err := c.do(ctx, http.MethodPost, "/v2/receipts/score", nil, receipt, &score); err != nil {
+		return nil, err
+	}
+	return &score, nil
+}
+
+// Outcome of an Import. Rows are numbered as in the file, the header is row 1
+type ImportReport struct {
+	Receipts []struct {
+		Rows   []int  `json:"rows"`
+		ID     string `json:"id"`
+		Points int    `json:"points"`
+	} `json:"receipts"`
+	Errors []struct {
+		Row     int    `json:"row"`
+		Column  string `json:"column"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+const (
+	ContentTypeCSV  = "text/csv"
+	ContentTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// Stores every valid receipt in a CSV or XLSX file, one row per item with the receipt fields repeated. columns maps
+// receipt fields to headers that differ from the field names, e.g. {"price": "Amount"}. Imports are never retried,
+// a failed one may already have stored some receipts
+func (c *Client) Import(ctx context.Context, file []byte, contentType string, columns map[string]string) (*ImportReport, error) {
+	var mapping []string
+	for field, header := range columns {
+		mapping = append(mapping, field+"="+header)
+	}
+	sort.Strings(mapping)
+
+	path := "/v2/receipts/import"
+	if len(mapping) > 0 {
+		path += "?" + url.Values{"columns": {strings.Join(mapping, ",")}}.Encode()
+	}
+
+	var report ImportReport
+	if err := c.doRaw(ctx, http.MethodPost, path, http.Header{"Content-Type": {contentType}}, file, &report, 0); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Outcome of one receipt in a Batch, either Result or Err is set
+type BatchResult struct {
+	Result *Result
+	Err    error
+}
+
+// Processes the receipts concurrently, returning their outcomes in the same order. Receipts that fail
+// don't stop the others, only a cancelled context does
+func (c *Client) Batch(ctx context.Context, receipts []Receipt) []BatchResult {
+	results := make([]BatchResult, len(receipts))
+	slots := make(chan struct{}, c.batchConcurrency)
+	done := make(chan struct{})
+
+	for i := range receipts {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+
+			results[i].Result, results[i].Err = c.Process(ctx, receipts[i])
+		}()
+	}
+	for range receipts {
+		<-done
+	}
+	return results
+}
+
+// Sends in as JSON, retrying what can be retried, and decodes a 2xx body into out
+func (c *Client) do(ctx context.Context, method string, path string, header http.Header, in any, out any) error {
+	if in == nil {
+		return c.doRaw(ctx, method, path, header, nil, out, c.maxRetries)
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return c.doRaw(ctx, method, path, header, body, out, c.maxRetries)
+}
+
+// Sends the body as is with the Content-Type in header, retrying up to maxRetries times
+func (c *Client) doRaw(ctx context.Context, method string, path string, header http.Header, body []byte, out any, maxRetries int) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, header, body)
+
+		retryAfter := time.Duration(-1)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			err = decodeError(resp)
+		default:
+			return decodeResponse(resp, out)
+		}
+
+		if attempt >= maxRetries {
+			return err
+		}
+		if retryAfter < 0 {
+			retryAfter = c.jitteredBackoff(attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	c.authorize(req)
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) authorize(req *http.Request) {
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+}
+
+// Full jitter: a random wait up to the exponential backoff for the attempt
+func (c *Client) jitteredBackoff(attempt int) time.Duration {
+	backoff := c.backoff << attempt
+	if backoff <= 0 || backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return rand.N(backoff)
+}
+
+// Retry-After in seconds, -1 if missing or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Maps a v2 {"error": {...}} body onto Error, falling back to the status text for anything else
+func decodeError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	var body struct {
+		Error *Error `json:"error"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(data, &body) != nil || body.Error == nil {
+		body.Error = &Error{Message: http.StatusText(resp.StatusCode)}
+	}
+	body.Error.StatusCode = resp.StatusCode
+	return body.Error
+}
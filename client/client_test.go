@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetriesKeepIdempotencyKey(t *testing.T) {
+	var attempts atomic.Int32
+	keys := make(chan string, 4)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "abc", "status": "done", "points": 28}`))
+		}
+	}))
+	defer server.Close()
+
+	result, err := New(server.URL, WithRetries(3, time.Millisecond, 10*time.Millisecond)).Process(context.Background(), Receipt{})
+	assert.NoError(t, err)
+	assert.Equal(t, 28, result.Points)
+	assert.Equal(t, int32(3), attempts.Load())
+
+	first := <-keys
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, <-keys)
+	assert.Equal(t, first, <-keys)
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error": {"code": "busy", "message": "The server is too busy to accept the receipt."}}`))
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, WithRetries(2, time.Millisecond, time.Millisecond)).Score(context.Background(), Receipt{})
+	assert.Equal(t, int32(3), attempts.Load())
+
+	var apiError *Error
+	assert.ErrorAs(t, err, &apiError)
+	assert.Equal(t, "busy", apiError.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, apiError.StatusCode)
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"code": "invalid_receipt", "message": "The receipt is invalid.", "field": "total"}}`))
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL).Process(context.Background(), Receipt{})
+	assert.Equal(t, int32(1), attempts.Load())
+	assert.True(t, errors.Is(err, ErrInvalid))
+	assert.False(t, errors.Is(err, ErrNotFound))
+	assert.EqualError(t, err, "receipt processor: The receipt is invalid. (400 invalid_receipt): total")
+}
+
+func TestJitteredBackoffIsCapped(t *testing.T) {
+	c := New("http://localhost", WithRetries(10, 100*time.Millisecond, time.Second))
+	for attempt := 0; attempt < 10; attempt++ {
+		backoff := c.jitteredBackoff(attempt)
+		assert.GreaterOrEqual(t, backoff, time.Duration(0))
+		assert.Less(t, backoff, min(100*time.Millisecond<<attempt, time.Second))
+	}
+}
+
+func TestCancelledContextStopsRetrying(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := New(server.URL, WithRetries(100, time.Second, time.Second)).Points(ctx, "abc")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestAPIKeyIsSent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "rpk_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"code": "unauthorized", "message": "A valid API key is required."}}`))
+			return
+		}
+		w.Write([]byte(`{"id": "abc", "status": "done", "points": 28}`))
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL).Points(context.Background(), "abc")
+	var apiError *Error
+	assert.True(t, errors.As(err, &apiError))
+	assert.Equal(t, http.StatusUnauthorized, apiError.StatusCode)
+
+	result, err := New(server.URL, WithAPIKey("rpk_test")).Points(context.Background(), "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, 28, result.Points)
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// A receipt scored by the service
+type Event struct {
+	// Pass to Stream to resume after this event
+	ID        string `json:"-"`
+	ReceiptID string `json:"id"`
+	Retailer  string `json:"retailer"`
+	Points    int    `json:"points"`
+}
+
+// Calls handle with every receipt scored from now on, or after lastEventID if it isn't empty, until ctx is
+// done, handle returns an error or the server closes the stream. A nil error means ctx was done
+func (c *Client) Stream(ctx context.Context, lastEventID string, handle func(Event) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/receipts/stream", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	c.authorize(req)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+	defer resp.Body.Close()
+
+	var id, name, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// A blank line dispatches the event read so far
+		if line == "" {
+			if name == "receipt" {
+				event := Event{ID: id}
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					return err
+				}
+				if err := handle(event); err != nil {
+					return err
+				}
+			}
+			name, data = "", ""
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			name = value
+		case "data":
+			if data != "" {
+				data += "\n"
+			}
+			data += value
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"receipt-processor-api/client"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var clientReceipt = client.Receipt{
+	Retailer:     "Target",
+	PurchaseDate: "2022-01-02",
+	PurchaseTime: "13:13",
+	Items:        []client.Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+	Total:        "1.25",
+}
+
+func newTestClient(t *testing.T) *client.Client {
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return client.New(server.URL, client.WithRetries(0, 0, 0))
+}
+
+func TestClientProcessAndPoints(t *testing.T) {
+	receipts := newTestClient(t)
+	ctx := context.Background()
+
+	result, err := receipts.Process(ctx, clientReceipt)
+	assert.NoError(t, err)
+	assert.Equal(t, client.StatusDone, result.Status)
+	assert.Equal(t, 31, result.Points)
+	assert.Len(t, result.Breakdown, 2)
+
+	points, err := receipts.Points(ctx, result.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, result.ID, points.ID)
+	assert.Equal(t, 31, points.Points)
+
+	_, err = receipts.Points(ctx, "missing")
+	assert.True(t, errors.Is(err, client.ErrNotFound))
+}
+
+func TestClientScoreDoesNotStore(t *testing.T) {
+	receipts := newTestClient(t)
+
+	score, err := receipts.Score(context.Background(), clientReceipt)
+	assert.NoError(t, err)
+	assert.Equal(t, 31, score.Points)
+
+	invalid := clientReceipt
+	invalid.Items = []client.Item{{ShortDescription: "Pepsi", Price: "1.2"}}
+	_, err = receipts.Score(context.Background(), invalid)
+	assert.True(t, errors.Is(err, client.ErrInvalid))
+
+	var apiError *client.Error
+	assert.ErrorAs(t, err, &apiError)
+	assert.Equal(t, "invalid_receipt", apiError.Code)
+	assert.Equal(t, "items[0].price", apiError.Field)
+}
+
+func TestClientBatch(t *testing.T) {
+	receipts := newTestClient(t)
+
+	invalid := clientReceipt
+	invalid.Retailer = "!!!"
+	results := receipts.Batch(context.Background(), []client.Receipt{clientReceipt, invalid, clientReceipt})
+
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[0].Err)
+	assert.True(t, errors.Is(results[1].Err, client.ErrInvalid))
+	assert.NoError(t, results[2].Err)
+	assert.NotEqual(t, results[0].Result.ID, results[2].Result.ID)
+}
+
+func TestClientStream(t *testing.T) {
+	receipts := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	events := make(chan client.Event)
+	go receipts.Stream(ctx, "", func(event client.Event) error {
+		events <- event
+		return nil
+	})
+
+	// Keep submitting until the stream is connected and reports one of ours
+	submitted := map[string]bool{}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-events:
+			if !submitted[event.ReceiptID] {
+				continue
+			}
+			assert.Equal(t, "Target", event.Retailer)
+			assert.Equal(t, 31, event.Points)
+			assert.NotEmpty(t, event.ID)
+			return
+		case <-ticker.C:
+			result, err := receipts.Process(ctx, clientReceipt)
+			if assert.NoError(t, err) {
+				submitted[result.ID] = true
+			}
+		case <-ctx.Done():
+			t.Fatal("no event received")
+		}
+	}
+}
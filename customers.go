@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type customer struct {
+	Id        string    `json:"id" xml:"id" yaml:"id"`
+	Name      string    `json:"name" xml:"name" yaml:"name"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+}
+
+// A ledger entry as it changed a customer's balance, earned points carry the receipt that earned them
+type pointsTransaction struct {
+	Id        string    `json:"id" xml:"id" yaml:"id"`
+	Type      string    `json:"type" xml:"type" yaml:"type"`
+	ReceiptId string    `json:"receiptId,omitempty" xml:"receiptId,omitempty" yaml:"receiptId,omitempty"`
+	OrderId   string    `json:"orderId,omitempty" xml:"orderId,omitempty" yaml:"orderId,omitempty"`
+	Reverses  string    `json:"reverses,omitempty" xml:"reverses,omitempty" yaml:"reverses,omitempty"`
+	Memo      string    `json:"memo,omitempty" xml:"memo,omitempty" yaml:"memo,omitempty"`
+	Points    int       `json:"points" xml:"points" yaml:"points"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+}
+
+var (
+	customerNotFoundV2 = apiErrorV2{Code: "customer_not_found", Message: "No customer found for that ID."}
+	unknownCustomerV2  = apiErrorV2{Code: "unknown_customer", Message: "No customer found for that customer ID."}
+)
+
+func (t *tenant) loadCustomer(id string) (customer, bool) {
+	value, ok := t.customers.Load(id)
+	if !ok {
+		return customer{}, false
+	}
+	return value.(customer), true
+}
+
+// Whether the customer ID sent with a receipt can be credited, an empty one is an anonymous receipt
+func (t *tenant) knownCustomer(id string) bool {
+	if id == "" {
+		return true
+	}
+	_, ok := t.customers.Load(id)
+	return ok
+}
+
+func setupCustomerAPI(group *gin.RouterGroup) {
+	group.POST("/customers", createCustomer)
+	group.GET("/customers/:id", getCustomer)
+	group.GET("/customers/:id/balance", getCustomerBalance)
+	group.GET("/customers/:id/transactions", listCustomerTransactions)
+	group.GET("/customers/:id/expirations", listCustomerExpirations)
+	group.GET("/customers/:id/loyalty", getCustomerLoyalty)
+	group.POST("/receipts/:id/claim", claimReceipt)
+	setupLedgerAPI(group)
+	setupRewardsAPI(group)
+	setupGroupAPI(group)
+}
+
+func createCustomer(c *gin.Context) {
+	var request struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+
+	created := customer{Id: uuid.New().String(), Name: request.Name, CreatedAt: time.Now().UTC()}
+	tenantOf(c).customers.Store(created.Id, created)
+
+	c.Header("Location", "/v2/customers/"+created.Id)
+	respond(c, http.StatusCreated, created)
+}
+
+func getCustomer(c *gin.Context) {
+	found, ok := tenantOf(c).loadCustomer(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, found)
+}
+
+func getCustomerBalance(c *gin.Context) {
+	t := tenantOf(c)
+	found, ok := t.loadCustomer(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"customerId": found.Id, "balance": t.ledger.balance(customerLedgerAccount(found.Id))})
+}
+
+// The customer's side of their ledger entries, newest first
+func listCustomerTransactions(c *gin.Context) {
+	t := tenantOf(c)
+	found, ok := t.loadCustomer(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+
+	account := customerLedgerAccount(found.Id)
+	entries := t.ledger.entriesFor(account)
+	transactions := make([]pointsTransaction, len(entries))
+	for i, entry := range entries {
+		transaction := pointsTransaction{Id: entry.Id, Type: entry.Type, ReceiptId: entry.ReceiptId, OrderId: entry.OrderId, Reverses: entry.Reverses, Memo: entry.Memo, CreatedAt: entry.CreatedAt}
+		for _, posting := range entry.Postings {
+			if posting.Account == account {
+				transaction.Points = posting.Amount
+			}
+		}
+		transactions[len(transactions)-1-i] = transaction
+	}
+
+	respond(c, http.StatusOK, gin.H{"transactions": transactions})
+}
+
+// POST /v2/receipts/{id}/claim credits an anonymous scored receipt to a customer
+func claimReceipt(c *gin.Context) {
+	var request struct {
+		CustomerId string `json:"customerId" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	t := tenantOf(c)
+	if !t.knownCustomer(request.CustomerId) {
+		respondErrorV2(c, http.StatusBadRequest, unknownCustomerV2)
+		return
+	}
+
+	t.claimMu.Lock()
+	defer t.claimMu.Unlock()
+
+	receiptGuid := c.Param("id")
+	value, ok := t.receipts.Load(receiptGuid)
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, receiptNotFoundV2)
+		return
+	}
+	stored := value.(storedReceipt)
+
+	switch {
+	case stored.CustomerId != "":
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "already_claimed", Message: "The receipt has already been claimed."})
+		return
+	case stored.Status != statusDone:
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "not_scored", Message: "Only scored receipts can be claimed."})
+		return
+	}
+
+	// A receipt that couldn't be credited stays unclaimed
+	stored.CustomerId = request.CustomerId
+	var err error
+	claimed := t.updateStoredReceipt(receiptGuid, func() {
+		if stored, err = t.loyalty.credit(receiptGuid, stored); err == nil {
+			t.receipts.Store(receiptGuid, stored)
+		}
+	})
+	if !claimed {
+		respondErrorV2(c, http.StatusNotFound, receiptNotFoundV2)
+		return
+	}
+	if err != nil {
+		respondErrorV2(c, http.StatusInternalServerError, creditFailedV2)
+		return
+	}
+
+	respond(c, http.StatusOK, newReceiptV2(receiptGuid, stored, false))
+}
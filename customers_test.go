@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sends a JSON request to the test router with the given headers, returning the response
+func sendJSON(method string, path string, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func newTestCustomer(t *testing.T) string {
+	w := sendJSON("POST", "/v2/customers", `{"name": "Pat"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created customer
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "/v2/customers/"+created.Id, w.Header().Get("Location"))
+	return created.Id
+}
+
+func customerBalance(t *testing.T, customerId string) int {
+	w := sendJSON("GET", "/v2/customers/"+customerId+"/balance", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body struct{ Balance int }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body.Balance
+}
+
+func TestReceiptsSubmittedForCustomer(t *testing.T) {
+	customerId := newTestCustomer(t)
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", customerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+	assert.Equal(t, customerId, submitted.CustomerId)
+	assert.Equal(t, 31, customerBalance(t, customerId))
+
+	// Async receipts are credited once scored
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", customerId, "Prefer", "respond-async")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Eventually(t, func() bool { return customerBalance(t, customerId) == 62 }, time.Second, 5*time.Millisecond)
+
+	w = sendJSON("GET", "/v2/customers/"+customerId+"/transactions", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct{ Transactions []pointsTransaction }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Len(t, body.Transactions, 2)
+	assert.Equal(t, submitted.Id, body.Transactions[1].ReceiptId)
+	assert.Equal(t, entryEarn, body.Transactions[1].Type)
+	assert.Equal(t, 31, body.Transactions[1].Points)
+
+	// Deleting a receipt keeps what it earned until its entry is reversed
+	loyalty := sendJSON("GET", "/v2/customers/"+customerId+"/loyalty", "").Body.String()
+	w = sendJSON("DELETE", "/v2/receipts/"+submitted.Id, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 62, customerBalance(t, customerId))
+	assert.Equal(t, loyalty, sendJSON("GET", "/v2/customers/"+customerId+"/loyalty", "").Body.String())
+	w = sendJSON("POST", "/v2/ledger/entries/"+body.Transactions[1].Id+"/reversal", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, 31, customerBalance(t, customerId))
+
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", "missing")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown_customer")
+}
+
+func TestClaimReceipt(t *testing.T) {
+	customerId := newTestCustomer(t)
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+	claim := "/v2/receipts/" + submitted.Id + "/claim"
+
+	w = sendJSON("POST", claim, `{"customerId": "missing"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = sendJSON("POST", claim, `{"customerId": "`+customerId+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var claimed receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &claimed))
+	assert.Equal(t, customerId, claimed.CustomerId)
+	assert.Equal(t, 31, customerBalance(t, customerId))
+
+	// A receipt can only be claimed once, even by the same customer
+	w = sendJSON("POST", claim, `{"customerId": "`+newTestCustomer(t)+`"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "already_claimed")
+	w = sendJSON("POST", claim, `{"customerId": "`+customerId+`"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, 31, customerBalance(t, customerId))
+
+	w = sendJSON("POST", "/v2/receipts/missing/claim", `{"customerId": "`+customerId+`"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = sendJSON("GET", "/v2/customers/missing/balance", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "customer_not_found")
+}
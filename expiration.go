@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const entryExpiry = "expiry"
+
+// Program account expired points go to
+const accountExpired = "program:expired"
+
+// How often the sweeper expires points, debits expire a customer's due points themselves in between
+const DefaultExpirySweep = time.Minute
+
+// When points expire after being earned: never (the zero value), a number of days later, or at the end of the
+// following calendar year
+type expirationPolicy struct {
+	days          int
+	endOfNextYear bool
+}
+
+// Parses POINTS_EXPIRATION: "never", "days:<n>" or "end-of-next-year"
+func parseExpirationPolicy(value string) (expirationPolicy, bool) {
+	switch {
+	case value == "" || value == "never":
+		return expirationPolicy{}, true
+	case value == "end-of-next-year":
+		return expirationPolicy{endOfNextYear: true}, true
+	case strings.HasPrefix(value, "days:"):
+		days, err := strconv.Atoi(strings.TrimPrefix(value, "days:"))
+		if err != nil || days < 1 {
+			return expirationPolicy{}, false
+		}
+		return expirationPolicy{days: days}, true
+	}
+	return expirationPolicy{}, false
+}
+
+// When points earned at the time expire, nil if they never do
+func (p expirationPolicy) expiresAt(earnedAt time.Time) *time.Time {
+	var expiresAt time.Time
+	switch {
+	case p.days > 0:
+		expiresAt = earnedAt.AddDate(0, 0, p.days)
+	case p.endOfNextYear:
+		expiresAt = time.Date(earnedAt.Year()+2, time.January, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return nil
+	}
+	return &expiresAt
+}
+
+// Points credited to a customer or group account by one entry, spent earliest earned first
+type pointsLot struct {
+	entryId   string
+	remaining int
+	earnedAt  time.Time
+	expiresAt *time.Time
+}
+
+func (lot *pointsLot) expired(now time.Time) bool {
+	return lot.expiresAt != nil && !now.Before(*lot.expiresAt)
+}
+
+// Points an entry took from a lot
+type lotUse struct {
+	lot    *pointsLot
+	amount int
+}
+
+// Keeps the customer's lots in step with a posting to their account
+func (l *ledger) moveLots(entry ledgerEntry, posting posting) {
+	if posting.Amount > 0 {
+		l.creditLots(entry, posting)
+	} else {
+		l.debitLots(entry, posting)
+	}
+}
+
+func (l *ledger) creditLots(entry ledgerEntry, posting posting) {
+	amount := posting.Amount
+
+	// Transferred points keep when they were earned and when they expire, transfers post their debit first
+	if entry.Type == entryTransfer {
+		for _, use := range l.uses[entry.Id] {
+			lot := *use.lot
+			lot.entryId = entry.Id
+			lot.remaining = use.amount
+			l.lots[posting.Account] = append(l.lots[posting.Account], &lot)
+		}
+		sort.SliceStable(l.lots[posting.Account], func(i, j int) bool {
+			return l.lots[posting.Account][i].earnedAt.Before(l.lots[posting.Account][j].earnedAt)
+		})
+		return
+	}
+
+	// Reversing a debit puts the points back where they came from, unless they have expired since
+	for _, use := range l.uses[entry.Reverses] {
+		if !use.lot.expired(entry.CreatedAt) {
+			use.lot.remaining += use.amount
+			amount -= use.amount
+		}
+	}
+
+	if amount > 0 {
+		lot := &pointsLot{entryId: entry.Id, remaining: amount, earnedAt: entry.CreatedAt, expiresAt: l.policy.expiresAt(entry.CreatedAt)}
+		l.lots[posting.Account] = append(l.lots[posting.Account], lot)
+	}
+}
+
+func (l *ledger) debitLots(entry ledgerEntry, posting posting) {
+	amount := -posting.Amount
+
+	// Expiries take the expired lots and reversals the lot of the entry they reverse, then points are taken
+	// earliest earned first
+	preferred := func(lot *pointsLot) bool {
+		switch {
+		case entry.Type == entryExpiry:
+			return lot.expired(entry.CreatedAt)
+		case entry.Reverses != "":
+			return lot.entryId == entry.Reverses
+		}
+		return false
+	}
+
+	var uses []lotUse
+	for _, onlyPreferred := range []bool{true, false} {
+		for _, lot := range l.lots[posting.Account] {
+			if amount == 0 {
+				break
+			}
+			if lot.remaining == 0 || (onlyPreferred && !preferred(lot)) {
+				continue
+			}
+			taken := min(lot.remaining, amount)
+			lot.remaining -= taken
+			amount -= taken
+			uses = append(uses, lotUse{lot: lot, amount: taken})
+		}
+	}
+	l.uses[entry.Id] = uses
+}
+
+// Posts an expiry entry for the customer or group account's points that are due, if any
+func (l *ledger) expireAccountLocked(account string, now time.Time) {
+	due := 0
+	for _, lot := range l.lots[account] {
+		if lot.expired(now) {
+			due += lot.remaining
+		}
+	}
+	if due == 0 {
+		return
+	}
+
+	entry := ledgerEntry{Type: entryExpiry, Postings: []posting{{Account: account, Amount: -due}, {Account: accountExpired, Amount: due}}}
+	if customerId, ok := strings.CutPrefix(account, customerAccountPrefix); ok {
+		entry.CustomerId = customerId
+	} else {
+		entry.GroupId = strings.TrimPrefix(account, groupAccountPrefix)
+	}
+	if _, err := l.postLocked(entry); err != nil {
+		log.Printf("Failed to expire %d points of %s: %v", due, account, err)
+	}
+}
+
+// Expires every customer's due points
+func (l *ledger) expireDue(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for account := range l.lots {
+		l.expireAccountLocked(account, now)
+	}
+}
+
+type upcomingExpiration struct {
+	ExpiresAt time.Time `json:"expiresAt" xml:"expiresAt" yaml:"expiresAt"`
+	Points    int       `json:"points" xml:"points" yaml:"points"`
+}
+
+// Points in the account that will expire, soonest first. Points already due are left out but not expired here, that
+// is left to the sweeper and to debits so reading never posts
+func (l *ledger) upcomingExpirations(account string, now time.Time) []upcomingExpiration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byTime := map[time.Time]int{}
+	for _, lot := range l.lots[account] {
+		if lot.remaining > 0 && lot.expiresAt != nil && !lot.expired(now) {
+			byTime[*lot.expiresAt] += lot.remaining
+		}
+	}
+
+	expirations := []upcomingExpiration{}
+	for expiresAt, points := range byTime {
+		expirations = append(expirations, upcomingExpiration{ExpiresAt: expiresAt, Points: points})
+	}
+	sort.Slice(expirations, func(i, j int) bool { return expirations[i].ExpiresAt.Before(expirations[j].ExpiresAt) })
+	return expirations
+}
+
+func (l *ledger) setPolicy(policy expirationPolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policy = policy
+}
+
+// How often the sweeper expires points, set from POINTS_EXPIRY_SWEEP by loadExpiration
+var expirySweep = DefaultExpirySweep
+
+// Applies POINTS_EXPIRATION to points earned from now on and reads POINTS_EXPIRY_SWEEP. Either one set to something
+// that doesn't parse stops the server from starting, rather than leaving points that silently never expire
+func loadExpiration() error {
+	value := os.Getenv("POINTS_EXPIRATION")
+	policy, ok := parseExpirationPolicy(value)
+	if !ok {
+		return fmt.Errorf("POINTS_EXPIRATION=%q isn't never, days:<n> or end-of-next-year", value)
+	}
+
+	sweep := os.Getenv("POINTS_EXPIRY_SWEEP")
+	if sweep != "" {
+		parsed, err := time.ParseDuration(sweep)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("POINTS_EXPIRY_SWEEP=%q isn't a positive duration", sweep)
+		}
+		expirySweep = parsed
+	}
+
+	tenants.setPolicy(policy)
+	return nil
+}
+
+var startExpirySweeperOnce sync.Once
+
+// Starts expiring points every POINTS_EXPIRY_SWEEP
+func startExpirySweeper() {
+	startExpirySweeperOnce.Do(func() {
+		sweep := expirySweep
+		go func() {
+			for now := range time.Tick(sweep) {
+				tenants.each(func(t *tenant) { t.ledger.expireDue(now) })
+			}
+		}()
+	})
+}
+
+// GET /v2/customers/{id}/expirations lists when the customer's points will expire
+func listCustomerExpirations(c *gin.Context) {
+	t := tenantOf(c)
+	found, ok := t.loadCustomer(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"expirations": t.ledger.upcomingExpirations(customerLedgerAccount(found.Id), time.Now())})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Remaining points of the account's lots, earliest earned first
+func lotsRemaining(l *ledger, account string) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	remaining := []int{}
+	for _, lot := range l.lots[account] {
+		remaining = append(remaining, lot.remaining)
+	}
+	return remaining
+}
+
+// The lots always hold the whole balance
+func assertLotsBalance(t *testing.T, l *ledger, account string) {
+	sum := 0
+	for _, remaining := range lotsRemaining(l, account) {
+		sum += remaining
+	}
+	assert.Equal(t, l.balance(account), sum)
+	assert.Equal(t, l.balance(account), replayLedger(l.entries)[account])
+}
+
+func TestParseExpirationPolicy(t *testing.T) {
+	for value, expected := range map[string]expirationPolicy{
+		"":                 {},
+		"never":            {},
+		"days:90":          {days: 90},
+		"end-of-next-year": {endOfNextYear: true},
+	} {
+		policy, ok := parseExpirationPolicy(value)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, policy, value)
+	}
+	for _, value := range []string{"days:0", "days:-1", "days:", "yearly"} {
+		_, ok := parseExpirationPolicy(value)
+		assert.False(t, ok, value)
+	}
+
+	// A mistyped setting stops the server instead of leaving points that never expire
+	t.Setenv("POINTS_EXPIRATION", "days:ninety")
+	assert.ErrorContains(t, loadExpiration(), "POINTS_EXPIRATION")
+	t.Setenv("POINTS_EXPIRATION", "never")
+	t.Setenv("POINTS_EXPIRY_SWEEP", "every minute")
+	assert.ErrorContains(t, loadExpiration(), "POINTS_EXPIRY_SWEEP")
+	t.Setenv("POINTS_EXPIRY_SWEEP", "-1m")
+	assert.ErrorContains(t, loadExpiration(), "POINTS_EXPIRY_SWEEP")
+	assert.Equal(t, DefaultExpirySweep, expirySweep)
+
+	earned := time.Date(2026, 3, 14, 15, 9, 0, 0, time.UTC)
+	assert.Nil(t, expirationPolicy{}.expiresAt(earned))
+	assert.Equal(t, time.Date(2026, 4, 13, 15, 9, 0, 0, time.UTC), *expirationPolicy{days: 30}.expiresAt(earned))
+	assert.Equal(t, time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC), *expirationPolicy{endOfNextYear: true}.expiresAt(earned))
+}
+
+func TestPointsSpentEarliestEarnedFirst(t *testing.T) {
+	l := newLedger()
+	l.policy = expirationPolicy{days: 30}
+	account := customerLedgerAccount("fifo")
+
+	_, err := l.post(customerEntry(entryEarn, "fifo", accountIssued, 10))
+	assert.NoError(t, err)
+	_, err = l.post(customerEntry(entryEarn, "fifo", accountIssued, 20))
+	assert.NoError(t, err)
+
+	redemption, err := l.post(customerEntry(entryRedemption, "fifo", accountRedeemed, -15))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 15}, lotsRemaining(l, account))
+	assertLotsBalance(t, l, account)
+
+	// Reversing the redemption puts the points back in their lots
+	_, err = l.reverse(redemption.Id, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{10, 20}, lotsRemaining(l, account))
+	assertLotsBalance(t, l, account)
+
+	// Only the second lot is left to expire
+	_, err = l.post(customerEntry(entryRedemption, "fifo", accountRedeemed, -12))
+	assert.NoError(t, err)
+	past := time.Now().Add(-time.Hour)
+	l.lots[account][1].expiresAt = &past
+	l.expireDue(time.Now())
+	assert.Equal(t, 0, l.balance(account))
+	assert.Equal(t, 18, l.balance(accountExpired))
+	assertLotsBalance(t, l, account)
+
+	expiry := l.entries[len(l.entries)-1]
+	assert.Equal(t, entryExpiry, expiry.Type)
+	assert.Equal(t, "fifo", expiry.CustomerId)
+}
+
+func TestExpiredPointsCantBeSpent(t *testing.T) {
+	l := newLedger()
+	l.policy = expirationPolicy{days: 30}
+	account := customerLedgerAccount("expired")
+
+	_, err := l.post(customerEntry(entryEarn, "expired", accountIssued, 10))
+	assert.NoError(t, err)
+	l.policy = expirationPolicy{}
+	_, err = l.post(customerEntry(entryEarn, "expired", accountIssued, 5))
+	assert.NoError(t, err)
+
+	// The sweeper hasn't run, but the redemption expires the due points first
+	past := time.Now().Add(-time.Hour)
+	l.lots[account][0].expiresAt = &past
+	_, err = l.post(customerEntry(entryRedemption, "expired", accountRedeemed, -6))
+	assert.ErrorIs(t, err, errInsufficientBalance)
+	assert.Equal(t, 5, l.balance(account))
+	assert.Equal(t, 10, l.balance(accountExpired))
+	assertLotsBalance(t, l, account)
+
+	// Expired points stay expired even if a redemption that spent them is reversed
+	redemption, err := l.post(customerEntry(entryRedemption, "expired", accountRedeemed, -5))
+	assert.NoError(t, err)
+	l.lots[account][1].expiresAt = &past
+	_, err = l.reverse(redemption.Id, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 0, 5}, lotsRemaining(l, account))
+	assertLotsBalance(t, l, account)
+}
+
+func TestCustomerExpirations(t *testing.T) {
+	defaultTenant().ledger.setPolicy(expirationPolicy{endOfNextYear: true})
+	customerId := newFundedCustomer(t, 30)
+	defaultTenant().ledger.setPolicy(expirationPolicy{})
+	_, err := defaultTenant().ledger.post(customerEntry(entryAdjustment, customerId, accountIssued, 5))
+	assert.NoError(t, err)
+
+	w := sendJSON("GET", "/v2/customers/"+customerId+"/expirations", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Expirations []upcomingExpiration
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, []upcomingExpiration{{ExpiresAt: time.Date(time.Now().UTC().Year()+2, 1, 1, 0, 0, 0, 0, time.UTC), Points: 30}}, body.Expirations)
+
+	// Due points aren't listed, and listing doesn't expire them
+	l := defaultTenant().ledger
+	account := customerLedgerAccount(customerId)
+	past := time.Now().Add(-time.Hour)
+	l.mu.Lock()
+	l.lots[account][0].expiresAt = &past
+	l.mu.Unlock()
+	w = sendJSON("GET", "/v2/customers/"+customerId+"/expirations", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Empty(t, body.Expirations)
+	assert.Equal(t, 35, l.balance(account))
+
+	w = sendJSON("GET", "/v2/customers/missing/expirations", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// Limits on how deep selections nest and how many fields a query can resolve, checked before execution
+const GraphqlMaxDepth = 6
+const GraphqlMaxComplexity = 2000
+
+const graphqlDefaultLimit = 20
+const graphqlMaxLimit = 100
+
+// Assumed length of nested lists (items, breakdown) when estimating complexity
+const graphqlNestedListSize = 10
+
+// Receipt as exposed over GraphQL, resolved by json tag
+type receiptNode struct {
+	Id           string        `json:"id"`
+	Retailer     string        `json:"retailer"`
+	PurchaseDate string        `json:"purchaseDate"`
+	PurchaseTime string        `json:"purchaseTime"`
+	Total        string        `json:"total"`
+	Items        []Item        `json:"items"`
+	Status       string        `json:"status"`
+	Points       *int          `json:"points"`
+	Breakdown    []pointsAward `json:"breakdown"`
+	SubmittedAt  string        `json:"submittedAt"`
+}
+
+type pointsSummary struct {
+	Count         int     `json:"count"`
+	TotalPoints   int     `json:"totalPoints"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+// Criteria from the ReceiptFilter input, zero values match everything
+type receiptFilter struct {
+	retailer        string
+	status          string
+	purchasedAfter  string
+	purchasedBefore string
+	minPoints       *int
+	maxPoints       *int
+}
+
+var itemType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Item",
+	Fields: graphql.Fields{
+		"shortDescription": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"price":            &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var pointsAwardType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "PointsAward",
+	Description: "Points awarded to a receipt by a single rule.",
+	Fields: graphql.Fields{
+		"rule":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"points":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"description": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var receiptType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Receipt",
+	Fields: graphql.Fields{
+		"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"retailer":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"purchaseDate": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"purchaseTime": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"total":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"items":        &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(itemType)))},
+		"status":       &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "pending, processing, done or failed."},
+		"points":       &graphql.Field{Type: graphql.Int, Description: "Null until the receipt is scored."},
+		"breakdown":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(pointsAwardType)))},
+		"submittedAt":  &graphql.Field{Type: graphql.String},
+	},
+})
+
+var pointsSummaryType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "PointsSummary",
+	Description: "Aggregate points over the scored receipts matching a filter.",
+	Fields: graphql.Fields{
+		"count":         &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"totalPoints":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"averagePoints": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+	},
+})
+
+var receiptFilterType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "ReceiptFilter",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"retailer":        &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Case-insensitive retailer name."},
+		"status":          &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"purchasedAfter":  &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Inclusive purchase date, YYYY-MM-DD."},
+		"purchasedBefore": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Inclusive purchase date, YYYY-MM-DD."},
+		"minPoints":       &graphql.InputObjectFieldConfig{Type: graphql.Int},
+		"maxPoints":       &graphql.InputObjectFieldConfig{Type: graphql.Int},
+	},
+})
+
+var graphqlSchema = mustGraphqlSchema()
+
+func mustGraphqlSchema() graphql.Schema {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"receipt": &graphql.Field{
+				Type: receiptType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					id, _ := p.Args["id"].(string)
+					value, ok := tenantFromContext(p.Context).receipts.Load(id)
+					if !ok || !visibleInContext(p.Context, value.(storedReceipt)) {
+						return nil, nil
+					}
+					return newReceiptNode(id, value.(storedReceipt)), nil
+				},
+			},
+			"receipts": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(receiptType))),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: receiptFilterType},
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlDefaultLimit},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					receipts := filterReceipts(p.Context, parseReceiptFilter(p.Args["filter"]))
+
+					limit, _ := p.Args["limit"].(int)
+					offset, _ := p.Args["offset"].(int)
+					limit = min(max(limit, 0), graphqlMaxLimit)
+					offset = min(max(offset, 0), len(receipts))
+
+					return receipts[offset:min(offset+limit, len(receipts))], nil
+				},
+			},
+			"pointsSummary": &graphql.Field{
+				Type: graphql.NewNonNull(pointsSummaryType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: receiptFilterType},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					summary := pointsSummary{}
+					for _, receipt := range filterReceipts(p.Context, parseReceiptFilter(p.Args["filter"])) {
+						if receipt.Points == nil {
+							continue
+						}
+						summary.Count++
+						summary.TotalPoints += *receipt.Points
+					}
+					if summary.Count > 0 {
+						summary.AveragePoints = float64(summary.TotalPoints) / float64(summary.Count)
+					}
+					return summary, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+func newReceiptNode(id string, stored storedReceipt) receiptNode {
+	node := receiptNode{
+		Id:           id,
+		Retailer:     stored.Receipt.Retailer,
+		PurchaseDate: stored.Receipt.PurcahseDate,
+		PurchaseTime: stored.Receipt.PurchaseTime,
+		Total:        stored.Receipt.Total,
+		Items:        stored.Receipt.Items,
+		Status:       string(stored.Status),
+		Breakdown:    stored.Breakdown,
+	}
+	if node.Items == nil {
+		node.Items = []Item{}
+	}
+	if node.Breakdown == nil {
+		node.Breakdown = []pointsAward{}
+	}
+	if stored.Status == statusDone {
+		points := stored.Points
+		node.Points = &points
+	}
+	if !stored.SubmittedAt.IsZero() {
+		node.SubmittedAt = stored.SubmittedAt.Format("2006-01-02T15:04:05Z07:00")
+	}
+	return node
+}
+
+func parseReceiptFilter(arg any) receiptFilter {
+	var filter receiptFilter
+	input, ok := arg.(map[string]any)
+	if !ok {
+		return filter
+	}
+
+	filter.retailer, _ = input["retailer"].(string)
+	filter.status, _ = input["status"].(string)
+	filter.purchasedAfter, _ = input["purchasedAfter"].(string)
+	filter.purchasedBefore, _ = input["purchasedBefore"].(string)
+	if minPoints, ok := input["minPoints"].(int); ok {
+		filter.minPoints = &minPoints
+	}
+	if maxPoints, ok := input["maxPoints"].(int); ok {
+		filter.maxPoints = &maxPoints
+	}
+	return filter
+}
+
+// The tenant's receipts matching the filter that the caller in ctx may see, oldest submission first
+func filterReceipts(ctx context.Context, filter receiptFilter) []receiptNode {
+	receipts := []receiptNode{}
+	tenantFromContext(ctx).receipts.Range(func(key, value any) bool {
+		if !visibleInContext(ctx, value.(storedReceipt)) {
+			return true
+		}
+		node := newReceiptNode(key.(string), value.(storedReceipt))
+		if filter.matches(node) {
+			receipts = append(receipts, node)
+		}
+		return true
+	})
+
+	sort.Slice(receipts, func(i, j int) bool {
+		if receipts[i].SubmittedAt != receipts[j].SubmittedAt {
+			return receipts[i].SubmittedAt < receipts[j].SubmittedAt
+		}
+		return receipts[i].Id < receipts[j].Id
+	})
+	return receipts
+}
+
+func (filter receiptFilter) matches(node receiptNode) bool {
+	if filter.retailer != "" && !strings.EqualFold(filter.retailer, node.Retailer) {
+		return false
+	}
+	if filter.status != "" && filter.status != node.Status {
+		return false
+	}
+	// Dates are YYYY-MM-DD so they compare lexically
+	if filter.purchasedAfter != "" && node.PurchaseDate < filter.purchasedAfter {
+		return false
+	}
+	if filter.purchasedBefore != "" && node.PurchaseDate > filter.purchasedBefore {
+		return false
+	}
+	if filter.minPoints != nil && (node.Points == nil || *node.Points < *filter.minPoints) {
+		return false
+	}
+	if filter.maxPoints != nil && (node.Points == nil || *node.Points > *filter.maxPoints) {
+		return false
+	}
+	return true
+}
+
+type graphqlRequest struct {
+	Query         string         `json:"query" form:"query"`
+	OperationName string         `json:"operationName" form:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+func serveGraphql(c *gin.Context) {
+	var request graphqlRequest
+	if err := c.ShouldBind(&request); err != nil || request.Query == "" {
+		respond(c, http.StatusBadRequest, gin.H{"errors": []gin.H{{"message": "A GraphQL query is required."}}})
+		return
+	}
+
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(request.Query), Name: "GraphQL request"})})
+	if err != nil {
+		respondGraphql(c, http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	validation := graphql.ValidateDocument(&graphqlSchema, document, nil)
+	if !validation.IsValid {
+		respondGraphql(c, http.StatusBadRequest, &graphql.Result{Errors: validation.Errors})
+		return
+	}
+
+	// Reject expensive queries before resolving anything
+	depth, complexity := measureQuery(document, request.Variables)
+	if depth > GraphqlMaxDepth {
+		respondGraphql(c, http.StatusBadRequest, &graphql.Result{Errors: []gqlerrors.FormattedError{
+			gqlerrors.NewFormattedError("Query depth " + strconv.Itoa(depth) + " exceeds the limit of " + strconv.Itoa(GraphqlMaxDepth) + "."),
+		}})
+		return
+	}
+	if complexity > GraphqlMaxComplexity {
+		respondGraphql(c, http.StatusBadRequest, &graphql.Result{Errors: []gqlerrors.FormattedError{
+			gqlerrors.NewFormattedError("Query complexity " + strconv.Itoa(complexity) + " exceeds the limit of " + strconv.Itoa(GraphqlMaxComplexity) + "."),
+		}})
+		return
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphqlSchema,
+		AST:           document,
+		OperationName: request.OperationName,
+		Args:          request.Variables,
+		Context:       graphqlContext(c),
+	})
+
+	respondGraphql(c, http.StatusOK, result)
+}
+
+// Renders the result in the negotiated format. encoding/xml can't write the maps results are made of, so for XML the
+// result is rebuilt from its JSON as gin.H, which can
+func respondGraphql(c *gin.Context, code int, result *graphql.Result) {
+	if responseFormat(c) != formatXML {
+		respond(c, code, result)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		respond(c, http.StatusInternalServerError, gin.H{"errors": []gin.H{{"message": "The result could not be encoded."}}})
+		return
+	}
+	var tree any
+	json.Unmarshal(data, &tree)
+	respond(c, code, xmlTree(tree))
+}
+
+// Replaces the maps in a decoded JSON value with gin.H
+func xmlTree(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		tree := gin.H{}
+		for key, element := range value {
+			tree[key] = xmlTree(element)
+		}
+		return tree
+	case []any:
+		for i, element := range value {
+			value[i] = xmlTree(element)
+		}
+	}
+	return value
+}
+
+// Carries the request's tenant, and caller if it signed in with a token, to the resolvers
+func graphqlContext(c *gin.Context) context.Context {
+	ctx := withTenant(c.Request.Context(), tenantOf(c))
+	if caller, ok := requestToken(c); ok {
+		ctx = withToken(ctx, caller)
+	}
+	return ctx
+}
+
+// Walks every operation in the document for its deepest selection and the number of fields it could resolve
+func measureQuery(document *ast.Document, variables map[string]any) (int, int) {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	measurer := queryMeasurer{fragments: fragments, variables: variables}
+	maxDepth, maxComplexity := 0, 0
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			depth, complexity := measurer.measure(operation.SelectionSet, 0)
+			maxDepth = max(maxDepth, depth)
+			maxComplexity = max(maxComplexity, complexity)
+		}
+	}
+	return maxDepth, maxComplexity
+}
+
+type queryMeasurer struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+}
+
+// Fragments are inlined at the depth they are spread; validation has already rejected fragment cycles
+func (m queryMeasurer) measure(set *ast.SelectionSet, depth int) (int, int) {
+	if set == nil {
+		return depth, 0
+	}
+
+	maxDepth, complexity := depth, 0
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			// __typename is answered from the schema for free, __schema and __type can nest as deep as any field
+			if selection.Name.Value == "__typename" {
+				continue
+			}
+			fieldDepth, childComplexity := m.measure(selection.SelectionSet, depth+1)
+			maxDepth = max(maxDepth, fieldDepth)
+			complexity += 1 + childComplexity*m.listSize(selection)
+		case *ast.InlineFragment:
+			fragmentDepth, fragmentComplexity := m.measure(selection.SelectionSet, depth)
+			maxDepth = max(maxDepth, fragmentDepth)
+			complexity += fragmentComplexity
+		case *ast.FragmentSpread:
+			if fragment, ok := m.fragments[selection.Name.Value]; ok {
+				fragmentDepth, fragmentComplexity := m.measure(fragment.SelectionSet, depth)
+				maxDepth = max(maxDepth, fragmentDepth)
+				complexity += fragmentComplexity
+			}
+		}
+	}
+	return maxDepth, complexity
+}
+
+// How many times a field's selections may be resolved
+func (m queryMeasurer) listSize(field *ast.Field) int {
+	switch field.Name.Value {
+	case "receipts":
+		for _, argument := range field.Arguments {
+			if argument.Name.Value != "limit" {
+				continue
+			}
+			switch value := argument.Value.(type) {
+			case *ast.IntValue:
+				if limit, err := strconv.Atoi(value.Value); err == nil {
+					return min(max(limit, 0), graphqlMaxLimit)
+				}
+			case *ast.Variable:
+				if limit, ok := m.variables[value.Name.Value].(float64); ok {
+					return min(max(int(limit), 0), graphqlMaxLimit)
+				}
+			}
+			return graphqlMaxLimit
+		}
+		return graphqlDefaultLimit
+	case "items", "breakdown":
+		return graphqlNestedListSize
+	}
+	return 1
+}
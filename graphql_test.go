@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+type graphqlResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func postGraphql(t *testing.T, query string, variables map[string]any) (int, graphqlResponse) {
+	payload, _ := json.Marshal(map[string]any{"query": query, "variables": variables})
+	req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response graphqlResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return w.Code, response
+}
+
+func TestGraphqlReceiptWithBreakdown(t *testing.T) {
+	id := submitReceipt(t, `{
+  "retailer": "M&M Corner Market",
+  "purchaseDate": "2022-03-20",
+  "purchaseTime": "14:33",
+  "items": [
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" }
+  ],
+  "total": "9.00"
+}`)
+
+	code, response := postGraphql(t, `query($id: ID!) {
+  receipt(id: $id) { id retailer points items { shortDescription price } breakdown { rule points } }
+}`, map[string]any{"id": id})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, response.Errors)
+
+	var receipt struct {
+		Id        string
+		Retailer  string
+		Points    int
+		Items     []Item
+		Breakdown []pointsAward
+	}
+	assert.NoError(t, json.Unmarshal(response.Data["receipt"], &receipt))
+	assert.Equal(t, id, receipt.Id)
+	assert.Equal(t, 109, receipt.Points)
+	assert.Len(t, receipt.Items, 4)
+
+	// Breakdown sums to the points awarded
+	total := 0
+	for _, award := range receipt.Breakdown {
+		total += award.Points
+	}
+	assert.Equal(t, 109, total)
+
+	// Unknown IDs resolve to null
+	_, response = postGraphql(t, `{ receipt(id: "missing") { id } }`, nil)
+	assert.Equal(t, "null", string(response.Data["receipt"]))
+}
+
+func TestGraphqlFilteredReceiptsAndSummary(t *testing.T) {
+	submitReceipt(t, `{
+  "retailer": "GraphQL Mart",
+  "purchaseDate": "1999-01-02",
+  "purchaseTime": "13:13",
+  "total": "1.25",
+  "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]
+}`)
+	submitReceipt(t, `{
+  "retailer": "GraphQL Mart",
+  "purchaseDate": "1999-01-03",
+  "purchaseTime": "13:13",
+  "total": "1.00",
+  "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.00"}]
+}`)
+
+	code, response := postGraphql(t, `{
+  receipts(filter: { retailer: "graphql mart", purchasedBefore: "1999-01-02" }) { purchaseDate points }
+  pointsSummary(filter: { retailer: "GraphQL Mart" }) { count totalPoints averagePoints }
+}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, response.Errors)
+
+	var receipts []struct {
+		PurchaseDate string
+		Points       int
+	}
+	assert.NoError(t, json.Unmarshal(response.Data["receipts"], &receipts))
+	assert.Len(t, receipts, 1)
+	assert.Equal(t, "1999-01-02", receipts[0].PurchaseDate)
+
+	var summary pointsSummary
+	assert.NoError(t, json.Unmarshal(response.Data["pointsSummary"], &summary))
+	assert.Equal(t, 2, summary.Count)
+	assert.Equal(t, 36+92, summary.TotalPoints)
+}
+
+func TestGraphqlLimits(t *testing.T) {
+	// Fragments are measured where they are spread
+	code, response := postGraphql(t, `
+fragment a on Receipt { items { shortDescription } }
+{ receipts { ...a breakdown { rule } } }`, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, response.Errors)
+
+	// Large pages of wide receipts are too complex
+	code, response = postGraphql(t, `query($limit: Int) {
+  receipts(limit: $limit) { id retailer items { shortDescription price } breakdown { rule points description } }
+}`, map[string]any{"limit": 100})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.True(t, strings.Contains(response.Errors[0].Message, "complexity"))
+
+	// Nor can introspection nest past the limit
+	code, response = postGraphql(t, `{ __schema { types { fields { type { ofType { ofType { ofType { name } } } } } } } }`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.True(t, strings.Contains(response.Errors[0].Message, "depth"))
+
+	code, response = postGraphql(t, `{ receipts { nope } }`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.NotEmpty(t, response.Errors)
+}
+
+func TestMeasureQuery(t *testing.T) {
+	parse := func(query string) *ast.Document {
+		document, err := parser.Parse(parser.ParseParams{Source: query})
+		assert.NoError(t, err)
+		return document
+	}
+
+	depth, complexity := measureQuery(parse(`{ receipt(id: "x") { items { price } } }`), nil)
+	assert.Equal(t, 3, depth)
+	assert.Equal(t, 1+1+10, complexity)
+
+	// receipts multiplies by its limit, __typename is free
+	depth, complexity = measureQuery(parse(`fragment f on Receipt { id __typename } { receipts(limit: 5) { ...f } }`), nil)
+	assert.Equal(t, 2, depth)
+	assert.Equal(t, 1+5, complexity)
+
+	// Introspection counts like any other field
+	depth, complexity = measureQuery(parse(`{ __schema { types { name } } }`), nil)
+	assert.Equal(t, 3, depth)
+	assert.Equal(t, 3, complexity)
+
+	// Deeper than any schema path allows today, measured without validation
+	depth, _ = measureQuery(parse(`{ a { b { c { d { e { f { g } } } } } } }`), nil)
+	assert.Greater(t, depth, GraphqlMaxDepth)
+}
+
+func TestGraphqlNegotiatesFormat(t *testing.T) {
+	id := submitReceipt(t, simpleReceiptPayload)
+	payload, _ := json.Marshal(map[string]any{"query": `{ receipt(id: "` + id + `") { points } }`})
+
+	for accept, expected := range map[string]string{
+		"application/yaml": "points: 31",
+		"application/xml":  "<points>31</points>",
+	} {
+		req := httptest.NewRequest("POST", "/graphql", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, accept)
+		assert.Contains(t, w.Body.String(), expected, accept)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	roleOwner  = "owner"
+	roleMember = "member"
+)
+
+const (
+	invitationPending  = "pending"
+	invitationAccepted = "accepted"
+	invitationDeclined = "declined"
+)
+
+type groupMember struct {
+	CustomerId string    `json:"customerId" xml:"customerId" yaml:"customerId"`
+	Role       string    `json:"role" xml:"role" yaml:"role"`
+	JoinedAt   time.Time `json:"joinedAt" xml:"joinedAt" yaml:"joinedAt"`
+}
+
+// A household or other group of customers whose receipts all credit one pooled balance. Members are in the order
+// they joined, and the group always has exactly one owner while it has members
+type pointsGroup struct {
+	Id        string        `json:"id" xml:"id" yaml:"id"`
+	Name      string        `json:"name" xml:"name" yaml:"name"`
+	Members   []groupMember `json:"members" xml:"members>member" yaml:"members"`
+	CreatedAt time.Time     `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+}
+
+func (g *pointsGroup) member(customerId string) (int, bool) {
+	for i, member := range g.Members {
+		if member.CustomerId == customerId {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (g *pointsGroup) copy() pointsGroup {
+	copied := *g
+	copied.Members = append([]groupMember{}, g.Members...)
+	return copied
+}
+
+type groupInvitation struct {
+	Id          string     `json:"id" xml:"id" yaml:"id"`
+	GroupId     string     `json:"groupId" xml:"groupId" yaml:"groupId"`
+	CustomerId  string     `json:"customerId" xml:"customerId" yaml:"customerId"`
+	InvitedBy   string     `json:"invitedBy" xml:"invitedBy" yaml:"invitedBy"`
+	Status      string     `json:"status" xml:"status" yaml:"status"`
+	CreatedAt   time.Time  `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+	RespondedAt *time.Time `json:"respondedAt,omitempty" xml:"respondedAt,omitempty" yaml:"respondedAt,omitempty"`
+}
+
+// What a customer put into and took out of a group's pool
+type groupContribution struct {
+	CustomerId string `json:"customerId" xml:"customerId" yaml:"customerId"`
+	Member     bool   `json:"member" xml:"member" yaml:"member"`
+	Earned     int    `json:"earned" xml:"earned" yaml:"earned"`
+	Redeemed   int    `json:"redeemed" xml:"redeemed" yaml:"redeemed"`
+}
+
+var (
+	errGroupNotFound      = errors.New("group not found")
+	errNotGroupMember     = errors.New("customer is not a member of the group")
+	errNotGroupOwner      = errors.New("customer is not the owner of the group")
+	errAlreadyInGroup     = errors.New("customer is already in a group")
+	errInvitationNotFound = errors.New("invitation not found")
+	errInvitationClosed   = errors.New("invitation has already been answered")
+)
+
+// Groups, their invitations and who is in which, a customer is in at most one group. Earnings are posted under the
+// lock so they can't reach a group the customer has just left
+type groupDirectory struct {
+	mu          sync.Mutex
+	groups      map[string]*pointsGroup
+	memberOf    map[string]string
+	invitations map[string]*groupInvitation
+	ledger      *ledger
+}
+
+func newGroupDirectory(pointsLedger *ledger) *groupDirectory {
+	return &groupDirectory{groups: map[string]*pointsGroup{}, memberOf: map[string]string{}, invitations: map[string]*groupInvitation{}, ledger: pointsLedger}
+}
+
+func (d *groupDirectory) create(name string, ownerId string) (pointsGroup, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.memberOf[ownerId]; ok {
+		return pointsGroup{}, errAlreadyInGroup
+	}
+
+	now := time.Now().UTC()
+	created := &pointsGroup{Id: uuid.New().String(), Name: name, Members: []groupMember{{CustomerId: ownerId, Role: roleOwner, JoinedAt: now}}, CreatedAt: now}
+	d.groups[created.Id] = created
+	d.memberOf[ownerId] = created.Id
+	return created.copy(), nil
+}
+
+func (d *groupDirectory) get(id string) (pointsGroup, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	found, ok := d.groups[id]
+	if !ok {
+		return pointsGroup{}, false
+	}
+	return found.copy(), true
+}
+
+// The group and the member acting on it, who must be its owner if ownerOnly
+func (d *groupDirectory) actingLocked(groupId string, actingId string, ownerOnly bool) (*pointsGroup, error) {
+	found, ok := d.groups[groupId]
+	if !ok {
+		return nil, errGroupNotFound
+	}
+	i, ok := found.member(actingId)
+	switch {
+	case !ok:
+		return nil, errNotGroupMember
+	case ownerOnly && found.Members[i].Role != roleOwner:
+		return nil, errNotGroupOwner
+	}
+	return found, nil
+}
+
+// Invites a customer to the group, only the owner can
+func (d *groupDirectory) invite(groupId string, actingId string, customerId string) (groupInvitation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.actingLocked(groupId, actingId, true); err != nil {
+		return groupInvitation{}, err
+	}
+	if d.memberOf[customerId] == groupId {
+		return groupInvitation{}, errAlreadyInGroup
+	}
+
+	invitation := &groupInvitation{Id: uuid.New().String(), GroupId: groupId, CustomerId: customerId, InvitedBy: actingId, Status: invitationPending, CreatedAt: time.Now().UTC()}
+	d.invitations[invitation.Id] = invitation
+	return *invitation, nil
+}
+
+// Accepts or declines an invitation, only the invited customer can. Customers already in a group have to leave it
+// before accepting
+func (d *groupDirectory) answer(groupId string, invitationId string, actingId string, accept bool) (groupInvitation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	invitation, ok := d.invitations[invitationId]
+	if !ok || invitation.GroupId != groupId || invitation.CustomerId != actingId {
+		return groupInvitation{}, errInvitationNotFound
+	}
+	if invitation.Status != invitationPending {
+		return groupInvitation{}, errInvitationClosed
+	}
+
+	now := time.Now().UTC()
+	if accept {
+		found, ok := d.groups[groupId]
+		if !ok {
+			return groupInvitation{}, errGroupNotFound
+		}
+		if _, ok := d.memberOf[actingId]; ok {
+			return groupInvitation{}, errAlreadyInGroup
+		}
+		found.Members = append(found.Members, groupMember{CustomerId: actingId, Role: roleMember, JoinedAt: now})
+		d.memberOf[actingId] = groupId
+		invitation.Status = invitationAccepted
+	} else {
+		invitation.Status = invitationDeclined
+	}
+	invitation.RespondedAt = &now
+	return *invitation, nil
+}
+
+// Takes a member out of the group, members can leave and the owner can remove anyone. What the member contributed
+// stays in the pool. An owner who leaves hands the group to the longest standing member, and the last member to leave
+// takes the pool with them and dissolves the group
+func (d *groupDirectory) leave(groupId string, actingId string, customerId string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	found, err := d.actingLocked(groupId, actingId, actingId != customerId)
+	if err != nil {
+		return err
+	}
+	i, ok := found.member(customerId)
+	if !ok {
+		return errNotGroupMember
+	}
+
+	if len(found.Members) == 1 {
+		entry := ledgerEntry{Type: entryTransfer, CustomerId: customerId, GroupId: groupId, Memo: "Group dissolved"}
+		if err := d.ledger.transferBalance(entry, groupLedgerAccount(groupId), customerLedgerAccount(customerId)); err != nil {
+			return err
+		}
+		delete(d.groups, groupId)
+	} else {
+		wasOwner := found.Members[i].Role == roleOwner
+		found.Members = append(found.Members[:i], found.Members[i+1:]...)
+		if wasOwner {
+			found.Members[0].Role = roleOwner
+		}
+	}
+	delete(d.memberOf, customerId)
+	return nil
+}
+
+// Posts points a customer earned to their group's pool, or to their own balance if they aren't in one
+func (d *groupDirectory) creditEarned(customerId string, receiptId string, points int) (ledgerEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry := customerEntry(entryEarn, customerId, accountIssued, points)
+	entry.ReceiptId = receiptId
+	if groupId, ok := d.memberOf[customerId]; ok {
+		entry.GroupId = groupId
+		entry.Postings[0].Account = groupLedgerAccount(groupId)
+	}
+	return d.ledger.post(entry)
+}
+
+// Spends points from the pool, any member can
+func (d *groupDirectory) redeem(groupId string, actingId string, points int, memo string) (ledgerEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.actingLocked(groupId, actingId, false); err != nil {
+		return ledgerEntry{}, err
+	}
+	entry := ledgerEntry{Type: entryRedemption, CustomerId: actingId, GroupId: groupId, Memo: memo, Postings: []posting{
+		{Account: groupLedgerAccount(groupId), Amount: -points},
+		{Account: accountRedeemed, Amount: points},
+	}}
+	return d.ledger.post(entry)
+}
+
+// Every current and former member's contributions, most earned first
+func (d *groupDirectory) contributions(groupId string) ([]groupContribution, bool) {
+	found, ok := d.get(groupId)
+	if !ok {
+		return nil, false
+	}
+
+	byCustomer := d.ledger.contributionsTo(groupLedgerAccount(groupId))
+	for _, member := range found.Members {
+		if _, ok := byCustomer[member.CustomerId]; !ok {
+			byCustomer[member.CustomerId] = &groupContribution{CustomerId: member.CustomerId}
+		}
+		byCustomer[member.CustomerId].Member = true
+	}
+
+	contributions := []groupContribution{}
+	for _, contribution := range byCustomer {
+		contributions = append(contributions, *contribution)
+	}
+	sort.Slice(contributions, func(i, j int) bool {
+		if contributions[i].Earned != contributions[j].Earned {
+			return contributions[i].Earned > contributions[j].Earned
+		}
+		return contributions[i].CustomerId < contributions[j].CustomerId
+	})
+	return contributions, true
+}
+
+// Posts the entry moving the whole unexpired balance of one account to another, if there is any
+func (l *ledger) transferBalance(entry ledgerEntry, from string, to string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expireAccountLocked(from, time.Now().UTC())
+	amount := l.balances[from]
+	if amount == 0 {
+		return nil
+	}
+	entry.Postings = []posting{{Account: from, Amount: -amount}, {Account: to, Amount: amount}}
+	_, err := l.postLocked(entry)
+	return err
+}
+
+// Points each customer earned into and redeemed from the account, net of reversals
+func (l *ledger) contributionsTo(account string) map[string]*groupContribution {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byCustomer := map[string]*groupContribution{}
+	for _, entry := range l.entries {
+		for _, posting := range entry.Postings {
+			if posting.Account != account || entry.CustomerId == "" {
+				continue
+			}
+			contribution, ok := byCustomer[entry.CustomerId]
+			if !ok {
+				contribution = &groupContribution{CustomerId: entry.CustomerId}
+				byCustomer[entry.CustomerId] = contribution
+			}
+			switch l.originalTypeLocked(entry) {
+			case entryEarn:
+				contribution.Earned += posting.Amount
+			case entryRedemption:
+				contribution.Redeemed -= posting.Amount
+			}
+		}
+	}
+	return byCustomer
+}
+
+func setupGroupAPI(group *gin.RouterGroup) {
+	group.POST("/groups", createGroup)
+	group.GET("/groups/:id", getGroup)
+	group.GET("/groups/:id/contributions", listGroupContributions)
+	group.POST("/groups/:id/invitations", inviteToGroup)
+	group.POST("/groups/:id/invitations/:invitationId/accept", acceptInvitation)
+	group.POST("/groups/:id/invitations/:invitationId/decline", declineInvitation)
+	group.DELETE("/groups/:id/members/:customerId", removeGroupMember)
+	group.POST("/groups/:id/redemptions", redeemGroupPoints)
+}
+
+var groupNotFoundV2 = apiErrorV2{Code: "group_not_found", Message: "No group found for that ID."}
+
+func respondGroupError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errGroupNotFound):
+		respondErrorV2(c, http.StatusNotFound, groupNotFoundV2)
+	case errors.Is(err, errNotGroupMember):
+		respondErrorV2(c, http.StatusForbidden, apiErrorV2{Code: "not_group_member", Message: "The customer is not a member of the group."})
+	case errors.Is(err, errNotGroupOwner):
+		respondErrorV2(c, http.StatusForbidden, apiErrorV2{Code: "not_group_owner", Message: "Only the group's owner can do that."})
+	case errors.Is(err, errAlreadyInGroup):
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "already_in_group", Message: "The customer is already in a group."})
+	case errors.Is(err, errInvitationNotFound):
+		respondErrorV2(c, http.StatusNotFound, apiErrorV2{Code: "invitation_not_found", Message: "No invitation found for that ID."})
+	case errors.Is(err, errInvitationClosed):
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "invitation_closed", Message: "The invitation has already been answered."})
+	default:
+		respondLedgerError(c, err)
+	}
+}
+
+// The customer acting on a group, signed in with a token or named by the Customer-Id header
+func actingCustomer(c *gin.Context) (string, bool) {
+	found, ok := tenantOf(c).loadCustomer(requestCustomerId(c))
+	if !ok {
+		respondErrorV2(c, http.StatusBadRequest, unknownCustomerV2)
+		return "", false
+	}
+	return found.Id, true
+}
+
+type groupView struct {
+	pointsGroup
+	Balance int `json:"balance" xml:"balance" yaml:"balance"`
+}
+
+func (d *groupDirectory) view(found pointsGroup) groupView {
+	return groupView{pointsGroup: found, Balance: d.ledger.balance(groupLedgerAccount(found.Id))}
+}
+
+// POST /v2/groups creates a group owned by the acting customer
+func createGroup(c *gin.Context) {
+	var request struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	actingId, ok := actingCustomer(c)
+	if !ok {
+		return
+	}
+
+	groups := tenantOf(c).groups
+	created, err := groups.create(request.Name, actingId)
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	c.Header("Location", "/v2/groups/"+created.Id)
+	respond(c, http.StatusCreated, groups.view(created))
+}
+
+// Customer tokens only see the groups their customer is a member of
+func canSeeGroup(c *gin.Context, found pointsGroup) bool {
+	caller, ok := requestToken(c)
+	if !ok || caller.Admin {
+		return true
+	}
+	_, member := found.member(caller.CustomerId)
+	return member
+}
+
+func getGroup(c *gin.Context) {
+	groups := tenantOf(c).groups
+	found, ok := groups.get(c.Param("id"))
+	if !ok || !canSeeGroup(c, found) {
+		respondErrorV2(c, http.StatusNotFound, groupNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, groups.view(found))
+}
+
+func listGroupContributions(c *gin.Context) {
+	groups := tenantOf(c).groups
+	found, ok := groups.get(c.Param("id"))
+	if !ok || !canSeeGroup(c, found) {
+		respondErrorV2(c, http.StatusNotFound, groupNotFoundV2)
+		return
+	}
+	contributions, ok := groups.contributions(found.Id)
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, groupNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"contributions": contributions})
+}
+
+// POST /v2/groups/{id}/invitations invites a customer to join
+func inviteToGroup(c *gin.Context) {
+	var request struct {
+		CustomerId string `json:"customerId" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	actingId, ok := actingCustomer(c)
+	if !ok {
+		return
+	}
+	t := tenantOf(c)
+	if _, ok := t.loadCustomer(request.CustomerId); !ok {
+		respondErrorV2(c, http.StatusBadRequest, unknownCustomerV2)
+		return
+	}
+
+	invitation, err := t.groups.invite(c.Param("id"), actingId, request.CustomerId)
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	respond(c, http.StatusCreated, invitation)
+}
+
+func acceptInvitation(c *gin.Context) {
+	answerInvitation(c, true)
+}
+
+func declineInvitation(c *gin.Context) {
+	answerInvitation(c, false)
+}
+
+func answerInvitation(c *gin.Context, accept bool) {
+	actingId, ok := actingCustomer(c)
+	if !ok {
+		return
+	}
+
+	invitation, err := tenantOf(c).groups.answer(c.Param("id"), c.Param("invitationId"), actingId, accept)
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	respond(c, http.StatusOK, invitation)
+}
+
+// DELETE /v2/groups/{id}/members/{customerId} leaves the group, or removes a member if the owner asks
+func removeGroupMember(c *gin.Context) {
+	actingId, ok := actingCustomer(c)
+	if !ok {
+		return
+	}
+
+	if err := tenantOf(c).groups.leave(c.Param("id"), actingId, c.Param("customerId")); err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// POST /v2/groups/{id}/redemptions spends points from the pool
+func redeemGroupPoints(c *gin.Context) {
+	var request struct {
+		Points int    `json:"points" binding:"required,min=1"`
+		Memo   string `json:"memo"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	actingId, ok := actingCustomer(c)
+	if !ok {
+		return
+	}
+
+	posted, err := tenantOf(c).groups.redeem(c.Param("id"), actingId, request.Points, request.Memo)
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	c.Header("Location", "/v2/ledger/entries/"+posted.Id)
+	respond(c, http.StatusCreated, posted)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGroup(t *testing.T, ownerId string) groupView {
+	w := sendJSON("POST", "/v2/groups", `{"name": "The Pats"}`, "Customer-Id", ownerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created groupView
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "/v2/groups/"+created.Id, w.Header().Get("Location"))
+	return created
+}
+
+// Invites the customer to the group and accepts for them
+func joinTestGroup(t *testing.T, groupId string, ownerId string, customerId string) {
+	w := sendJSON("POST", "/v2/groups/"+groupId+"/invitations", `{"customerId": "`+customerId+`"}`, "Customer-Id", ownerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var invitation groupInvitation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &invitation))
+	assert.Equal(t, invitationPending, invitation.Status)
+
+	w = sendJSON("POST", "/v2/groups/"+groupId+"/invitations/"+invitation.Id+"/accept", "", "Customer-Id", customerId)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func groupBalance(t *testing.T, groupId string) int {
+	w := sendJSON("GET", "/v2/groups/"+groupId, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var found groupView
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	return found.Balance
+}
+
+func TestGroupInvitations(t *testing.T) {
+	ownerId, memberId, outsiderId := newTestCustomer(t), newTestCustomer(t), newTestCustomer(t)
+	created := newTestGroup(t, ownerId)
+	invitations := "/v2/groups/" + created.Id + "/invitations"
+
+	// Only the owner invites, and only the invited customer answers
+	w := sendJSON("POST", invitations, `{"customerId": "`+outsiderId+`"}`, "Customer-Id", memberId)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "not_group_member")
+
+	w = sendJSON("POST", invitations, `{"customerId": "`+memberId+`"}`, "Customer-Id", ownerId)
+	var invitation groupInvitation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &invitation))
+	w = sendJSON("POST", invitations+"/"+invitation.Id+"/accept", "", "Customer-Id", outsiderId)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("POST", invitations+"/"+invitation.Id+"/accept", "", "Customer-Id", memberId)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = sendJSON("POST", invitations+"/"+invitation.Id+"/decline", "", "Customer-Id", memberId)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "invitation_closed")
+
+	w = sendJSON("POST", invitations, `{"customerId": "`+outsiderId+`"}`, "Customer-Id", memberId)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "not_group_owner")
+
+	// Customers are in one group at a time
+	w = sendJSON("POST", "/v2/groups", `{"name": "Another"}`, "Customer-Id", memberId)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "already_in_group")
+
+	w = sendJSON("GET", "/v2/groups/"+created.Id, "")
+	var found groupView
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	assert.Len(t, found.Members, 2)
+	assert.Equal(t, roleOwner, found.Members[0].Role)
+	assert.Equal(t, groupMember{CustomerId: memberId, Role: roleMember, JoinedAt: found.Members[1].JoinedAt}, found.Members[1])
+
+	w = sendJSON("POST", "/v2/groups", `{"name": "Nobody's"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = sendJSON("POST", "/v2/groups", `{"name": "Nobody's"}`, "Customer-Id", "missing")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown_customer")
+	w = sendJSON("GET", "/v2/groups/missing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGroupPoolsPoints(t *testing.T) {
+	ownerId, memberId := newTestCustomer(t), newFundedCustomer(t, 100)
+	created := newTestGroup(t, ownerId)
+	joinTestGroup(t, created.Id, ownerId, memberId)
+
+	// Receipts submitted or claimed by any member credit the pool
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", ownerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload)
+	var anonymous receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &anonymous))
+	w = sendJSON("POST", "/v2/receipts/"+anonymous.Id+"/claim", `{"customerId": "`+memberId+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, 62, groupBalance(t, created.Id))
+	assert.Equal(t, 0, customerBalance(t, ownerId))
+	assert.Equal(t, 100, customerBalance(t, memberId))
+
+	w = sendJSON("POST", "/v2/groups/"+created.Id+"/redemptions", `{"points": 20}`, "Customer-Id", memberId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = sendJSON("POST", "/v2/groups/"+created.Id+"/redemptions", `{"points": 50}`, "Customer-Id", ownerId)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "insufficient_balance")
+
+	// The member leaves their contribution behind and earns for themselves again
+	w = sendJSON("DELETE", "/v2/groups/"+created.Id+"/members/"+memberId, "", "Customer-Id", memberId)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", memberId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, 42, groupBalance(t, created.Id))
+	assert.Equal(t, 131, customerBalance(t, memberId))
+
+	w = sendJSON("GET", "/v2/groups/"+created.Id+"/contributions", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Contributions []groupContribution
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.ElementsMatch(t, []groupContribution{
+		{CustomerId: ownerId, Member: true, Earned: 31},
+		{CustomerId: memberId, Member: false, Earned: 31, Redeemed: 20},
+	}, body.Contributions)
+
+	// The last member out takes the pool with them
+	w = sendJSON("DELETE", "/v2/groups/"+created.Id+"/members/"+ownerId, "", "Customer-Id", ownerId)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 42, customerBalance(t, ownerId))
+	w = sendJSON("GET", "/v2/groups/"+created.Id, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assertLotsBalance(t, defaultTenant().ledger, customerLedgerAccount(ownerId))
+}
+
+func TestGroupOwnership(t *testing.T) {
+	ownerId, firstId, secondId := newTestCustomer(t), newTestCustomer(t), newTestCustomer(t)
+	created := newTestGroup(t, ownerId)
+	joinTestGroup(t, created.Id, ownerId, firstId)
+	joinTestGroup(t, created.Id, ownerId, secondId)
+	members := "/v2/groups/" + created.Id + "/members/"
+
+	w := sendJSON("DELETE", members+ownerId, "", "Customer-Id", secondId)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The longest standing member takes over from an owner who leaves
+	w = sendJSON("DELETE", members+ownerId, "", "Customer-Id", ownerId)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	found, _ := defaultTenant().groups.get(created.Id)
+	assert.Equal(t, []groupMember{
+		{CustomerId: firstId, Role: roleOwner, JoinedAt: found.Members[0].JoinedAt},
+		{CustomerId: secondId, Role: roleMember, JoinedAt: found.Members[1].JoinedAt},
+	}, found.Members)
+
+	w = sendJSON("DELETE", members+secondId, "", "Customer-Id", firstId)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = sendJSON("DELETE", members+secondId, "", "Customer-Id", firstId)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGroupCreditErrors(t *testing.T) {
+	directory := newGroupDirectory(newLedger())
+	credited, err := directory.creditEarned("earner", "receipt", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, customerLedgerAccount("earner"), credited.Postings[0].Account)
+
+	_, err = directory.creditEarned("earner", "receipt", 0)
+	assert.ErrorIs(t, err, errUnbalancedEntry)
+}
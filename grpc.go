@@ -0,0 +1,153 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/receipts/v1/receipts.proto
+
+import (
+	"context"
+	"errors"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC transport for the receipt API, backed by the same scoring and store as the HTTP handlers. Calls name their
+// tenant with tenant-id metadata
+type receiptService struct {
+	receiptsv1.UnimplementedReceiptServiceServer
+}
+
+// Serves the receipt API over gRPC. Receipts are validated against api.yml, which loadAPISpec loads on first use, so
+// nothing has to run before it
+func SetupGrpc() *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(authenticateUnary), grpc.StreamInterceptor(authenticateStream))
+	receiptsv1.RegisterReceiptServiceServer(server, &receiptService{})
+	return server
+}
+
+func (s *receiptService) ProcessReceipt(ctx context.Context, req *receiptsv1.ProcessReceiptRequest) (*receiptsv1.ProcessReceiptResponse, error) {
+	t, err := grpcTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetReceipt() == nil {
+		return nil, status.Error(codes.InvalidArgument, "The receipt is invalid.")
+	}
+
+	// Callers signed in with a token are credited for their receipts
+	customerId := ""
+	if caller, ok := tokenFromContext(ctx); ok {
+		customerId = t.signIn(caller).Id
+	}
+
+	id, _, err := t.processNewReceipt(receiptFromProto(req.GetReceipt()), customerId)
+	if errors.Is(err, errCreditFailed) {
+		return nil, status.Error(codes.Internal, creditFailedV2.Message)
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "The receipt is invalid.")
+	}
+
+	return &receiptsv1.ProcessReceiptResponse{Id: id}, nil
+}
+
+func (s *receiptService) GetPoints(ctx context.Context, req *receiptsv1.GetPointsRequest) (*receiptsv1.GetPointsResponse, error) {
+	t, err := grpcTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := t.receipts.Load(req.GetId())
+	if !ok || !visibleInContext(ctx, value.(storedReceipt)) {
+		return nil, status.Error(codes.NotFound, "No receipt found for that ID.")
+	}
+
+	stored := value.(storedReceipt)
+
+	if !stored.Async {
+		return &receiptsv1.GetPointsResponse{Points: int64(stored.Points)}, nil
+	}
+
+	// Asynchronous receipts report their status like the HTTP API
+	if stored.Status == statusFailed && errors.Is(stored.Err, errCreditFailed) {
+		return nil, status.Error(codes.Internal, creditFailedV2.Message)
+	}
+	if stored.Status == statusFailed {
+		return nil, status.Error(codes.InvalidArgument, "The receipt is invalid.")
+	}
+	return &receiptsv1.GetPointsResponse{Points: int64(stored.Points), Status: string(stored.Status)}, nil
+}
+
+func (s *receiptService) ScoreReceipt(ctx context.Context, req *receiptsv1.ScoreReceiptRequest) (*receiptsv1.ScoreReceiptResponse, error) {
+	t, err := grpcTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetReceipt() == nil {
+		return nil, status.Error(codes.InvalidArgument, "The receipt is invalid.")
+	}
+
+	result, err := t.score(receiptFromProto(req.GetReceipt()))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "The receipt is invalid.")
+	}
+
+	return &receiptsv1.ScoreReceiptResponse{Points: int64(result.Points)}, nil
+}
+
+func (s *receiptService) StreamReceipts(req *receiptsv1.StreamReceiptsRequest, stream grpc.ServerStreamingServer[receiptsv1.ReceiptEvent]) error {
+	t, err := grpcTenant(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	missed, events, unsubscribe := t.feed.subscribe(req.GetLastEventId(), req.LastEventId != nil)
+	defer unsubscribe()
+
+	for _, event := range missed {
+		if err := stream.Send(eventToProto(event)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			// Closed when the listener falls too far behind, clients resume with the last event ID
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "Receipt stream fell behind, resume with the last event ID.")
+			}
+			if err := stream.Send(eventToProto(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func receiptFromProto(receipt *receiptsv1.Receipt) Receipt {
+	items := make([]Item, 0, len(receipt.GetItems()))
+	for _, item := range receipt.GetItems() {
+		items = append(items, Item{ShortDescription: item.GetShortDescription(), Price: item.GetPrice()})
+	}
+
+	return Receipt{
+		Retailer:     receipt.GetRetailer(),
+		PurcahseDate: receipt.GetPurchaseDate(),
+		PurchaseTime: receipt.GetPurchaseTime(),
+		Items:        items,
+		Total:        receipt.GetTotal(),
+	}
+}
+
+func eventToProto(event feedEvent) *receiptsv1.ReceiptEvent {
+	return &receiptsv1.ReceiptEvent{
+		EventId:  event.Sequence,
+		Id:       event.Id,
+		Retailer: event.Retailer,
+		Points:   int64(event.Points),
+	}
+}
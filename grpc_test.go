@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Starts the gRPC server on an in-memory listener and returns a connected client
+func newGrpcClient(t *testing.T) receiptsv1.ReceiptServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := SetupGrpc()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return receiptsv1.NewReceiptServiceClient(conn)
+}
+
+func receiptToProto(receipt Receipt) *receiptsv1.Receipt {
+	items := []*receiptsv1.Item{}
+	for _, item := range receipt.Items {
+		items = append(items, &receiptsv1.Item{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+
+	return &receiptsv1.Receipt{
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurcahseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Items:        items,
+		Total:        receipt.Total,
+	}
+}
+
+// Both transports award identical points for every example receipt
+func TestGrpcMatchesHttpPoints(t *testing.T) {
+	client := newGrpcClient(t)
+	ctx := context.Background()
+
+	examples, _ := filepath.Glob("examples/*.json")
+	assert.NotEmpty(t, examples)
+
+	for _, example := range examples {
+		payload, err := os.ReadFile(example)
+		assert.NoError(t, err)
+
+		var receipt Receipt
+		assert.NoError(t, json.Unmarshal(payload, &receipt))
+
+		// HTTP
+		req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var posted postResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &posted))
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/"+posted.Id+"/points", nil))
+
+		var httpPoints getResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &httpPoints))
+
+		// gRPC
+		processed, err := client.ProcessReceipt(ctx, &receiptsv1.ProcessReceiptRequest{Receipt: receiptToProto(receipt)})
+		assert.NoError(t, err)
+
+		grpcPoints, err := client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: processed.GetId()})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(httpPoints.Points), grpcPoints.GetPoints(), example)
+
+		scored, err := client.ScoreReceipt(ctx, &receiptsv1.ScoreReceiptRequest{Receipt: receiptToProto(receipt)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(httpPoints.Points), scored.GetPoints(), example)
+
+		// Receipts stored over gRPC are readable over HTTP
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/"+processed.GetId()+"/points", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+func TestGrpcErrors(t *testing.T) {
+	client := newGrpcClient(t)
+	ctx := context.Background()
+
+	_, err := client.ProcessReceipt(ctx, &receiptsv1.ProcessReceiptRequest{Receipt: &receiptsv1.Receipt{Retailer: "!!!"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.ProcessReceipt(ctx, &receiptsv1.ProcessReceiptRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// A receipt whose points couldn't be credited is the server's failure, not the caller's
+func TestGrpcCreditFailed(t *testing.T) {
+	client := newGrpcClient(t)
+
+	id := t.Name()
+	defaultTenant().receipts.Store(id, storedReceipt{Status: statusFailed, Async: true, Err: errCreditFailed, SubmittedAt: time.Now()})
+	t.Cleanup(func() { defaultTenant().receipts.Delete(id) })
+
+	_, err := client.GetPoints(context.Background(), &receiptsv1.GetPointsRequest{Id: id})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, creditFailedV2.Message, status.Convert(err).Message())
+}
+
+func TestGrpcStreamReceipts(t *testing.T) {
+	client := newGrpcClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	stream, err := client.StreamReceipts(ctx, &receiptsv1.StreamReceiptsRequest{})
+	assert.NoError(t, err)
+
+	// Wait for the server side subscription before publishing
+	time.Sleep(50 * time.Millisecond)
+
+	id := submitReceipt(t, `{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-02",
+  "purchaseTime": "13:13",
+  "total": "1.25",
+  "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]
+}`)
+
+	event, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, id, event.GetId())
+	assert.Equal(t, int64(31), event.GetPoints())
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	mimeCSV  = "text/csv"
+	mimeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// Largest import file accepted, XLSX workbooks are read into memory whole
+const maxImportBytes = 10 << 20
+
+// Largest an XLSX workbook may unzip to, so a small zip of a huge sheet can't exhaust memory or disk. Sheets larger
+// than maxImportBytes are unzipped to a temporary file rather than memory
+const maxUnzippedImportBytes = 10 * maxImportBytes
+
+// Receipt fields an import can map columns to. Rows with the same receipt column are one receipt, without it
+// consecutive rows repeating the same header fields are
+var importFields = []string{"receipt", "retailer", "purchaseDate", "purchaseTime", "total", "shortDescription", "price"}
+
+// Fields that must have a column, the receipt header is repeated on every item row
+var requiredImportFields = []string{"retailer", "purchaseDate", "purchaseTime", "total", "shortDescription", "price"}
+
+// Fields repeated on every row of a receipt, which must agree
+var importHeaderFields = []string{"retailer", "purchaseDate", "purchaseTime", "total"}
+
+func init() {
+	// Spreadsheets are validated as opaque files like any other binary body
+	openapi3filter.RegisterBodyDecoder(mimeXLSX, openapi3filter.FileBodyDecoder)
+}
+
+// Outcome of an import, receipts that failed have their rows in Errors instead
+type importReport struct {
+	Receipts []importedReceipt `json:"receipts"`
+	Errors   []importRowError  `json:"errors"`
+}
+
+type importedReceipt struct {
+	Rows   []int  `json:"rows"`
+	Id     string `json:"id,omitempty"`
+	Points int    `json:"points"`
+}
+
+// Problem with a row, rows are numbered as in the file with the header as row 1
+type importRowError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+var (
+	errInvalidImport      = errors.New("import is invalid")
+	errUnzippedImportSize = fmt.Errorf("workbook unzips to more than %d bytes", maxUnzippedImportBytes)
+)
+
+// Column headers by receipt field, the field's own name unless mapped otherwise by "field=Header,..."
+func parseImportColumns(mapping string) (map[string]string, error) {
+	columns := map[string]string{}
+	for _, field := range importFields {
+		columns[field] = field
+	}
+
+	for _, pair := range strings.Split(mapping, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		field, header, ok := strings.Cut(pair, "=")
+		field = strings.TrimSpace(field)
+		if _, known := columns[field]; !ok || !known {
+			return nil, fmt.Errorf("%w: %q is not field=Header for one of %s", errInvalidImport, pair, strings.Join(importFields, ", "))
+		}
+		columns[field] = strings.TrimSpace(header)
+	}
+	return columns, nil
+}
+
+// Rows of a CSV file, or of the first sheet of an XLSX workbook
+func readImportRows(contentType string, body io.Reader) ([][]string, error) {
+	if contentType == mimeXLSX {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkUnzippedSize(data); err != nil {
+			return nil, err
+		}
+		workbook, err := excelize.OpenReader(bytes.NewReader(data), excelize.Options{
+			UnzipSizeLimit:    maxUnzippedImportBytes,
+			UnzipXMLSizeLimit: maxImportBytes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer workbook.Close()
+
+		rows, err := workbook.GetRows(workbook.GetSheetName(0))
+		if err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	// The reader skips blank lines, pad them back so rows keep their line numbers
+	var rows [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		for len(rows) < line-1 {
+			rows = append(rows, nil)
+		}
+		rows = append(rows, record)
+	}
+}
+
+// Refuses workbooks whose files add up to more than maxUnzippedImportBytes, telling them apart from unreadable ones.
+// archive/zip won't read more of a file than its header declares, so the headers can't understate the size
+func checkUnzippedSize(data []byte) error {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	var size uint64
+	for _, file := range archive.File {
+		size += file.UncompressedSize64
+		if size > maxUnzippedImportBytes {
+			return errUnzippedImportSize
+		}
+	}
+	return nil
+}
+
+// Spreadsheets show 9.00 as 9 and 2.50 as 2.5 unless told otherwise
+var spreadsheetAmountRegex = regexp.MustCompile(`^\d+(\.\d)?$`)
+
+func normalizeAmount(amount string) string {
+	if !spreadsheetAmountRegex.MatchString(amount) {
+		return amount
+	}
+	value, _ := strconv.ParseFloat(amount, 64)
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// Groups rows into receipts and submits each one, reporting every row that couldn't be imported.
+// An error is only returned when the file itself can't be imported
+func importReceipts(rows [][]string, columns map[string]string, normalizeAmounts bool, submit func(Receipt) (string, Result, error)) (importReport, error) {
+	report := importReport{Receipts: []importedReceipt{}, Errors: []importRowError{}}
+	if len(rows) == 0 {
+		return report, fmt.Errorf("%w: the file is empty", errInvalidImport)
+	}
+
+	// Column index of each field from the header row
+	index := map[string]int{}
+	for i, header := range rows[0] {
+		for field, column := range columns {
+			if strings.EqualFold(strings.TrimSpace(header), column) {
+				index[field] = i
+			}
+		}
+	}
+	for _, field := range requiredImportFields {
+		if _, ok := index[field]; !ok {
+			return report, fmt.Errorf("%w: no %q column for %s", errInvalidImport, columns[field], field)
+		}
+	}
+
+	cell := func(row []string, field string) string {
+		i, ok := index[field]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		value := strings.TrimSpace(row[i])
+		if normalizeAmounts && (field == "price" || field == "total") {
+			value = normalizeAmount(value)
+		}
+		return value
+	}
+
+	type group struct {
+		key  string
+		rows []int
+	}
+	var groups []*group
+	byKey := map[string]*group{}
+
+	for i, row := range rows[1:] {
+		// Skip blank lines between receipts
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+
+		key := cell(row, "receipt")
+		if _, ok := index["receipt"]; !ok {
+			header := make([]string, len(importHeaderFields))
+			for j, field := range importHeaderFields {
+				header[j] = cell(row, field)
+			}
+			key = strings.Join(header, "\x00")
+		}
+
+		// Without a receipt column only consecutive rows belong together
+		current := byKey[key]
+		if _, ok := index["receipt"]; !ok && (len(groups) == 0 || groups[len(groups)-1].key != key) {
+			current = nil
+		}
+		if current == nil {
+			current = &group{key: key}
+			groups = append(groups, current)
+			byKey[key] = current
+		}
+		current.rows = append(current.rows, i+1)
+	}
+
+	for _, group := range groups {
+		first := rows[group.rows[0]]
+		receipt := Receipt{
+			Retailer:     cell(first, "retailer"),
+			PurcahseDate: cell(first, "purchaseDate"),
+			PurchaseTime: cell(first, "purchaseTime"),
+			Total:        cell(first, "total"),
+		}
+
+		var conflicts []importRowError
+		for _, r := range group.rows {
+			row := rows[r]
+			for _, field := range importHeaderFields {
+				if cell(row, field) != cell(first, field) {
+					conflicts = append(conflicts, importRowError{Row: r + 1, Column: columns[field],
+						Message: fmt.Sprintf("%s differs from row %d of the same receipt.", columns[field], group.rows[0]+1)})
+				}
+			}
+			receipt.Items = append(receipt.Items, Item{ShortDescription: cell(row, "shortDescription"), Price: cell(row, "price")})
+		}
+		if len(conflicts) > 0 {
+			report.Errors = append(report.Errors, conflicts...)
+			continue
+		}
+
+		id, result, err := submit(receipt)
+		if err != nil {
+			report.Errors = append(report.Errors, importError(err, group.rows, columns))
+			continue
+		}
+
+		lines := make([]int, len(group.rows))
+		for i, r := range group.rows {
+			lines[i] = r + 1
+		}
+		report.Receipts = append(report.Receipts, importedReceipt{Rows: lines, Id: id, Points: result.Points})
+	}
+
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+	return report, nil
+}
+
+var itemFieldRegex = regexp.MustCompile(`^items\[(\d+)\]\.(\w+)$`)
+
+// Points a receipt validation error at the row and column it came from
+func importError(err error, rows []int, columns map[string]string) importRowError {
+	rowError := importRowError{Row: rows[0] + 1, Message: "The receipt is invalid."}
+
+	var fieldError *invalidFieldError
+	if !errors.As(err, &fieldError) {
+		return rowError
+	}
+
+	if match := itemFieldRegex.FindStringSubmatch(fieldError.Field); match != nil {
+		item, _ := strconv.Atoi(match[1])
+		if item < len(rows) {
+			rowError.Row = rows[item] + 1
+		}
+		rowError.Column = columns[match[2]]
+	} else {
+		rowError.Column = columns[fieldError.Field]
+	}
+
+	if rowError.Column != "" {
+		rowError.Message = rowError.Column + " is invalid."
+	}
+	return rowError
+}
+
+// POST /v2/receipts/import stores every valid receipt in a CSV or XLSX file and reports the rows that weren't
+func importReceiptsV2(c *gin.Context) {
+	columns, err := parseImportColumns(c.Query("columns"))
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_columns", Message: err.Error()})
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	rows, err := readImportRows(contentType, c.Request.Body)
+	if bodyTooLarge(err) || errors.Is(err, errUnzippedImportSize) {
+		respondErrorV2(c, http.StatusRequestEntityTooLarge, requestTooLargeV2)
+		return
+	}
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "malformed_import", Message: "The file could not be read."})
+		return
+	}
+
+	t := tenantOf(c)
+	report, err := importReceipts(rows, columns, contentType == mimeXLSX, func(receipt Receipt) (string, Result, error) {
+		id, stored, err := t.processNewReceipt(receipt, "")
+		return id, Result{Points: stored.Points, Breakdown: stored.Breakdown}, err
+	})
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_columns", Message: err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, report)
+}
+
+// Content type of an import file by its extension, CSV unless it is .xlsx
+func importContentType(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".xlsx") {
+		return mimeXLSX
+	}
+	return mimeCSV
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xuri/excelize/v2"
+)
+
+func importFile(t *testing.T, query string, contentType string, body []byte) (int, importReport) {
+	req := httptest.NewRequest("POST", "/v2/receipts/import"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var report importReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	return w.Code, report
+}
+
+func TestImportExampleCSV(t *testing.T) {
+	file, err := os.ReadFile("examples/receipts.csv")
+	assert.NoError(t, err)
+
+	code, report := importFile(t, "", mimeCSV, file)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, report.Errors)
+	assert.Len(t, report.Receipts, 2)
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, report.Receipts[0].Rows)
+	assert.Equal(t, 28, report.Receipts[0].Points)
+	assert.Equal(t, 109, report.Receipts[1].Points)
+
+	value, ok := defaultTenant().receipts.Load(report.Receipts[1].Id)
+	assert.True(t, ok)
+	assert.Equal(t, "M&M Corner Market", value.(storedReceipt).Receipt.Retailer)
+}
+
+func TestImportReportsRows(t *testing.T) {
+	// No receipt column, so consecutive rows with the same header are one receipt
+	csv := strings.Join([]string{
+		"Store,Date,Time,Total Paid,Item,Amount",
+		"Target,2022-01-02,13:13,2.50,Pepsi - 12-oz,1.25",
+		"Target,2022-01-02,13:13,2.50,Dasani,1.2",
+		"",
+		"Walgreens,2022-01-02,08:13,2.65,Pepsi - 12-oz,1.25",
+		"Walgreens,2022-01-02,08:13,2.65,Dasani,1.40",
+		"Walgreens,2022-01-03,08:13,1.00,Gum,1.00",
+	}, "\n")
+	columns := "?columns=" + strings.ReplaceAll("retailer=Store,purchaseDate=Date,purchaseTime=Time,total=Total Paid,shortDescription=Item,price=Amount", " ", "%20")
+
+	code, report := importFile(t, columns, mimeCSV, []byte(csv))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, report.Receipts, 2)
+	assert.Equal(t, []int{5, 6}, report.Receipts[0].Rows)
+	assert.Equal(t, []int{7}, report.Receipts[1].Rows)
+	assert.Equal(t, []importRowError{{Row: 3, Column: "Amount", Message: "Amount is invalid."}}, report.Errors)
+
+	// Missing columns fail the whole file
+	code, _ = importFile(t, "", mimeCSV, []byte(csv))
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestImportConflictingRows(t *testing.T) {
+	csv := "receipt,retailer,purchaseDate,purchaseTime,total,shortDescription,price\n" +
+		"A,Target,2022-01-02,13:13,2.50,Pepsi,1.25\n" +
+		"A,Target,2022-01-02,13:13,2.75,Pepsi,1.25\n"
+
+	_, report := importFile(t, "", mimeCSV, []byte(csv))
+	assert.Empty(t, report.Receipts)
+	assert.Equal(t, []importRowError{{Row: 3, Column: "total", Message: "total differs from row 2 of the same receipt."}}, report.Errors)
+}
+
+func TestImportXLSX(t *testing.T) {
+	workbook := excelize.NewFile()
+	sheet := workbook.GetSheetName(0)
+	rows := [][]any{
+		{"retailer", "purchaseDate", "purchaseTime", "total", "shortDescription", "price"},
+		{"M&M Corner Market", "2022-03-20", "14:33", 9, "Gatorade", 2.25},
+		{"M&M Corner Market", "2022-03-20", "14:33", 9, "Gatorade", 2.25},
+		{"M&M Corner Market", "2022-03-20", "14:33", 9, "Gatorade", 2.25},
+		{"M&M Corner Market", "2022-03-20", "14:33", 9, "Gatorade", 2.25},
+	}
+	for i, row := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		assert.NoError(t, workbook.SetSheetRow(sheet, cell, &row))
+	}
+	var file bytes.Buffer
+	assert.NoError(t, workbook.Write(&file))
+
+	code, report := importFile(t, "", mimeXLSX, file.Bytes())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, report.Errors)
+	assert.Len(t, report.Receipts, 1)
+	assert.Equal(t, 109, report.Receipts[0].Points)
+}
+
+func TestImportTooLarge(t *testing.T) {
+	for _, contentType := range []string{mimeCSV, mimeXLSX} {
+		code, _ := importFile(t, "", contentType, bytes.Repeat([]byte("a"), maxImportBytes+1))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, code, contentType)
+	}
+}
+
+func TestImportXLSXZipBomb(t *testing.T) {
+	// A sheet of spaces compresses about a thousandfold, well under maxImportBytes
+	var file bytes.Buffer
+	archive := zip.NewWriter(&file)
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	assert.NoError(t, err)
+	_, err = sheet.Write(bytes.Repeat([]byte(" "), maxUnzippedImportBytes+1))
+	assert.NoError(t, err)
+	assert.NoError(t, archive.Close())
+	assert.Less(t, file.Len(), maxImportBytes)
+
+	code, _ := importFile(t, "", mimeXLSX, file.Bytes())
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+}
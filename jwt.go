@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // RS384, RS512 and ES384 hash with it
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// How long a fetched JWKS is used before it is fetched again
+	DefaultJWKSRefresh = time.Hour
+
+	// Tokens signed with a key ID the JWKS doesn't have refetch it at most this often, so made up key IDs can't
+	// flood the identity provider
+	DefaultJWKSMinRefetch = time.Minute
+
+	// Clock skew allowed when checking exp and nbf
+	jwtLeeway = 30 * time.Second
+)
+
+// Only asymmetric algorithms, so the JWKS holds nothing secret and a token can't be signed with a public key
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// A verification key from the JWKS
+type jwk struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// The identity provider's keys, from a file or URL
+type jwksCache struct {
+	source     string
+	refresh    time.Duration
+	minRefetch time.Duration
+
+	// Held while fetching, so a rotation is fetched once however many requests notice it
+	mu          sync.Mutex
+	keys        []jwk
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func (j *jwksCache) fetch(now time.Time) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fetchLocked(now)
+}
+
+func (j *jwksCache) fetchLocked(now time.Time) error {
+	j.attemptedAt = now
+	data, err := readJWKS(j.source)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	j.keys = keys
+	j.fetchedAt = now
+	return nil
+}
+
+// Keys with the key ID, every key for tokens without one. Refetches the JWKS once it is older than refresh, or when it
+// doesn't have the key ID, which is how rotated keys are picked up. A failed fetch keeps the keys it had
+func (j *jwksCache) lookup(kid string, now time.Time) []crypto.PublicKey {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	known := slices.ContainsFunc(j.keys, func(key jwk) bool { return key.kid == kid })
+	stale := now.Sub(j.fetchedAt) >= j.refresh
+	if (stale || (kid != "" && !known)) && now.Sub(j.attemptedAt) >= j.minRefetch {
+		if err := j.fetchLocked(now); err != nil {
+			log.Printf("Keeping the JWKS fetched from %s at %s: %v", j.source, j.fetchedAt.Format(time.RFC3339), err)
+		}
+	}
+
+	var keys []crypto.PublicKey
+	for _, key := range j.keys {
+		if kid == "" || key.kid == kid {
+			keys = append(keys, key.key)
+		}
+	}
+	return keys
+}
+
+func readJWKS(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+
+	resp, err := jwksClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", source, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// The signing keys in a JWKS. Encryption keys and key types that can't verify the accepted algorithms are left out
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+
+	var keys []jwk
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		public, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS: key %q: %w", key.Kid, err)
+		}
+		if public != nil {
+			keys = append(keys, jwk{kid: key.Kid, key: public})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS: no signing keys")
+	}
+	return keys, nil
+}
+
+// The key, nil if it isn't of a type the accepted algorithms use
+func (key jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil || len(n) == 0 {
+			return nil, errors.New("invalid n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		exponent := new(big.Int).SetBytes(e)
+		if err != nil || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid e")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		curves := map[string]struct {
+			ecdsa elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+		}
+		curve, ok := curves[key.Crv]
+		if !ok {
+			return nil, nil
+		}
+		size := (curve.ecdsa.Params().BitSize + 7) / 8
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid x or y")
+		}
+		// Refuses points that aren't on the curve
+		if _, err := curve.ecdh.NewPublicKey(slices.Concat([]byte{4}, x, y)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve.ecdsa, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) bool {
+	hash := jwtAlgorithms[alg]
+	digest := hash.New()
+	digest.Write(signed)
+	sum := digest.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, sum, signature) == nil
+	case *ecdsa.PublicKey:
+		// ES256 is only ever P-256 and ES384 P-384, with r and s concatenated at the curve's size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || alg[2:] != fmt.Sprint(key.Curve.Params().BitSize) || len(signature) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, sum, r, s)
+	default:
+		return false
+	}
+}
+
+// aud is a string or an array of them
+type jwtAudience []string
+
+func (audience *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*audience = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*audience = many
+	return nil
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	Name      string      `json:"name"`
+	Tenant    string      `json:"tenant"`
+
+	// Space separated as in RFC 8693, or an array under scp as some identity providers send them
+	Scope  string   `json:"scope"`
+	Scopes []string `json:"scp"`
+}
+
+// A user signed in with a JWT, as the customer named by its sub in the tenant named by its tenant claim
+type tokenCaller struct {
+	CustomerId string
+	Name       string
+	TenantId   string
+	Admin      bool
+}
+
+// The tenant a request made with the token belongs to. Like API keys, tokens only work for their own tenant
+func (caller tokenCaller) tenantFor(requested string) (string, bool) {
+	if requested == "" {
+		return caller.TenantId, true
+	}
+	return requested, requested == caller.TenantId
+}
+
+// Whether the caller may see the receipt: only their own, unless their token has the admin scope
+func (caller tokenCaller) canSee(stored storedReceipt) bool {
+	return caller.Admin || stored.CustomerId == caller.CustomerId
+}
+
+type jwtVerifier struct {
+	jwks       *jwksCache
+	issuer     string
+	audience   string
+	adminScope string
+
+	// The tenant of tokens without a tenant claim
+	tenantId string
+}
+
+// Tokens are accepted once JWT_JWKS is configured
+var bearerTokens atomic.Pointer[jwtVerifier]
+
+var errInvalidToken = errors.New("invalid token")
+
+func invalidToken(reason string) error {
+	return fmt.Errorf("%w: %s", errInvalidToken, reason)
+}
+
+// Checks the token's signature against the JWKS, and that it was issued by the issuer, for the audience, and is
+// current
+func (v *jwtVerifier) verify(token string, now time.Time) (tokenCaller, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenCaller{}, invalidToken("not a JWS compact serialization")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return tokenCaller{}, invalidToken("header: " + err.Error())
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok {
+		return tokenCaller{}, invalidToken("algorithm " + header.Alg + " is not accepted")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return tokenCaller{}, invalidToken("signature: " + err.Error())
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := slices.ContainsFunc(v.jwks.lookup(header.Kid, now), func(key crypto.PublicKey) bool {
+		return verifyJWTSignature(header.Alg, key, signed, signature)
+	})
+	if !verified {
+		return tokenCaller{}, invalidToken("signature doesn't match a key in the JWKS")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return tokenCaller{}, invalidToken("claims: " + err.Error())
+	}
+	switch {
+	case claims.Issuer != v.issuer:
+		return tokenCaller{}, invalidToken("issued by " + claims.Issuer)
+	case !slices.Contains(claims.Audience, v.audience):
+		return tokenCaller{}, invalidToken("not for this audience")
+	case claims.ExpiresAt == nil || !now.Before(unixTime(*claims.ExpiresAt).Add(jwtLeeway)):
+		return tokenCaller{}, invalidToken("expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)):
+		return tokenCaller{}, invalidToken("not valid yet")
+	case claims.Subject == "":
+		return tokenCaller{}, invalidToken("no subject")
+	}
+
+	tenantId := claims.Tenant
+	if tenantId == "" {
+		tenantId = v.tenantId
+	}
+	scopes := append(strings.Fields(claims.Scope), claims.Scopes...)
+	return tokenCaller{
+		CustomerId: claims.Subject,
+		Name:       claims.Name,
+		TenantId:   tenantId,
+		Admin:      slices.Contains(scopes, v.adminScope),
+	}, nil
+}
+
+func decodeJWTPart(part string, into any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(into)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// Accepts tokens verified against the JWT_JWKS file or URL, issued by JWT_ISSUER for JWT_AUDIENCE. The JWKS is fetched
+// now, so a broken one stops the server from starting, and again every JWT_JWKS_REFRESH. Tokens without a tenant claim
+// belong to JWT_TENANT
+func loadJWTVerifier() error {
+	source := os.Getenv("JWT_JWKS")
+	if source == "" {
+		return nil
+	}
+	issuer, audience := os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE")
+	if issuer == "" || audience == "" {
+		return errors.New("JWT_JWKS needs JWT_ISSUER and JWT_AUDIENCE")
+	}
+
+	refresh, err := time.ParseDuration(os.Getenv("JWT_JWKS_REFRESH"))
+	if err != nil || refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	adminScope := os.Getenv("JWT_ADMIN_SCOPE")
+	if adminScope == "" {
+		adminScope = scopeAdmin
+	}
+	tenantId := os.Getenv("JWT_TENANT")
+	if tenantId == "" {
+		tenantId = defaultTenantId
+	}
+
+	verifier := &jwtVerifier{
+		jwks:       &jwksCache{source: source, refresh: refresh, minRefetch: DefaultJWKSMinRefetch},
+		issuer:     issuer,
+		audience:   audience,
+		adminScope: adminScope,
+		tenantId:   tenantId,
+	}
+	if err := verifier.jwks.fetch(time.Now()); err != nil {
+		return fmt.Errorf("JWT_JWKS: %w", err)
+	}
+	bearerTokens.Store(verifier)
+	return nil
+}
+
+// The token in an Authorization header using the Bearer scheme
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// Routes a token without the admin scope can reach: submitting and reading the caller's own receipts, their own
+// customer and their group. Anything else, like adjusting points or reading other customers' receipts, takes an admin
+// token or an API key
+var customerTokenRoutes = map[string]bool{
+	"POST /receipts/process":                                true,
+	"GET /receipts/:id/points":                              true,
+	"DELETE /receipts/:id":                                  true,
+	"POST /v1/receipts/process":                             true,
+	"GET /v1/receipts/:id/points":                           true,
+	"DELETE /v1/receipts/:id":                               true,
+	"POST /v2/receipts/process":                             true,
+	"POST /v2/receipts/score":                               true,
+	"POST /v2/receipts/parse":                               true,
+	"GET /v2/receipts/:id":                                  true,
+	"GET /v2/receipts/:id/points":                           true,
+	"DELETE /v2/receipts/:id":                               true,
+	"GET /v2/customers/:id":                                 true,
+	"GET /v2/customers/:id/balance":                         true,
+	"GET /v2/customers/:id/transactions":                    true,
+	"GET /v2/customers/:id/expirations":                     true,
+	"GET /v2/customers/:id/loyalty":                         true,
+	"POST /v2/customers/:id/redemptions":                    true,
+	"GET /v2/customers/:id/rewards":                         true,
+	"POST /v2/customers/:id/orders":                         true,
+	"GET /v2/customers/:id/orders":                          true,
+	"GET /v2/customers/:id/orders/:orderId":                 true,
+	"POST /v2/customers/:id/orders/:orderId/cancel":         true,
+	"POST /v2/groups":                                       true,
+	"GET /v2/groups/:id":                                    true,
+	"GET /v2/groups/:id/contributions":                      true,
+	"POST /v2/groups/:id/invitations":                       true,
+	"POST /v2/groups/:id/invitations/:invitationId/accept":  true,
+	"POST /v2/groups/:id/invitations/:invitationId/decline": true,
+	"DELETE /v2/groups/:id/members/:customerId":             true,
+	"POST /v2/groups/:id/redemptions":                       true,
+	"GET /graphql":                                          true,
+	"POST /graphql":                                         true,
+}
+
+// gRPC methods a token without the admin scope can call, the stream carries every customer's receipts
+var customerTokenMethods = map[string]bool{
+	receiptsv1.ReceiptService_ProcessReceipt_FullMethodName: true,
+	receiptsv1.ReceiptService_GetPoints_FullMethodName:      true,
+	receiptsv1.ReceiptService_ScoreReceipt_FullMethodName:   true,
+}
+
+var customerTokenV2 = apiErrorV2{Code: "forbidden", Message: "The token can only act for its own customer."}
+
+const tokenContextKey = "token"
+
+// Verifies the bearer token for authenticate. Tokens without the admin scope only reach customerTokenRoutes
+func authenticateToken(c *gin.Context, token string) {
+	verifier := bearerTokens.Load()
+	if verifier == nil {
+		abortWithError(c, http.StatusUnauthorized, unauthorizedV2)
+		return
+	}
+
+	caller, err := verifier.verify(token, time.Now())
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		abortWithError(c, http.StatusUnauthorized, unauthorizedV2)
+		return
+	}
+	if !caller.Admin && !customerTokenRoutes[c.Request.Method+" "+c.FullPath()] {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		abortWithError(c, http.StatusForbidden, forbiddenV2)
+		return
+	}
+	c.Set(tokenContextKey, caller)
+}
+
+// The caller signed in with the request's token, if it had one
+func requestToken(c *gin.Context) (tokenCaller, bool) {
+	caller, ok := c.Get(tokenContextKey)
+	if !ok {
+		return tokenCaller{}, false
+	}
+	return caller.(tokenCaller), true
+}
+
+// Signs the token's customer in to the tenant, and keeps tokens to their own customer: a Customer-Id header naming
+// another is refused, and without the admin scope so are other customers' paths
+func authorizeCustomer(c *gin.Context) {
+	caller, ok := requestToken(c)
+	if !ok {
+		return
+	}
+	tenantOf(c).signIn(caller)
+
+	if customerId := c.GetHeader("Customer-Id"); customerId != "" && customerId != caller.CustomerId {
+		abortWithError(c, http.StatusForbidden, customerTokenV2)
+		return
+	}
+	if !caller.Admin && strings.HasPrefix(c.FullPath(), "/v2/customers/:id") && c.Param("id") != caller.CustomerId {
+		abortWithError(c, http.StatusNotFound, customerNotFoundV2)
+	}
+}
+
+// The customer a request acts for: the token's, or the one in the Customer-Id header
+func requestCustomerId(c *gin.Context) string {
+	if caller, ok := requestToken(c); ok {
+		return caller.CustomerId
+	}
+	return c.GetHeader("Customer-Id")
+}
+
+// Whether the request may see the receipt, only tokens are limited to some receipts
+func canSeeReceipt(c *gin.Context, stored storedReceipt) bool {
+	caller, ok := requestToken(c)
+	return !ok || caller.canSee(stored)
+}
+
+// Whether the caller in ctx may see the receipt, like canSeeReceipt
+func visibleInContext(ctx context.Context, stored storedReceipt) bool {
+	caller, ok := tokenFromContext(ctx)
+	return !ok || caller.canSee(stored)
+}
+
+// The customer a token names, created the first time they sign in
+func (t *tenant) signIn(caller tokenCaller) customer {
+	signedIn, _ := t.customers.LoadOrStore(caller.CustomerId, customer{Id: caller.CustomerId, Name: caller.Name, CreatedAt: time.Now().UTC()})
+	return signedIn.(customer)
+}
+
+type tokenKey struct{}
+
+// Carries the caller to code that only gets a context, like gRPC handlers and GraphQL resolvers
+func withToken(ctx context.Context, caller tokenCaller) context.Context {
+	return context.WithValue(ctx, tokenKey{}, caller)
+}
+
+func tokenFromContext(ctx context.Context) (tokenCaller, bool) {
+	caller, ok := ctx.Value(tokenKey{}).(tokenCaller)
+	return caller, ok
+}
+
+// Verifies a gRPC call's bearer token for authenticateGrpc
+func authenticateGrpcToken(ctx context.Context, method string, token string) (context.Context, error) {
+	verifier := bearerTokens.Load()
+	if verifier == nil {
+		return nil, status.Error(codes.Unauthenticated, unauthorizedV2.Message)
+	}
+
+	caller, err := verifier.verify(token, time.Now())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, unauthorizedV2.Message)
+	}
+	if !caller.Admin && !customerTokenMethods[method] {
+		return nil, status.Error(codes.PermissionDenied, forbiddenV2.Message)
+	}
+	return withToken(ctx, caller), nil
+}
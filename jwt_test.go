@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com/"
+	testAudience = "receipt-processor"
+)
+
+// A signing key the identity provider publishes in its JWKS
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newRSASigner(t *testing.T, kid string) testSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return testSigner{kid: kid, alg: "RS256", key: key}
+}
+
+func newECSigner(t *testing.T, kid string) testSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return testSigner{kid: kid, alg: "ES256", key: key}
+}
+
+func (s testSigner) jwk() map[string]string {
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32)))}
+	}
+	return nil
+}
+
+func testJWKS(t *testing.T, signers ...testSigner) []byte {
+	keys := []map[string]string{}
+	for _, signer := range signers {
+		keys = append(keys, signer.jwk())
+	}
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	assert.NoError(t, err)
+	return data
+}
+
+// Signs claims on top of valid ones for sub, a nil value leaves the claim out
+func (s testSigner) token(t *testing.T, sub string, claims map[string]any) string {
+	payload := map[string]any{"iss": testIssuer, "aud": testAudience, "sub": sub, "exp": time.Now().Add(time.Hour).Unix()}
+	for name, value := range claims {
+		if value == nil {
+			delete(payload, name)
+		} else {
+			payload[name] = value
+		}
+	}
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	assert.NoError(t, err)
+	body, err := json.Marshal(payload)
+	assert.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Accepts tokens signed by the JWKS at source until the test ends
+func acceptTokens(t *testing.T, source string) {
+	verifier := &jwtVerifier{
+		jwks:       &jwksCache{source: source, refresh: DefaultJWKSRefresh, minRefetch: DefaultJWKSMinRefetch},
+		issuer:     testIssuer,
+		audience:   testAudience,
+		adminScope: scopeAdmin,
+		tenantId:   defaultTenantId,
+	}
+	assert.NoError(t, verifier.jwks.fetch(time.Now()))
+	bearerTokens.Store(verifier)
+	t.Cleanup(func() { bearerTokens.Store(nil) })
+}
+
+// Accepts tokens signed by the signers, from a JWKS file the test can rewrite
+func acceptTokensFrom(t *testing.T, signers ...testSigner) string {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, testJWKS(t, signers...), 0o600))
+	acceptTokens(t, path)
+	return path
+}
+
+func TestBearerTokenReceipts(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	acceptTokensFrom(t, signer)
+	alice, bob := signer.token(t, t.Name()+"-alice", map[string]any{"name": "Alice"}), signer.token(t, t.Name()+"-bob", nil)
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Authorization", "Bearer "+alice)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+	assert.Equal(t, t.Name()+"-alice", submitted.CustomerId)
+
+	// Alice was created when she signed in, and credited
+	w = sendJSON("GET", "/v2/customers/"+t.Name()+"-alice/balance", "", "Authorization", "Bearer "+alice)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var balance struct{ Balance int }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &balance))
+	assert.Equal(t, 31, balance.Balance)
+	found, ok := defaultTenant().loadCustomer(t.Name() + "-alice")
+	assert.True(t, ok)
+	assert.Equal(t, "Alice", found.Name)
+
+	// Nobody else's token sees her receipt
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+alice)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+bob)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("GET", "/receipts/"+submitted.Id+"/points", "", "Authorization", "Bearer "+bob)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("DELETE", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+bob)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("POST", "/graphql", `{"query": "{ receipts { id } }"}`, "Authorization", "Bearer "+bob)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data": {"receipts": []}}`, w.Body.String())
+	w = sendJSON("POST", "/graphql", `{"query": "{ receipts { id } }"}`, "Authorization", "Bearer "+alice)
+	assert.JSONEq(t, `{"data": {"receipts": [{"id": "`+submitted.Id+`"}]}}`, w.Body.String())
+
+	// Admin tokens see everyone's
+	admin := signer.token(t, t.Name()+"-admin", map[string]any{"scope": "openid admin"})
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = sendJSON("DELETE", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+alice)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestBearerTokenCustomer(t *testing.T) {
+	other := newTestCustomer(t)
+	signer := newECSigner(t, "ec")
+	acceptTokensFrom(t, signer)
+	token := signer.token(t, t.Name(), nil)
+
+	w := sendJSON("GET", "/v2/customers/"+t.Name(), "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = sendJSON("GET", "/v2/customers/"+other+"/balance", "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Authorization", "Bearer "+token, "Customer-Id", other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, customerTokenV2, body.Error)
+
+	// Operations outside the customer's reach take the admin scope
+	w = sendJSON("GET", "/admin/keys", "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope"`, w.Header().Get("WWW-Authenticate"))
+	w = sendJSON("GET", "/admin/keys", "", "Authorization", "Bearer "+signer.token(t, t.Name(), map[string]any{"scp": []string{"admin"}}))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestBearerTokenGroups(t *testing.T) {
+	ownerId, outsiderId := newTestCustomer(t), newTestCustomer(t)
+	created := newTestGroup(t, ownerId)
+	signer := newRSASigner(t, "rsa")
+	acceptTokensFrom(t, signer)
+
+	for _, path := range []string{"/v2/groups/" + created.Id, "/v2/groups/" + created.Id + "/contributions"} {
+		w := sendJSON("GET", path, "", "Authorization", "Bearer "+signer.token(t, ownerId, nil))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		w = sendJSON("GET", path, "", "Authorization", "Bearer "+signer.token(t, outsiderId, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+		w = sendJSON("GET", path, "", "Authorization", "Bearer "+signer.token(t, outsiderId, map[string]any{"scope": "admin"}))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+}
+
+func TestBearerTokenTenant(t *testing.T) {
+	other := newTestTenant(t, `{}`)
+	signer := newRSASigner(t, "rsa")
+	acceptTokensFrom(t, signer)
+	token := signer.token(t, t.Name(), nil)
+	otherToken := signer.token(t, t.Name(), map[string]any{"tenant": other.id, "scope": "admin"})
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Authorization", "Bearer "+otherToken)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+
+	// Tokens without a tenant claim belong to JWT_TENANT, and neither token can name the other's tenant
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+token, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, otherTenantV2, body.Error)
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+otherToken, "Tenant-Id", defaultTenantId)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Authorization", "Bearer "+otherToken, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	client := newGrpcClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token, "tenant-id", other.id)
+	_, err := client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: submitted.Id})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+otherToken)
+	_, err = client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: submitted.Id})
+	assert.NoError(t, err)
+}
+
+func TestInvalidBearerTokens(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	acceptTokensFrom(t, signer)
+	unknown := newRSASigner(t, "unknown")
+	impostor := newRSASigner(t, "rsa")
+
+	claims := strings.Split(signer.token(t, t.Name(), nil), ".")[1]
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg": "none"}`))
+	for name, token := range map[string]string{
+		"wrong issuer":   signer.token(t, t.Name(), map[string]any{"iss": "https://elsewhere.example.com/"}),
+		"wrong audience": signer.token(t, t.Name(), map[string]any{"aud": []string{"someone-else"}}),
+		"expired":        signer.token(t, t.Name(), map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"no expiry":      signer.token(t, t.Name(), map[string]any{"exp": nil}),
+		"not yet valid":  signer.token(t, t.Name(), map[string]any{"nbf": time.Now().Add(time.Hour).Unix()}),
+		"no subject":     signer.token(t, "", nil),
+		"unknown key":    unknown.token(t, t.Name(), nil),
+		"bad signature":  impostor.token(t, t.Name(), nil),
+		"alg none":       none + "." + claims + ".",
+		"garbage":        "not-a-token",
+	} {
+		w := sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+token)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+		assert.Equal(t, `Bearer error="invalid_token"`, w.Header().Get("WWW-Authenticate"), name)
+	}
+
+	// Credentials are required once tokens are accepted
+	w := sendJSON("GET", "/v2/receipts/missing", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON("GET", "/receipts/missing/points", "")
+	assert.JSONEq(t, `{"description": "A valid API key or bearer token is required."}`, w.Body.String())
+	w = sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+signer.token(t, t.Name(), map[string]any{"aud": []string{"other", testAudience}}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestJWKSRotation(t *testing.T) {
+	old := newRSASigner(t, "old")
+	path := acceptTokensFrom(t, old)
+	bearerTokens.Load().jwks.minRefetch = 0
+
+	// The provider starts signing with a key that wasn't published when the JWKS was fetched
+	rotated := newECSigner(t, "new")
+	assert.NoError(t, os.WriteFile(path, testJWKS(t, rotated), 0o600))
+	w := sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+rotated.token(t, t.Name(), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+old.token(t, t.Name(), nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// A JWKS that can't be read keeps the keys already fetched
+	assert.NoError(t, os.WriteFile(path, []byte(`{`), 0o600))
+	w = sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+newRSASigner(t, "other").token(t, t.Name(), nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+rotated.token(t, t.Name(), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestJWKSURL(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(testJWKS(t, signer))
+	}))
+	t.Cleanup(server.Close)
+	acceptTokens(t, server.URL)
+
+	// The JWKS is fetched once, and unknown key IDs don't refetch it within a minute of the last fetch
+	for i := 0; i < 3; i++ {
+		w := sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+signer.token(t, t.Name(), nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		w := sendJSON("GET", "/v2/receipts/missing", "", "Authorization", "Bearer "+newRSASigner(t, "unknown").token(t, t.Name(), nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestGrpcBearerToken(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	acceptTokensFrom(t, signer)
+	client := newGrpcClient(t)
+	alice := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signer.token(t, t.Name()+"-alice", nil))
+	bob := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signer.token(t, t.Name()+"-bob", nil))
+
+	processed, err := client.ProcessReceipt(alice, &receiptsv1.ProcessReceiptRequest{Receipt: &receiptsv1.Receipt{
+		Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "13:13", Total: "1.25",
+		Items: []*receiptsv1.Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+	}})
+	assert.NoError(t, err)
+	points, err := client.GetPoints(alice, &receiptsv1.GetPointsRequest{Id: processed.GetId()})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(31), points.GetPoints())
+	_, err = client.GetPoints(bob, &receiptsv1.GetPointsRequest{Id: processed.GetId()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The stream carries every customer's receipts
+	stream, err := client.StreamReceipts(bob, &receiptsv1.StreamReceiptsRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	invalid := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer not-a-token")
+	_, err = client.GetPoints(invalid, &receiptsv1.GetPointsRequest{Id: processed.GetId()})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestLoadJWTVerifier(t *testing.T) {
+	t.Cleanup(func() { bearerTokens.Store(nil) })
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, testJWKS(t, newRSASigner(t, "rsa")), 0o600))
+
+	t.Setenv("JWT_JWKS", "")
+	assert.NoError(t, loadJWTVerifier())
+	assert.Nil(t, bearerTokens.Load())
+
+	t.Setenv("JWT_JWKS", path)
+	assert.Error(t, loadJWTVerifier())
+	t.Setenv("JWT_ISSUER", testIssuer)
+	t.Setenv("JWT_AUDIENCE", testAudience)
+	t.Setenv("JWT_JWKS", filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, loadJWTVerifier())
+	assert.Nil(t, bearerTokens.Load())
+
+	t.Setenv("JWT_JWKS", path)
+	t.Setenv("JWT_JWKS_REFRESH", "5m")
+	assert.NoError(t, loadJWTVerifier())
+	assert.Equal(t, 5*time.Minute, bearerTokens.Load().jwks.refresh)
+	assert.Equal(t, scopeAdmin, bearerTokens.Load().adminScope)
+	assert.Equal(t, defaultTenantId, bearerTokens.Load().tenantId)
+
+	t.Setenv("JWT_TENANT", "corner-store")
+	assert.NoError(t, loadJWTVerifier())
+	assert.Equal(t, "corner-store", bearerTokens.Load().tenantId)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	entryEarn       = "earn"
+	entryAdjustment = "adjustment"
+	entryRedemption = "redemption"
+	entryReversal   = "reversal"
+	entryTransfer   = "transfer"
+)
+
+// Program accounts on the other side of every customer posting. Points are issued to customers by scoring and
+// adjustments, and redeemed by them
+const (
+	accountIssued   = "program:issued"
+	accountRedeemed = "program:redeemed"
+)
+
+// Customer and group accounts hold points their owners can spend, and can't go negative
+const (
+	customerAccountPrefix = "customer:"
+	groupAccountPrefix    = "group:"
+)
+
+func customerLedgerAccount(customerId string) string {
+	return customerAccountPrefix + customerId
+}
+
+func groupLedgerAccount(groupId string) string {
+	return groupAccountPrefix + groupId
+}
+
+func holderAccount(account string) bool {
+	return strings.HasPrefix(account, customerAccountPrefix) || strings.HasPrefix(account, groupAccountPrefix)
+}
+
+type posting struct {
+	Account string `json:"account" xml:"account" yaml:"account"`
+	Amount  int    `json:"amount" xml:"amount" yaml:"amount"`
+}
+
+// An immutable ledger entry whose postings sum to zero. Customer accounts hold the points the customer can spend, and
+// group accounts the points pooled by its members. CustomerId is the customer who posted it
+type ledgerEntry struct {
+	Id         string    `json:"id" xml:"id" yaml:"id"`
+	Type       string    `json:"type" xml:"type" yaml:"type"`
+	CustomerId string    `json:"customerId" xml:"customerId" yaml:"customerId"`
+	GroupId    string    `json:"groupId,omitempty" xml:"groupId,omitempty" yaml:"groupId,omitempty"`
+	ReceiptId  string    `json:"receiptId,omitempty" xml:"receiptId,omitempty" yaml:"receiptId,omitempty"`
+	OrderId    string    `json:"orderId,omitempty" xml:"orderId,omitempty" yaml:"orderId,omitempty"`
+	Reverses   string    `json:"reverses,omitempty" xml:"reverses,omitempty" yaml:"reverses,omitempty"`
+	Memo       string    `json:"memo,omitempty" xml:"memo,omitempty" yaml:"memo,omitempty"`
+	Postings   []posting `json:"postings" xml:"postings>posting" yaml:"postings"`
+	CreatedAt  time.Time `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+}
+
+var (
+	errInsufficientBalance = errors.New("insufficient balance")
+	errUnbalancedEntry     = errors.New("ledger entry is not balanced")
+	errEntryNotFound       = errors.New("ledger entry not found")
+	errAlreadyReversed     = errors.New("ledger entry has already been reversed")
+)
+
+// Append-only journal with running balances, which must always equal replayLedger of the entries. Customer
+// balances are also split into lots by when they were earned, for expiration
+type ledger struct {
+	mu       sync.Mutex
+	entries  []ledgerEntry
+	byId     map[string]int
+	reversed map[string]bool
+	balances map[string]int
+	policy   expirationPolicy
+	lots     map[string][]*pointsLot
+	uses     map[string][]lotUse
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		byId:     map[string]int{},
+		reversed: map[string]bool{},
+		balances: map[string]int{},
+		lots:     map[string][]*pointsLot{},
+		uses:     map[string][]lotUse{},
+	}
+}
+
+// Appends the entry if it balances and leaves no customer account negative
+func (l *ledger) post(entry ledgerEntry) (ledgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.postLocked(entry)
+}
+
+func (l *ledger) postLocked(entry ledgerEntry) (ledgerEntry, error) {
+	now := time.Now().UTC()
+
+	// Expired points can't be spent, even if the sweeper hasn't got to them yet
+	if entry.Type != entryExpiry {
+		for _, posting := range entry.Postings {
+			if holderAccount(posting.Account) && posting.Amount < 0 {
+				l.expireAccountLocked(posting.Account, now)
+			}
+		}
+	}
+
+	sum := 0
+	accounts := map[string]bool{}
+	for _, posting := range entry.Postings {
+		if accounts[posting.Account] || posting.Amount == 0 {
+			return ledgerEntry{}, errUnbalancedEntry
+		}
+		accounts[posting.Account] = true
+		sum += posting.Amount
+
+		// Customers and groups can't spend points they don't have
+		if holderAccount(posting.Account) && l.balances[posting.Account]+posting.Amount < 0 {
+			return ledgerEntry{}, errInsufficientBalance
+		}
+	}
+	if sum != 0 || len(entry.Postings) < 2 {
+		return ledgerEntry{}, errUnbalancedEntry
+	}
+
+	entry.Id = uuid.New().String()
+	entry.CreatedAt = now
+	entry.Postings = append([]posting(nil), entry.Postings...)
+
+	l.byId[entry.Id] = len(l.entries)
+	l.entries = append(l.entries, entry)
+	for _, posting := range entry.Postings {
+		l.balances[posting.Account] += posting.Amount
+		if holderAccount(posting.Account) {
+			l.moveLots(entry, posting)
+		}
+	}
+	return entry, nil
+}
+
+// Posts the opposite of an entry, once. Reversals themselves can't be reversed, post another entry instead
+func (l *ledger) reverse(id string, memo string) (ledgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, ok := l.byId[id]
+	if !ok {
+		return ledgerEntry{}, errEntryNotFound
+	}
+	original := l.entries[index]
+	if l.reversed[id] || original.Type == entryReversal {
+		return ledgerEntry{}, errAlreadyReversed
+	}
+
+	reversal := ledgerEntry{Type: entryReversal, CustomerId: original.CustomerId, GroupId: original.GroupId, ReceiptId: original.ReceiptId, OrderId: original.OrderId, Reverses: id, Memo: memo}
+	for _, posting := range original.Postings {
+		posting.Amount = -posting.Amount
+		reversal.Postings = append(reversal.Postings, posting)
+	}
+
+	reversal, err := l.postLocked(reversal)
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	l.reversed[id] = true
+	return reversal, nil
+}
+
+// The type of the entry, or of the entry it reverses
+func (l *ledger) originalTypeLocked(entry ledgerEntry) string {
+	if entry.Type == entryReversal {
+		return l.entries[l.byId[entry.Reverses]].Type
+	}
+	return entry.Type
+}
+
+func (l *ledger) entry(id string) (ledgerEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, ok := l.byId[id]
+	if !ok {
+		return ledgerEntry{}, false
+	}
+	return l.entries[index], true
+}
+
+func (l *ledger) balance(account string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balances[account]
+}
+
+// Entries posted to the account, oldest first
+func (l *ledger) entriesFor(account string) []ledgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []ledgerEntry
+	for _, entry := range l.entries {
+		for _, posting := range entry.Postings {
+			if posting.Account == account {
+				entries = append(entries, entry)
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// Balances of every account computed from the entries alone
+func replayLedger(entries []ledgerEntry) map[string]int {
+	balances := map[string]int{}
+	for _, entry := range entries {
+		for _, posting := range entry.Postings {
+			balances[posting.Account] += posting.Amount
+		}
+	}
+	return balances
+}
+
+// Moves points between a customer and a program account, positive points go to the customer
+func customerEntry(entryType string, customerId string, programAccount string, points int) ledgerEntry {
+	return ledgerEntry{Type: entryType, CustomerId: customerId, Postings: []posting{
+		{Account: customerLedgerAccount(customerId), Amount: points},
+		{Account: programAccount, Amount: -points},
+	}}
+}
+
+func setupLedgerAPI(group *gin.RouterGroup) {
+	group.POST("/customers/:id/redemptions", redeemPoints)
+	group.POST("/customers/:id/adjustments", adjustPoints)
+	group.GET("/ledger/entries/:id", getLedgerEntry)
+	group.POST("/ledger/entries/:id/reversal", reverseLedgerEntry)
+}
+
+var (
+	insufficientBalanceV2 = apiErrorV2{Code: "insufficient_balance", Message: "The customer doesn't have enough points."}
+	entryNotFoundV2       = apiErrorV2{Code: "entry_not_found", Message: "No ledger entry found for that ID."}
+	orderEntryV2          = apiErrorV2{Code: "order_entry", Message: "The ledger entry belongs to a reward order, cancel the order instead."}
+)
+
+// Answers a failed posting
+func respondLedgerError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errInsufficientBalance):
+		respondErrorV2(c, http.StatusConflict, insufficientBalanceV2)
+	case errors.Is(err, errEntryNotFound):
+		respondErrorV2(c, http.StatusNotFound, entryNotFoundV2)
+	case errors.Is(err, errAlreadyReversed):
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "already_reversed", Message: "The ledger entry has already been reversed."})
+	default:
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+	}
+}
+
+// POST /v2/customers/{id}/redemptions spends points from the customer's balance
+func redeemPoints(c *gin.Context) {
+	var request struct {
+		Points int    `json:"points" binding:"required,min=1"`
+		Memo   string `json:"memo"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	t := tenantOf(c)
+	if _, ok := t.customers.Load(c.Param("id")); !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+
+	entry := customerEntry(entryRedemption, c.Param("id"), accountRedeemed, -request.Points)
+	entry.Memo = request.Memo
+	posted, err := t.ledger.post(entry)
+	if err != nil {
+		respondLedgerError(c, err)
+		return
+	}
+
+	c.Header("Location", "/v2/ledger/entries/"+posted.Id)
+	respond(c, http.StatusCreated, posted)
+}
+
+// POST /v2/customers/{id}/adjustments corrects a customer's balance by hand, in either direction
+func adjustPoints(c *gin.Context) {
+	var request struct {
+		Points int    `json:"points" binding:"required"`
+		Memo   string `json:"memo" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	t := tenantOf(c)
+	if _, ok := t.customers.Load(c.Param("id")); !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+
+	entry := customerEntry(entryAdjustment, c.Param("id"), accountIssued, request.Points)
+	entry.Memo = request.Memo
+	posted, err := t.ledger.post(entry)
+	if err != nil {
+		respondLedgerError(c, err)
+		return
+	}
+
+	c.Header("Location", "/v2/ledger/entries/"+posted.Id)
+	respond(c, http.StatusCreated, posted)
+}
+
+func getLedgerEntry(c *gin.Context) {
+	entry, ok := tenantOf(c).ledger.entry(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, entryNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, entry)
+}
+
+// POST /v2/ledger/entries/{id}/reversal undoes an entry by posting its opposite
+func reverseLedgerEntry(c *gin.Context) {
+	// The memo is optional, and so is the body
+	var request struct {
+		Memo string `json:"memo"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+
+	// Reversing an order's entry behind its back would refund it without returning the stock or cancelling it
+	t := tenantOf(c)
+	if entry, ok := t.ledger.entry(c.Param("id")); ok && entry.OrderId != "" {
+		respondErrorV2(c, http.StatusConflict, orderEntryV2)
+		return
+	}
+
+	reversal, err := t.ledger.reverse(c.Param("id"), request.Memo)
+	if err != nil {
+		respondLedgerError(c, err)
+		return
+	}
+
+	c.Header("Location", "/v2/ledger/entries/"+reversal.Id)
+	respond(c, http.StatusCreated, reversal)
+}
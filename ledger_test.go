@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedgerEntriesBalance(t *testing.T) {
+	l := newLedger()
+	customer := customerLedgerAccount("c")
+
+	earned, err := l.post(customerEntry(entryEarn, "c", accountIssued, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, 100, l.balance(customer))
+	assert.Equal(t, -100, l.balance(accountIssued))
+
+	_, err = l.post(customerEntry(entryRedemption, "c", accountRedeemed, -101))
+	assert.ErrorIs(t, err, errInsufficientBalance)
+	_, err = l.post(ledgerEntry{Type: entryAdjustment, Postings: []posting{{Account: customer, Amount: 5}, {Account: accountIssued, Amount: -4}}})
+	assert.ErrorIs(t, err, errUnbalancedEntry)
+
+	redeemed, err := l.post(customerEntry(entryRedemption, "c", accountRedeemed, -60))
+	assert.NoError(t, err)
+
+	// Reversing the earn would take back points already spent
+	_, err = l.reverse(earned.Id, "")
+	assert.ErrorIs(t, err, errInsufficientBalance)
+
+	reversal, err := l.reverse(redeemed.Id, "refund")
+	assert.NoError(t, err)
+	assert.Equal(t, redeemed.Id, reversal.Reverses)
+	assert.Equal(t, []posting{{Account: customer, Amount: 60}, {Account: accountRedeemed, Amount: -60}}, reversal.Postings)
+	assert.Equal(t, 100, l.balance(customer))
+
+	_, err = l.reverse(redeemed.Id, "")
+	assert.ErrorIs(t, err, errAlreadyReversed)
+	_, err = l.reverse(reversal.Id, "")
+	assert.ErrorIs(t, err, errAlreadyReversed)
+	_, err = l.reverse("missing", "")
+	assert.ErrorIs(t, err, errEntryNotFound)
+
+	assert.Equal(t, l.balances, replayLedger(l.entries))
+	assert.Len(t, l.entriesFor(customer), 3)
+}
+
+func TestLedgerConcurrentRedemptions(t *testing.T) {
+	l := newLedger()
+	_, err := l.post(customerEntry(entryEarn, "c", accountIssued, 50))
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := l.post(customerEntry(entryRedemption, "c", accountRedeemed, -1)); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, succeeded)
+	assert.Equal(t, 0, l.balance(customerLedgerAccount("c")))
+	assert.Equal(t, l.balances, replayLedger(l.entries))
+}
+
+func TestRedemptionsAndAdjustments(t *testing.T) {
+	customerId := newTestCustomer(t)
+	sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", customerId)
+	customerPath := "/v2/customers/" + customerId
+
+	w := sendJSON("POST", customerPath+"/redemptions", `{"points": 32}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "insufficient_balance")
+
+	w = sendJSON("POST", customerPath+"/redemptions", `{"points": 30, "memo": "Free coffee"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var redemption ledgerEntry
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &redemption))
+	assert.Equal(t, entryRedemption, redemption.Type)
+	assert.Equal(t, "/v2/ledger/entries/"+redemption.Id, w.Header().Get("Location"))
+	assert.Equal(t, 1, customerBalance(t, customerId))
+
+	w = sendJSON("POST", customerPath+"/adjustments", `{"points": -2, "memo": "Typo"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = sendJSON("POST", customerPath+"/adjustments", `{"points": 10, "memo": "Goodwill"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = sendJSON("POST", customerPath+"/adjustments", `{"points": 0, "memo": "Nothing"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 11, customerBalance(t, customerId))
+
+	w = sendJSON("POST", "/v2/ledger/entries/"+redemption.Id+"/reversal", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, 41, customerBalance(t, customerId))
+	w = sendJSON("POST", "/v2/ledger/entries/"+redemption.Id+"/reversal", `{"memo": "Again"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = sendJSON("GET", customerPath+"/transactions", "")
+	var body struct{ Transactions []pointsTransaction }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	var types []string
+	var points []int
+	for _, transaction := range body.Transactions {
+		types = append(types, transaction.Type)
+		points = append(points, transaction.Points)
+	}
+	assert.Equal(t, []string{entryReversal, entryAdjustment, entryRedemption, entryEarn}, types)
+	assert.Equal(t, []int{30, 10, -30, 31}, points)
+	assert.Equal(t, redemption.Id, body.Transactions[0].Reverses)
+
+	w = sendJSON("GET", "/v2/ledger/entries/"+redemption.Id, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), accountRedeemed)
+	w = sendJSON("POST", "/v2/customers/missing/redemptions", `{"points": 1}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rules of the loyalty bonuses added to a customer's receipts on top of the scoring rules
+const (
+	ruleTierBonus    = "tier-bonus"
+	ruleDailyStreak  = "daily-streak"
+	ruleWeeklyStreak = "weekly-streak"
+)
+
+// A status tier reached by earning Threshold points over the last 12 months, its receipts earn Bonus percent more
+// points from the scoring rules
+type loyaltyTier struct {
+	Name      string
+	Threshold int
+	Bonus     int
+}
+
+// Lowest first, everyone is at least a member
+var loyaltyTiers = []loyaltyTier{
+	{Name: "member", Threshold: 0, Bonus: 0},
+	{Name: "silver", Threshold: 1000, Bonus: 25},
+	{Name: "gold", Threshold: 5000, Bonus: 50},
+}
+
+// Streak bonuses grow with every consecutive day or week a customer submits receipts, up to a cap
+const (
+	dailyStreakBonus     = 5
+	dailyStreakBonusCap  = 50
+	weeklyStreakBonus    = 10
+	weeklyStreakBonusCap = 100
+)
+
+type tierChange struct {
+	From             string    `json:"from" xml:"from" yaml:"from"`
+	To               string    `json:"to" xml:"to" yaml:"to"`
+	QualifyingPoints int       `json:"qualifyingPoints" xml:"qualifyingPoints" yaml:"qualifyingPoints"`
+	ChangedAt        time.Time `json:"changedAt" xml:"changedAt" yaml:"changedAt"`
+}
+
+// A customer's tier and streaks, streaks count the days and weeks (starting Monday, UTC) receipts were submitted in
+type loyaltyStatus struct {
+	tier        loyaltyTier
+	qualifying  int
+	dayStreak   int
+	lastDay     time.Time
+	weekStreak  int
+	lastWeek    time.Time
+	tierChanges []tierChange
+}
+
+type loyaltyProgram struct {
+	mu        sync.Mutex
+	customers map[string]*loyaltyStatus
+	ledger    *ledger
+	groups    *groupDirectory
+}
+
+func newLoyaltyProgram(pointsLedger *ledger, groups *groupDirectory) *loyaltyProgram {
+	return &loyaltyProgram{customers: map[string]*loyaltyStatus{}, ledger: pointsLedger, groups: groups}
+}
+
+func (p *loyaltyProgram) statusLocked(customerId string) *loyaltyStatus {
+	status, ok := p.customers[customerId]
+	if !ok {
+		status = &loyaltyStatus{tier: loyaltyTiers[0]}
+		p.customers[customerId] = status
+	}
+	return status
+}
+
+// Moves the customer to the tier their points over the 12 months before now qualify for, recording any change
+func (p *loyaltyProgram) evaluateLocked(customerId string, status *loyaltyStatus, now time.Time) {
+	status.qualifying = p.ledger.earnedSince(customerId, now.AddDate(-1, 0, 0))
+
+	tier := loyaltyTiers[0]
+	for _, candidate := range loyaltyTiers {
+		if status.qualifying >= candidate.Threshold {
+			tier = candidate
+		}
+	}
+	if tier != status.tier {
+		status.tierChanges = append(status.tierChanges, tierChange{From: status.tier.Name, To: tier.Name, QualifyingPoints: status.qualifying, ChangedAt: now})
+		status.tier = tier
+	}
+}
+
+// Extends the customer's streaks with a receipt submitted at the time and returns the bonuses it earns. Only the
+// first receipt of a day or week extends a streak, and receipts older than the streak don't change it
+func (status *loyaltyStatus) extendStreaks(submittedAt time.Time) []pointsAward {
+	var bonuses []pointsAward
+
+	day := startOfDay(submittedAt)
+	switch {
+	case status.dayStreak > 0 && day.Equal(status.lastDay.AddDate(0, 0, 1)):
+		status.dayStreak++
+		points := min((status.dayStreak-1)*dailyStreakBonus, dailyStreakBonusCap)
+		bonuses = append(bonuses, pointsAward{Rule: ruleDailyStreak, Points: points, Description: fmt.Sprintf("%d consecutive days with receipts", status.dayStreak)})
+		status.lastDay = day
+	case day.After(status.lastDay):
+		status.dayStreak = 1
+		status.lastDay = day
+	}
+
+	week := startOfWeek(submittedAt)
+	switch {
+	case status.weekStreak > 0 && week.Equal(status.lastWeek.AddDate(0, 0, 7)):
+		status.weekStreak++
+		points := min((status.weekStreak-1)*weeklyStreakBonus, weeklyStreakBonusCap)
+		bonuses = append(bonuses, pointsAward{Rule: ruleWeeklyStreak, Points: points, Description: fmt.Sprintf("%d consecutive weeks with receipts", status.weekStreak)})
+		status.lastWeek = week
+	case week.After(status.lastWeek):
+		status.weekStreak = 1
+		status.lastWeek = week
+	}
+
+	return bonuses
+}
+
+// Receipts whose points didn't reach the ledger aren't stored as credited
+var errCreditFailed = errors.New("the receipt's points could not be credited")
+
+// Adds the customer's tier and streak bonuses to a scored receipt and posts its points to their balance, or their
+// group's, then moves them up a tier if the receipt qualifies them. Receipts that earned nothing have nothing to post.
+// A failed post leaves the customer's streaks as they were
+func (p *loyaltyProgram) credit(receiptId string, stored storedReceipt) (storedReceipt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().UTC()
+	status := p.statusLocked(stored.CustomerId)
+	p.evaluateLocked(stored.CustomerId, status, now)
+	before := *status
+
+	// Never share the backing array of the breakdown the receipt was scored with
+	breakdown := slices.Clip(stored.Breakdown)
+	if status.tier.Bonus > 0 && stored.Points > 0 {
+		points := (stored.Points*status.tier.Bonus + 99) / 100
+		breakdown = append(breakdown, pointsAward{Rule: ruleTierBonus, Points: points,
+			Description: fmt.Sprintf("%s tier earns %d%% more points, rounded up", status.tier.Name, status.tier.Bonus)})
+	}
+	breakdown = append(breakdown, status.extendStreaks(stored.SubmittedAt)...)
+
+	stored.Breakdown = breakdown
+	stored.Points = 0
+	for _, award := range breakdown {
+		stored.Points += award.Points
+	}
+	if stored.Points == 0 {
+		return stored, nil
+	}
+
+	if _, err := p.groups.creditEarned(stored.CustomerId, receiptId, stored.Points); err != nil {
+		*status = before
+		return storedReceipt{}, fmt.Errorf("%w: %w", errCreditFailed, err)
+	}
+
+	p.evaluateLocked(stored.CustomerId, status, now)
+	return stored, nil
+}
+
+type loyaltyView struct {
+	Tier             string       `json:"tier" xml:"tier" yaml:"tier"`
+	Multiplier       float64      `json:"multiplier" xml:"multiplier" yaml:"multiplier"`
+	QualifyingPoints int          `json:"qualifyingPoints" xml:"qualifyingPoints" yaml:"qualifyingPoints"`
+	NextTier         string       `json:"nextTier,omitempty" xml:"nextTier,omitempty" yaml:"nextTier,omitempty"`
+	PointsToNextTier int          `json:"pointsToNextTier,omitempty" xml:"pointsToNextTier,omitempty" yaml:"pointsToNextTier,omitempty"`
+	DayStreak        int          `json:"dayStreak" xml:"dayStreak" yaml:"dayStreak"`
+	WeekStreak       int          `json:"weekStreak" xml:"weekStreak" yaml:"weekStreak"`
+	TierChanges      []tierChange `json:"tierChanges" xml:"tierChanges>tierChange" yaml:"tierChanges"`
+}
+
+// The customer's tier as of now, which may have dropped as earned points leave the 12 month window, and the
+// streaks they can still extend
+func (p *loyaltyProgram) view(customerId string, now time.Time) loyaltyView {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := p.statusLocked(customerId)
+	p.evaluateLocked(customerId, status, now)
+
+	view := loyaltyView{
+		Tier:             status.tier.Name,
+		Multiplier:       1 + float64(status.tier.Bonus)/100,
+		QualifyingPoints: status.qualifying,
+		TierChanges:      append([]tierChange{}, status.tierChanges...),
+	}
+	for _, tier := range loyaltyTiers {
+		if tier.Threshold > status.qualifying {
+			view.NextTier = tier.Name
+			view.PointsToNextTier = tier.Threshold - status.qualifying
+			break
+		}
+	}
+	if !startOfDay(now).After(status.lastDay.AddDate(0, 0, 1)) {
+		view.DayStreak = status.dayStreak
+	}
+	if !startOfWeek(now).After(status.lastWeek.AddDate(0, 0, 7)) {
+		view.WeekStreak = status.weekStreak
+	}
+	return view
+}
+
+// Points the customer earned since the time, less earnings reversed since, whether they went to their own balance or
+// their group's
+func (l *ledger) earnedSince(customerId string, since time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	earned := 0
+	for _, entry := range l.entries {
+		if entry.CustomerId != customerId || entry.CreatedAt.Before(since) || l.originalTypeLocked(entry) != entryEarn {
+			continue
+		}
+		for _, posting := range entry.Postings {
+			if holderAccount(posting.Account) {
+				earned += posting.Amount
+			}
+		}
+	}
+	return earned
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Weeks start on Monday
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// GET /v2/customers/{id}/loyalty shows the customer's tier, tier history and streaks
+func getCustomerLoyalty(c *gin.Context) {
+	t := tenantOf(c)
+	found, ok := t.loadCustomer(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, t.loyalty.view(found.Id, time.Now().UTC()))
+}
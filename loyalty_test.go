@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreakBonuses(t *testing.T) {
+	p := newLoyaltyProgram(defaultTenant().ledger, defaultTenant().groups)
+	customerId := uuid.New().String()
+
+	// 2026-03-02 is a Monday
+	bonuses := map[string]int{}
+	for _, date := range []string{"2026-03-02", "2026-03-03", "2026-03-04", "2026-03-04", "2026-03-09", "2026-03-16", "2026-03-17", "2026-03-03"} {
+		submittedAt, _ := time.Parse("2006-01-02", date)
+		credited, err := p.credit(uuid.New().String(), storedReceipt{Status: statusDone, Points: 1, Breakdown: []pointsAward{{Points: 1}}, SubmittedAt: submittedAt.Add(12 * time.Hour), CustomerId: customerId})
+		assert.NoError(t, err)
+		for _, award := range credited.Breakdown[1:] {
+			bonuses[date+" "+award.Rule] += award.Points
+		}
+	}
+
+	assert.Equal(t, map[string]int{
+		"2026-03-03 daily-streak":  5,
+		"2026-03-04 daily-streak":  10,
+		"2026-03-09 weekly-streak": 10,
+		"2026-03-16 weekly-streak": 20,
+		"2026-03-17 daily-streak":  5,
+	}, bonuses)
+	assert.Equal(t, 1+6+11+1+11+21+6+1, defaultTenant().ledger.balance(customerLedgerAccount(customerId)))
+
+	// Both streaks are long broken
+	view := p.view(customerId, time.Now())
+	assert.Equal(t, 0, view.DayStreak)
+	assert.Equal(t, 0, view.WeekStreak)
+}
+
+func TestFailedCredit(t *testing.T) {
+	p := newLoyaltyProgram(defaultTenant().ledger, defaultTenant().groups)
+	customerId := uuid.New().String()
+	submittedAt := time.Now().UTC()
+
+	// Taking points from an empty balance can't be posted
+	_, err := p.credit(uuid.New().String(), storedReceipt{Status: statusDone, Points: -1, Breakdown: []pointsAward{{Points: -1}}, SubmittedAt: submittedAt, CustomerId: customerId})
+	assert.ErrorIs(t, err, errCreditFailed)
+	assert.ErrorIs(t, err, errInsufficientBalance)
+	assert.Equal(t, 0, p.view(customerId, submittedAt).DayStreak)
+
+	credited, err := p.credit(uuid.New().String(), storedReceipt{Status: statusDone, Points: 1, Breakdown: []pointsAward{{Points: 1}}, SubmittedAt: submittedAt, CustomerId: customerId})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, credited.Points)
+	assert.Equal(t, 1, p.view(customerId, submittedAt).DayStreak)
+}
+
+func TestTierBonus(t *testing.T) {
+	customerId := newTestCustomer(t)
+	_, err := defaultTenant().ledger.post(customerEntry(entryEarn, customerId, accountIssued, 999))
+	assert.NoError(t, err)
+
+	// The receipt that takes the customer to silver doesn't earn the silver bonus itself
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", customerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, 999+31, customerBalance(t, customerId))
+
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Customer-Id", customerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+	assert.Equal(t, 31+8, *submitted.Points)
+	assert.Contains(t, submitted.Breakdown, pointsAward{Rule: ruleTierBonus, Points: 8, Description: "silver tier earns 25% more points, rounded up"})
+	assert.Equal(t, 999+31+39, customerBalance(t, customerId))
+
+	w = sendJSON("GET", "/v2/customers/"+customerId+"/loyalty", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var view loyaltyView
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+	assert.Equal(t, "silver", view.Tier)
+	assert.Equal(t, 1.25, view.Multiplier)
+	assert.Equal(t, 999+31+39, view.QualifyingPoints)
+	assert.Equal(t, "gold", view.NextTier)
+	assert.Equal(t, 5000-999-31-39, view.PointsToNextTier)
+	assert.Equal(t, 1, view.DayStreak)
+	assert.Len(t, view.TierChanges, 1)
+	assert.Equal(t, tierChange{From: "member", To: "silver", QualifyingPoints: 999 + 31, ChangedAt: view.TierChanges[0].ChangedAt}, view.TierChanges[0])
+
+	// Redemptions don't cost a tier, reversed earnings do
+	entries := defaultTenant().ledger.entriesFor(customerLedgerAccount(customerId))
+	w = sendJSON("POST", "/v2/customers/"+customerId+"/redemptions", `{"points": 50}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = sendJSON("GET", "/v2/customers/"+customerId+"/loyalty", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+	assert.Equal(t, "silver", view.Tier)
+
+	_, err = defaultTenant().ledger.reverse(entries[0].Id, "")
+	assert.NoError(t, err)
+	w = sendJSON("GET", "/v2/customers/"+customerId+"/loyalty", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+	assert.Equal(t, "member", view.Tier)
+	assert.Len(t, view.TierChanges, 2)
+
+	w = sendJSON("GET", "/v2/customers/missing/loyalty", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"math"
+	"errors"
+	"net"
 	"net/http"
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,180 +13,271 @@ import (
 )
 
 const DefaultPort = "8080"
+const DefaultGrpcPort = "9090"
 
 type Item struct {
-	ShortDescription string `json:"shortDescription"`
-	Price            string `json:"price"`
+	ShortDescription string `json:"shortDescription" xml:"shortDescription" yaml:"shortDescription"`
+	Price            string `json:"price" xml:"price" yaml:"price"`
 }
 
 type Receipt struct {
-	Retailer     string `json:"retailer"`
-	PurcahseDate string `json:"purchaseDate"`
-	PurchaseTime string `json:"purchaseTime"`
-	Items        []Item `json:"items"`
-	Total        string `json:"total"`
+	Retailer     string `json:"retailer" xml:"retailer" yaml:"retailer"`
+	PurcahseDate string `json:"purchaseDate" xml:"purchaseDate" yaml:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime" xml:"purchaseTime" yaml:"purchaseTime"`
+	Items        []Item `json:"items" xml:"items>item" yaml:"items"`
+	Total        string `json:"total" xml:"total" yaml:"total"`
 }
 
-var retailerRegex *regexp.Regexp
-var priceRegex *regexp.Regexp
-var itemShortDescRegex *regexp.Regexp
+type receiptStatus string
 
-var inMemoryStore sync.Map
+const (
+	statusPending    receiptStatus = "pending"
+	statusProcessing receiptStatus = "processing"
+	statusDone       receiptStatus = "done"
+	statusFailed     receiptStatus = "failed"
+)
+
+// Value kept in the in memory store for each receipt ID, replaced as a whole on every status change
+type storedReceipt struct {
+	Receipt     Receipt
+	Status      receiptStatus
+	Points      int
+	Breakdown   []pointsAward
+	Err         error
+	Async       bool
+	SubmittedAt time.Time
+	CustomerId  string
+}
 
 func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Serves the HTTP API, and the gRPC API alongside it, until either fails
+func serve() error {
+	if err := loadTenants(os.Getenv("TENANTS_FILE")); err != nil {
+		return err
+	}
+	if err := loadAPIKeys(os.Getenv("API_KEYS_FILE")); err != nil {
+		return err
+	}
+	if err := loadJWTVerifier(); err != nil {
+		return err
+	}
+	if err := loadExpiration(); err != nil {
+		return err
+	}
 	router := SetupAPI()
 
+	// Refuse to serve an API that has drifted from its contract
+	if err := verifyRoutes(router.Routes()); err != nil {
+		return err
+	}
+
 	// port from env or default
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = DefaultPort
 	}
 
-	router.Run(":" + port)
+	// gRPC API is served alongside on its own port
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = DefaultGrpcPort
+	}
+
+	listener, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- SetupGrpc().Serve(listener) }()
+	go func() { errs <- router.Run(":" + port) }()
+	return <-errs
 }
 
 func SetupAPI() *gin.Engine {
-	// Compile RegExs once
-	retailerRegex = regexp.MustCompile(`^[\w\s\-&]+$`)
-	priceRegex = regexp.MustCompile(`^\d+\.\d{2}$`)
-	itemShortDescRegex = regexp.MustCompile(`^[\w\s\-]+$`)
+	// api.yml is the source of truth for what a valid request is
+	loadAPISpec()
+
+	// Workers score receipts submitted with `Prefer: respond-async`
+	startWorkers()
+	startExpirySweeper()
+	startIdempotencySweeper()
 
 	router := gin.Default()
-	router.POST("/receipts/process", processReceipt)
-	router.GET("/receipts/:id/points", getReceiptPoints)
+	router.Use(validateResponses, limitRequestBodies, authenticate, selectTenant, authorizeCustomer)
+
+	// v1 is the contract in api.yml, the unversioned paths are deprecated aliases of it
+	setupV1(router.Group("/v1"))
+	setupV1(router.Group("", deprecatedAlias("/v1")))
+	setupV2(router.Group("/v2"))
+
+	router.GET("/graphql", serveGraphql)
+	router.POST("/graphql", serveGraphql)
+
+	admin := router.Group("/admin", requireConfiguredCredentials)
+	setupWebhookAPI(admin)
+	setupAPIKeyAdminAPI(admin)
+	setupRewardsAdminAPI(admin)
+	setupStatsAPI(router)
+	setupDocs(router)
 
 	return router
 }
 
 // TODO should we check if receipt line items add up to the total?
-// TODO switch from indentedJSON to JSON after development because it is more performant
 func processReceipt(c *gin.Context) {
 	var newReceipt Receipt
-
-	// Payload should bind to receipt type, otherwise bad request with custom message
-	if err := c.ShouldBindJSON(&newReceipt); err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
-		return
-	}
-
-	// Validate Retailer field against RegEx in schema or Bad Request
-	if !retailerRegex.MatchString(newReceipt.Retailer) {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
+	t := tenantOf(c)
+	// v1 only credits customers signed in with a token, it never read the Customer-Id header
+	caller, _ := requestToken(c)
+	customerId := caller.CustomerId
+
+	// Payload should bind to receipt type in the format of its Content-Type, otherwise bad request with custom message
+	if err := bindReceipt(c, &newReceipt); err != nil {
+		respond(c, http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
 		return
 	}
 
-	// Total receipt points accumulator
-	var points int = 0
-
-	// 1 point per alphanumeric char in retailer name
-	for _, char := range newReceipt.Retailer {
-		if char >= 'A' && char <= 'Z' || char >= 'a' && char <= 'z' || char >= '0' && char <= '9' {
-			points += 1
+	// Hand validation and scoring off to the worker pool if the client asked for it
+	if prefersAsync(c.GetHeader("Prefer")) {
+		receiptGuid := uuid.New().String()
+		if _, ok := t.enqueueReceipt(receiptGuid, newReceipt, customerId); !ok {
+			respond(c, http.StatusServiceUnavailable, gin.H{"description": "The server is too busy to accept the receipt."})
+			return
 		}
-	}
 
-	// Validate Total against RegEx in schema or Bad Request
-	if !priceRegex.MatchString(newReceipt.Total) {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
+		c.Header("Preference-Applied", "respond-async")
+		c.Header("Location", strings.TrimSuffix(c.FullPath(), "/process")+"/"+receiptGuid+"/points")
+		respond(c, http.StatusAccepted, gin.H{"id": receiptGuid})
 		return
 	}
 
-	// Parse receipt total or Bad Request
-	receiptTotal, err := strconv.ParseFloat(newReceipt.Total, 64)
+	receiptGuid, _, err := t.processNewReceipt(newReceipt, customerId)
+	if errors.Is(err, errCreditFailed) {
+		respond(c, http.StatusInternalServerError, gin.H{"description": creditFailedV2.Message})
+		return
+	}
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
+		respond(c, http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
 		return
 	}
 
-	// 50 points if total is a round dollar amount, 25 points if total is a 25 cent amount
-	if getChange(receiptTotal) == 0 {
-		// 50 points + 25 points because round dollar around and is a multiple of 0.25
-		points += 75
-	} else if getChange(receiptTotal) == 25 {
-		points += 25
-	}
+	respond(c, http.StatusOK, gin.H{"id": receiptGuid})
+}
 
-	// Validate Items has at least 1 or Bad Request
-	if len(newReceipt.Items) == 0 {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
-		return
+// Scores and stores the receipt under a new ID, shared by every transport that submits receipts synchronously.
+// Its points are credited to the customer unless customerId is empty
+func (t *tenant) processNewReceipt(receipt Receipt, customerId string) (string, storedReceipt, error) {
+	result, err := t.score(receipt)
+	if err != nil {
+		t.publishWebhookEvent(eventReceiptRejected, gin.H{"receipt": receipt})
+		return "", storedReceipt{}, err
 	}
 
-	// 5 points for every two items
-	points += (len(newReceipt.Items) / 2) * 5
+	receiptGuid := uuid.New().String()
+	stored := storedReceipt{Receipt: receipt, Status: statusDone, Points: result.Points, Breakdown: result.Breakdown, SubmittedAt: time.Now().UTC(), CustomerId: customerId}
+	stored, err = t.storeScoredReceipt(receiptGuid, stored)
+	if err != nil {
+		return "", storedReceipt{}, err
+	}
 
-	// If the trimmed length of the item description is a multiple of 3, multiply the price by `0.2` and round up to the nearest integer. The result is the number of points earned.
-	for _, item := range newReceipt.Items {
+	return receiptGuid, stored, nil
+}
 
-		// Validate Short Description against RegEx in schema or Bad Request
-		if !itemShortDescRegex.MatchString(item.ShortDescription) {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
-			return
-		}
+// Credits a scored receipt to its customer with their loyalty bonuses, stores it and announces it. Returns the
+// receipt as stored. A receipt that couldn't be credited isn't stored
+func (t *tenant) storeScoredReceipt(id string, stored storedReceipt) (storedReceipt, error) {
+	stored, err := t.creditScoredReceipt(id, stored)
+	if err != nil {
+		return storedReceipt{}, err
+	}
+	t.receipts.Store(id, stored)
+	t.announceScoredReceipt(id, stored)
+	return stored, nil
+}
 
-		// Validate Item Price against RegEx in schema or Bad Request
-		if !priceRegex.MatchString(item.Price) {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
-			return
-		}
+// The receipt with its customer's loyalty bonuses, once its points are credited to them
+func (t *tenant) creditScoredReceipt(id string, stored storedReceipt) (storedReceipt, error) {
+	if stored.CustomerId == "" {
+		return stored, nil
+	}
+	return t.loyalty.credit(id, stored)
+}
 
-		// Reduce nesting, continue if short description is not a multiple of 3
-		if len(strings.TrimSpace(item.ShortDescription))%3 != 0 {
-			continue
-		}
+// Counts a stored receipt in the stats and notifies webhook subscribers and stream listeners
+func (t *tenant) announceScoredReceipt(id string, stored storedReceipt) {
+	t.stats.record(stored.Receipt, stored.Points, stored.Breakdown)
+	t.publishWebhookEvent(eventReceiptScored, gin.H{"id": id, "points": stored.Points})
+	t.feed.publish(id, stored.Receipt.Retailer, stored.Points)
+}
 
-		// Parse item price or Bad Request
-		itemPrice, err := strconv.ParseFloat(item.Price, 64)
-		if err != nil {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
-			return
-		}
+func getReceiptPoints(c *gin.Context) {
+	// don't need to check input against regex since the in memory store is populated by GUIDs and will always be valid
+	stored, ok := tenantOf(c).visibleReceipt(c, c.Param("id"))
 
-		// Round up item price * 0.2, add to points
-		roundUp := math.Ceil(itemPrice * 0.2)
-		points += int(roundUp)
+	// exit if we can't find this receipt ID
+	if !ok {
+		respond(c, http.StatusNotFound, gin.H{"description": "No receipt found for that ID."})
+		return
 	}
 
-	// Parse date and time as combined string with datetime
-	timeString := newReceipt.PurcahseDate + "T" + newReceipt.PurchaseTime
-	dateTime, err := time.Parse("2006-01-02T15:04", timeString)
-	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
+	// Clients polling with a current ETag don't need the body again
+	if notModified(c, stored) {
 		return
 	}
 
-	// 6 points if the day in the purchase date is odd.
-	if dateTime.Day()%2 == 1 {
-		points += 6
+	// Receipts processed synchronously keep the plain points response from the spec
+	if !stored.Async {
+		respond(c, http.StatusOK, gin.H{"points": stored.Points})
+		return
 	}
 
-	// 10 points if the time of purchase is after 2:00pm and before 4:00pm.
-	// [2:01pm, 3:59pm], description as after 2pm & before 4pm, interprating as exclusive range
-	if dateTime.Hour() >= 14 && dateTime.Hour() < 16 && (dateTime.Hour() > 14 || dateTime.Minute() > 0) {
-		points += 10
+	switch stored.Status {
+	case statusDone:
+		respond(c, http.StatusOK, gin.H{"status": stored.Status, "points": stored.Points})
+	case statusFailed:
+		if errors.Is(stored.Err, errCreditFailed) {
+			respond(c, http.StatusInternalServerError, gin.H{"status": stored.Status, "description": creditFailedV2.Message})
+			return
+		}
+		respond(c, http.StatusBadRequest, gin.H{"status": stored.Status, "description": "The receipt is invalid."})
+	default:
+		respond(c, http.StatusAccepted, gin.H{"status": stored.Status})
 	}
-
-	receiptGuid := uuid.New().String()
-
-	inMemoryStore.Store(receiptGuid, points)
-
-	c.IndentedJSON(http.StatusOK, gin.H{"id": receiptGuid})
 }
 
-func getReceiptPoints(c *gin.Context) {
-	// don't need to check input against regex since the in memory store is populated by GUIDs and will always be valid
-	points, ok := inMemoryStore.Load(c.Param("id"))
-
-	// exit if we can't find this receipt ID
+// The receipt, if it is stored and the request may see it
+func (t *tenant) visibleReceipt(c *gin.Context, id string) (storedReceipt, bool) {
+	value, ok := t.receipts.Load(id)
 	if !ok {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"description": "No receipt found for that ID."})
-		return
+		return storedReceipt{}, false
 	}
+	stored := value.(storedReceipt)
+	return stored, canSeeReceipt(c, stored)
+}
 
-	c.IndentedJSON(http.StatusOK, gin.H{"points": points})
+// Deletes the receipt if the request may see it. Receipts never change hands to a customer who can't see them, so
+// checking first is safe
+func (t *tenant) deleteVisibleReceipt(c *gin.Context, id string) bool {
+	if _, ok := t.visibleReceipt(c, id); !ok {
+		return false
+	}
+	t.receiptsMu.Lock()
+	defer t.receiptsMu.Unlock()
+	_, ok := t.receipts.LoadAndDelete(id)
+	return ok
 }
 
-// For a dollar amounted represented as a float, returns the change in cents as an integer
-func getChange(dollars float64) int {
-	return int((dollars * 100)) % 100
+func deleteReceipt(c *gin.Context) {
+	t := tenantOf(c)
+	if !t.deleteVisibleReceipt(c, c.Param("id")) {
+		respond(c, http.StatusNotFound, gin.H{"description": "No receipt found for that ID."})
+		return
+	}
+
+	t.publishWebhookEvent(eventReceiptDeleted, gin.H{"id": c.Param("id")})
+	c.Status(http.StatusNoContent)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+)
+
+// Response formats in order of preference when the Accept header allows several
+var offeredFormats = []string{
+	binding.MIMEJSON,
+	binding.MIMEMSGPACK2, binding.MIMEMSGPACK,
+	binding.MIMEYAML2, binding.MIMEYAML, "text/yaml",
+	binding.MIMEXML, binding.MIMEXML2,
+}
+
+// Renders obj in the format negotiated by responseFormat
+func respond(c *gin.Context, code int, obj any) {
+	c.Header("Vary", "Accept")
+
+	switch responseFormat(c) {
+	case formatMsgPack:
+		c.Render(code, render.MsgPack{Data: obj})
+	case formatYAML:
+		c.YAML(code, obj)
+	case formatXML:
+		c.XML(code, obj)
+	case formatPrettyJSON:
+		c.IndentedJSON(code, obj)
+	default:
+		c.JSON(code, obj)
+	}
+}
+
+const (
+	formatJSON       = "json"
+	formatPrettyJSON = "pretty-json"
+	formatMsgPack    = "msgpack"
+	formatYAML       = "yaml"
+	formatXML        = "xml"
+)
+
+// Format negotiated from the Accept header, JSON if nothing offered is acceptable.
+// JSON is indented in debug mode or when asked for with ?pretty, compact otherwise
+func responseFormat(c *gin.Context) string {
+	switch c.NegotiateFormat(offeredFormats...) {
+	case binding.MIMEMSGPACK2, binding.MIMEMSGPACK:
+		return formatMsgPack
+	case binding.MIMEYAML2, binding.MIMEYAML, "text/yaml":
+		return formatYAML
+	case binding.MIMEXML, binding.MIMEXML2:
+		return formatXML
+	}
+
+	if gin.IsDebugging() || wantsPretty(c) {
+		return formatPrettyJSON
+	}
+	return formatJSON
+}
+
+func wantsPretty(c *gin.Context) bool {
+	pretty, ok := c.GetQuery("pretty")
+	return ok && pretty != "false" && pretty != "0"
+}
+
+type receiptFormat struct {
+	name    string
+	binding binding.Binding
+}
+
+// Formats bindReceipt reads by Content-Type, with the names error messages give them
+var receiptFormats = map[string]receiptFormat{
+	binding.MIMEXML:      {name: "XML", binding: binding.XML},
+	binding.MIMEXML2:     {name: "XML", binding: binding.XML},
+	binding.MIMEYAML:     {name: "YAML", binding: binding.YAML},
+	binding.MIMEYAML2:    {name: "YAML", binding: binding.YAML},
+	"text/yaml":          {name: "YAML", binding: binding.YAML},
+	binding.MIMEMSGPACK:  {name: "MessagePack", binding: binding.MsgPack},
+	binding.MIMEMSGPACK2: {name: "MessagePack", binding: binding.MsgPack},
+}
+
+var jsonReceiptFormat = receiptFormat{name: "JSON", binding: binding.JSON}
+
+func receiptFormatOf(c *gin.Context) receiptFormat {
+	if format, ok := receiptFormats[c.ContentType()]; ok {
+		return format
+	}
+	return jsonReceiptFormat
+}
+
+// The name of the format bindReceipt decodes the body as, for error messages
+func receiptFormatName(c *gin.Context) string {
+	return receiptFormatOf(c).name
+}
+
+// Binds the request body by Content-Type. Anything that isn't XML, YAML or MessagePack is read as JSON,
+// as it always has been, so clients that leave the header off keep working
+func bindReceipt(c *gin.Context, receipt *Receipt) error {
+	return c.ShouldBindWith(receipt, receiptFormatOf(c).binding)
+}
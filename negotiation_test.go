@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/yaml.v3"
+)
+
+// POSTs the body with the given Content-Type and Accept, returning the recorder
+func processAs(t *testing.T, contentType string, accept string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", accept)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestXmlReceiptRoundTrip(t *testing.T) {
+	w := processAs(t, "application/xml", "application/xml", []byte(`<receipt>
+  <retailer>M&amp;M Corner Market</retailer>
+  <purchaseDate>2022-03-20</purchaseDate>
+  <purchaseTime>14:33</purchaseTime>
+  <items>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+    <item><shortDescription>Gatorade</shortDescription><price>2.25</price></item>
+  </items>
+  <total>9.00</total>
+</receipt>`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+
+	var posted struct {
+		Id string `xml:"id"`
+	}
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &posted))
+
+	req := httptest.NewRequest("GET", "/receipts/"+posted.Id+"/points", nil)
+	req.Header.Set("Accept", "text/xml")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var points struct {
+		Points int `xml:"points"`
+	}
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &points))
+	assert.Equal(t, 109, points.Points)
+}
+
+func TestYamlAndMsgPackReceipts(t *testing.T) {
+	receipt := Receipt{
+		Retailer:     "Target",
+		PurcahseDate: "2022-01-02",
+		PurchaseTime: "13:13",
+		Items:        []Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+		Total:        "1.25",
+	}
+
+	yamlBody, err := yaml.Marshal(receipt)
+	assert.NoError(t, err)
+
+	w := processAs(t, "application/yaml", "application/yaml", yamlBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var posted map[string]string
+	assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &posted))
+	assert.NotEmpty(t, posted["id"])
+
+	var msgpackBody []byte
+	assert.NoError(t, codec.NewEncoderBytes(&msgpackBody, &codec.MsgpackHandle{}).Encode(receipt))
+
+	w = processAs(t, "application/msgpack", "application/x-msgpack", msgpackBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "application/msgpack"))
+
+	posted = nil
+	assert.NoError(t, codec.NewDecoderBytes(w.Body.Bytes(), &codec.MsgpackHandle{}).Decode(&posted))
+	assert.NotEmpty(t, posted["id"])
+}
+
+func TestMalformedReceiptNamesFormat(t *testing.T) {
+	for contentType, format := range map[string]string{
+		"application/json":    "JSON",
+		"application/xml":     "XML",
+		"application/yaml":    "YAML",
+		"application/msgpack": "MessagePack",
+	} {
+		req := httptest.NewRequest("POST", "/v2/receipts/score", strings.NewReader(`{"retailer": [`))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, contentType)
+		assert.Contains(t, w.Body.String(), "The receipt is not valid "+format+".", contentType)
+	}
+}
+
+func TestJsonIndentation(t *testing.T) {
+	// Debug mode and ?pretty indent
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/missing/points", nil))
+	assert.Contains(t, w.Body.String(), "\n")
+
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.DebugMode)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/missing/points", nil))
+	assert.Equal(t, `{"description":"No receipt found for that ID."}`, w.Body.String())
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/missing/points?pretty", nil))
+	assert.Contains(t, w.Body.String(), "\n")
+
+	// Unsupported Accept falls back to JSON
+	req := httptest.NewRequest("GET", "/receipts/missing/points", nil)
+	req.Header.Set("Accept", "text/csv")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+}
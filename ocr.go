@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Largest plain-text receipt accepted, OCR output of a long receipt is a few KB
+const maxReceiptTextBytes = 64 << 10
+
+// How sure the parser is of each field, from 0 (not found) to 1
+type receiptConfidence struct {
+	Retailer     float64 `json:"retailer" xml:"retailer" yaml:"retailer"`
+	PurchaseDate float64 `json:"purchaseDate" xml:"purchaseDate" yaml:"purchaseDate"`
+	PurchaseTime float64 `json:"purchaseTime" xml:"purchaseTime" yaml:"purchaseTime"`
+	Items        float64 `json:"items" xml:"items" yaml:"items"`
+	Total        float64 `json:"total" xml:"total" yaml:"total"`
+}
+
+// A receipt extracted from text, Result is set once it has been submitted
+type parsedReceipt struct {
+	XMLName    xml.Name          `json:"-" xml:"parsed" yaml:"-"`
+	Receipt    Receipt           `json:"receipt" xml:"receipt" yaml:"receipt"`
+	Confidence receiptConfidence `json:"confidence" xml:"confidence" yaml:"confidence"`
+	Result     *receiptV2        `json:"result,omitempty" xml:"result,omitempty" yaml:"result,omitempty"`
+}
+
+var (
+	// An amount at the end of a line, OCR often reads 0 as O and prints a tax flag after it
+	textAmountRegex = regexp.MustCompile(`^(.*?)\s*\$?\s*(-?)(\d[\dOo]*|[Oo])[.,]([\dOo]{2})(?:\s+[A-Z]{1,2})?$`)
+
+	textISODateRegex = regexp.MustCompile(`\b(\d{4})-(\d{1,2})-(\d{1,2})\b`)
+	textUSDateRegex  = regexp.MustCompile(`\b(\d{1,2})[/-](\d{1,2})[/-](\d{4}|\d{2})\b`)
+	textTimeRegex    = regexp.MustCompile(`\b(\d{1,2}):(\d{2})(?::\d{2})?(?:\s*([AaPp])\.?[Mm]\b\.?)?`)
+	textPhoneRegex   = regexp.MustCompile(`\(?\d{3}\)?[-.\s]\d{3}[-.\s]\d{4}`)
+
+	textTotalRegex    = regexp.MustCompile(`(?i)^(grand\s+total|total|total\s+due|amount\s+due|balance\s+due)\b`)
+	textSubtotalRegex = regexp.MustCompile(`(?i)^sub[\s-]*total\b`)
+	textTaxRegex      = regexp.MustCompile(`(?i)^(sales\s+)?tax\b`)
+
+	// Lines with an amount that aren't items
+	textNotItemRegex = regexp.MustCompile(`(?i)\b(total|tax|change|cash|visa|mastercard|amex|discover|credit|debit|tender|balance|payment|savings|discount|tip|you saved)\b`)
+
+	textSKURegex         = regexp.MustCompile(`^\d{6,}\s+`)
+	textWelcomeRegex     = regexp.MustCompile(`(?i)^welcome(\s+to)?\b\s*`)
+	textNotRetailerRegex = regexp.MustCompile(`(?i)(www\.|\.com\b|@|\breceipt\b|\bthank)`)
+	retailerInvalidChars = regexp.MustCompile(`[^\w\s\-&]+`)
+	textWhitespaceRegex  = regexp.MustCompile(`\s+`)
+)
+
+// Extracts a receipt from plain text such as OCR output. Fields that can't be found are left empty with a
+// confidence of 0, nothing is validated so the receipt may still be rejected when submitted
+func parseReceiptText(text string) parsedReceipt {
+	parsed := parsedReceipt{Receipt: Receipt{Items: []Item{}}}
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	// Items are the amount lines up to the subtotal or total, payment lines follow them
+	itemsCents, taxCents, subtotalCents, totalCents := 0, 0, -1, -1
+	headerEnd := len(lines)
+	itemsEnd := false
+	for i, line := range lines {
+		match := textAmountRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		label := strings.TrimSpace(match[1])
+		cents := textAmountCents(match[3], match[4])
+		if match[2] == "-" {
+			cents = -cents
+		}
+
+		switch {
+		case textSubtotalRegex.MatchString(label):
+			subtotalCents = cents
+			itemsEnd = true
+		case textTotalRegex.MatchString(label):
+			if totalCents < 0 {
+				totalCents = cents
+			}
+			itemsEnd = true
+		case textTaxRegex.MatchString(label):
+			taxCents += cents
+		case itemsEnd || cents < 0 || textNotItemRegex.MatchString(label):
+		default:
+			description := textSKURegex.ReplaceAllString(label, "")
+			if !strings.ContainsFunc(description, isLetter) {
+				continue
+			}
+			headerEnd = min(headerEnd, i)
+			itemsCents += cents
+			parsed.Receipt.Items = append(parsed.Receipt.Items, Item{ShortDescription: description, Price: formatCents(cents)})
+		}
+	}
+
+	parsed.Receipt.Retailer, parsed.Confidence.Retailer = parseTextRetailer(lines[:headerEnd])
+	parsed.Receipt.PurcahseDate, parsed.Confidence.PurchaseDate = parseTextDate(lines)
+	parsed.Receipt.PurchaseTime, parsed.Confidence.PurchaseTime = parseTextTime(lines)
+
+	// Items and total vouch for each other when they add up
+	consistent := itemsCents == totalCents || itemsCents+taxCents == totalCents || itemsCents == subtotalCents
+	switch {
+	case len(parsed.Receipt.Items) == 0:
+	case consistent:
+		parsed.Confidence.Items = 1
+	default:
+		parsed.Confidence.Items = 0.5
+	}
+	switch {
+	case totalCents >= 0 && consistent:
+		parsed.Receipt.Total = formatCents(totalCents)
+		parsed.Confidence.Total = 1
+	case totalCents >= 0:
+		parsed.Receipt.Total = formatCents(totalCents)
+		parsed.Confidence.Total = 0.8
+	case len(parsed.Receipt.Items) > 0:
+		parsed.Receipt.Total = formatCents(itemsCents + taxCents)
+		parsed.Confidence.Total = 0.4
+	}
+	return parsed
+}
+
+// The first header line that reads like a name rather than an address, phone number, date or slogan
+func parseTextRetailer(header []string) (string, float64) {
+	for i, line := range header {
+		if textPhoneRegex.MatchString(line) || textNotRetailerRegex.MatchString(line) ||
+			textISODateRegex.MatchString(line) || textUSDateRegex.MatchString(line) || textTimeRegex.MatchString(line) {
+			continue
+		}
+		// Street addresses and store numbers start with a digit
+		if line[0] >= '0' && line[0] <= '9' {
+			continue
+		}
+
+		name := textWelcomeRegex.ReplaceAllString(line, "")
+		cleaned := strings.TrimSpace(textWhitespaceRegex.ReplaceAllString(retailerInvalidChars.ReplaceAllString(name, ""), " "))
+		if !strings.ContainsFunc(cleaned, isLetter) {
+			continue
+		}
+
+		// Less sure of names further down or with characters OCR may have made up
+		switch {
+		case i == 0 && cleaned == name:
+			return cleaned, 0.9
+		case i == 0 || cleaned == name:
+			return cleaned, 0.7
+		default:
+			return cleaned, 0.5
+		}
+	}
+	return "", 0
+}
+
+// The first date on the receipt, ISO or US month first
+func parseTextDate(lines []string) (string, float64) {
+	for _, line := range lines {
+		if match := textISODateRegex.FindStringSubmatch(line); match != nil {
+			if date, ok := textDate(match[1], match[2], match[3]); ok {
+				return date, 1
+			}
+		}
+		if match := textUSDateRegex.FindStringSubmatch(line); match != nil {
+			year := match[3]
+			if len(year) == 2 {
+				year = "20" + year
+			}
+			if date, ok := textDate(year, match[1], match[2]); ok {
+				// 03/04 could be the 3rd of April outside the US
+				day, _ := strconv.Atoi(match[2])
+				if day <= 12 {
+					return date, 0.7
+				}
+				return date, 0.9
+			}
+		}
+	}
+	return "", 0
+}
+
+// The first time on the receipt as 24-hour HH:MM
+func parseTextTime(lines []string) (string, float64) {
+	for _, line := range lines {
+		for _, match := range textTimeRegex.FindAllStringSubmatch(line, -1) {
+			hour, _ := strconv.Atoi(match[1])
+			minute, _ := strconv.Atoi(match[2])
+			meridiem := strings.ToLower(match[3])
+
+			confidence := 1.0
+			switch {
+			case meridiem != "" && (hour < 1 || hour > 12):
+				continue
+			case meridiem == "a" && hour == 12:
+				hour = 0
+			case meridiem == "p" && hour < 12:
+				hour += 12
+			case meridiem == "" && hour <= 12:
+				// Without AM or PM, 08:13 could be in the evening on a 12-hour clock
+				confidence = 0.8
+			}
+			if hour > 23 || minute > 59 {
+				continue
+			}
+			return fmt.Sprintf("%02d:%02d", hour, minute), confidence
+		}
+	}
+	return "", 0
+}
+
+func textDate(year string, month string, day string) (string, bool) {
+	date, err := time.Parse("2006-1-2", year+"-"+month+"-"+day)
+	if err != nil {
+		return "", false
+	}
+	return date.Format(time.DateOnly), true
+}
+
+func textAmountCents(dollars string, cents string) int {
+	digits := strings.NewReplacer("O", "0", "o", "0").Replace(dollars + cents)
+	value, _ := strconv.Atoi(digits)
+	return value
+}
+
+// An amount as dollars and cents, the sign in front so -50 is -0.50
+func formatCents(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func isLetter(char rune) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+// POST /v2/receipts/parse extracts a receipt from plain text, and with ?submit=true processes it like any other
+func parseReceiptV2(c *gin.Context) {
+	// The body is capped by limitRequestBodies, a partial receipt would be parsed as if it were whole
+	text, err := io.ReadAll(c.Request.Body)
+	if bodyTooLarge(err) {
+		respondErrorV2(c, http.StatusRequestEntityTooLarge, requestTooLargeV2)
+		return
+	}
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "malformed_receipt", Message: "The receipt text could not be read."})
+		return
+	}
+
+	parsed := parseReceiptText(string(text))
+	if c.Query("submit") != "true" {
+		respond(c, http.StatusOK, parsed)
+		return
+	}
+
+	t := tenantOf(c)
+	customerId := requestCustomerId(c)
+	if !t.knownCustomer(customerId) {
+		respondErrorV2(c, http.StatusBadRequest, unknownCustomerV2)
+		return
+	}
+
+	receiptGuid, stored, err := t.processNewReceipt(parsed.Receipt, customerId)
+	if errors.Is(err, errCreditFailed) {
+		respondErrorV2(c, http.StatusInternalServerError, creditFailedV2)
+		return
+	}
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidReceiptV2(err))
+		return
+	}
+	result := newReceiptV2(receiptGuid, stored, false)
+	parsed.Result = &result
+
+	c.Header("Location", "/v2/receipts/"+receiptGuid)
+	respond(c, http.StatusCreated, parsed)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Every text receipt in examples/text is a printed copy of the JSON receipt with the same name in examples
+func TestParseReceiptTextCorpus(t *testing.T) {
+	names, err := filepath.Glob("examples/text/*.txt")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, names)
+
+	for _, name := range names {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			text, err := os.ReadFile(name)
+			assert.NoError(t, err)
+			data, err := os.ReadFile(filepath.Join("examples", strings.TrimSuffix(filepath.Base(name), ".txt")+".json"))
+			assert.NoError(t, err)
+
+			var expected Receipt
+			assert.NoError(t, json.Unmarshal(data, &expected))
+			parsed := parseReceiptText(string(text))
+			actual := parsed.Receipt
+
+			// Printed receipts are often upper case, which scores the same
+			assert.True(t, strings.EqualFold(expected.Retailer, actual.Retailer), actual.Retailer)
+			assert.Equal(t, expected.PurcahseDate, actual.PurcahseDate)
+			assert.Equal(t, expected.PurchaseTime, actual.PurchaseTime)
+			assert.Equal(t, expected.Total, actual.Total)
+			if assert.Len(t, actual.Items, len(expected.Items)) {
+				for i, item := range expected.Items {
+					assert.True(t, strings.EqualFold(strings.TrimSpace(item.ShortDescription), actual.Items[i].ShortDescription), actual.Items[i].ShortDescription)
+					assert.Equal(t, item.Price, actual.Items[i].Price)
+				}
+			}
+
+			expectedResult, err := Score(expected)
+			assert.NoError(t, err)
+			actualResult, err := Score(actual)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedResult.Points, actualResult.Points)
+
+			assert.Equal(t, 1.0, parsed.Confidence.Items)
+			assert.Equal(t, 1.0, parsed.Confidence.Total)
+			assert.GreaterOrEqual(t, parsed.Confidence.Retailer, 0.5)
+			assert.GreaterOrEqual(t, parsed.Confidence.PurchaseDate, 0.5)
+			assert.GreaterOrEqual(t, parsed.Confidence.PurchaseTime, 0.5)
+		})
+	}
+}
+
+func TestParseReceiptTextConfidence(t *testing.T) {
+	// No total, and a time without AM or PM
+	parsed := parseReceiptText("Corner Shop!\n12/25/2022 07:30\nCoffee 2.50\nBagel 1.75\n")
+	assert.Equal(t, "Corner Shop", parsed.Receipt.Retailer)
+	assert.Equal(t, 0.7, parsed.Confidence.Retailer)
+	assert.Equal(t, "2022-12-25", parsed.Receipt.PurcahseDate)
+	assert.Equal(t, 0.9, parsed.Confidence.PurchaseDate)
+	assert.Equal(t, "07:30", parsed.Receipt.PurchaseTime)
+	assert.Equal(t, 0.8, parsed.Confidence.PurchaseTime)
+	assert.Equal(t, "4.25", parsed.Receipt.Total)
+	assert.Equal(t, 0.4, parsed.Confidence.Total)
+
+	// Items that don't add up to the total
+	parsed = parseReceiptText("Shop\nCoffee 2.50\nTOTAL 3.00\n")
+	assert.Equal(t, 0.5, parsed.Confidence.Items)
+	assert.Equal(t, 0.8, parsed.Confidence.Total)
+
+	parsed = parseReceiptText("nothing useful here")
+	assert.Empty(t, parsed.Receipt.Items)
+	assert.Equal(t, receiptConfidence{Retailer: 0.9}, parsed.Confidence)
+}
+
+func TestFormatCents(t *testing.T) {
+	for cents, formatted := range map[int]string{0: "0.00", 5: "0.05", 1250: "12.50", -50: "-0.50", -150: "-1.50"} {
+		assert.Equal(t, formatted, formatCents(cents))
+	}
+}
+
+func TestV2ParseReceipt(t *testing.T) {
+	text, err := os.ReadFile("examples/text/mm-corner-market-example.txt")
+	assert.NoError(t, err)
+
+	parse := func(query string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v2/receipts/parse"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := parse("", string(text))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var parsed parsedReceipt
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &parsed))
+	assert.Equal(t, "M&M CORNER MARKET", parsed.Receipt.Retailer)
+	assert.Nil(t, parsed.Result)
+
+	w = parse("?submit=true", string(text))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &parsed))
+	if assert.NotNil(t, parsed.Result) {
+		assert.Equal(t, 109, *parsed.Result.Points)
+		assert.Equal(t, "/v2/receipts/"+parsed.Result.Id, w.Header().Get("Location"))
+	}
+
+	w = parse("?submit=true", "Shop\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_receipt")
+
+	// Oversized text is refused rather than cut short and stored
+	w = parse("?submit=true", string(text)+strings.Repeat(" ", maxReceiptTextBytes))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "too_large")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// The API contract, served as is and checked against the router
+//
+//go:embed api.yml
+var apiSpecYAML []byte
+
+var apiSpec *openapi3.T
+var apiSpecJSON []byte
+
+// Documented operations by gin method and path, e.g. "GET /receipts/:id/points"
+var specRoutes map[string]*routers.Route
+
+// Routes that serve the documentation UI rather than the API
+var undocumentedRoutes = map[string]bool{
+	"GET /docs/*filepath": true,
+}
+
+// Swagger UI's initializer, pointed at our spec instead of the petstore
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "/openapi.json",
+    dom_id: '#swagger-ui',
+    deepLinking: true,
+    presets: [
+      SwaggerUIBundle.presets.apis,
+      SwaggerUIStandalonePreset
+    ],
+    plugins: [
+      SwaggerUIBundle.plugins.DownloadUrl
+    ],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+var loadAPISpecOnce sync.Once
+
+// Parses the embedded spec once, it is part of the binary so any error is a bug
+func loadAPISpec() {
+	loadAPISpecOnce.Do(parseAPISpec)
+}
+
+func parseAPISpec() {
+	doc, err := openapi3.NewLoader().LoadFromData(apiSpecYAML)
+	if err != nil {
+		panic(fmt.Sprintf("api.yml: %v", err))
+	}
+
+	apiSpecJSON, err = doc.MarshalJSON()
+	if err != nil {
+		panic(fmt.Sprintf("api.yml: %v", err))
+	}
+	apiSpec = doc
+
+	specRoutes = map[string]*routers.Route{}
+	for path, item := range doc.Paths.Map() {
+		// OpenAPI {id} is gin's :id
+		ginPath := pathParamRegex.ReplaceAllString(path, ":$1")
+		for method, operation := range item.Operations() {
+			specRoutes[method+" "+ginPath] = &routers.Route{Spec: doc, Path: path, PathItem: item, Method: method, Operation: operation}
+		}
+	}
+}
+
+func setupDocs(router *gin.Engine) {
+	router.GET("/openapi.yml", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/yaml; charset=utf-8", apiSpecYAML)
+	})
+	router.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", apiSpecJSON)
+	})
+
+	// gin redirects /docs to /docs/
+	router.GET("/docs/*filepath", serveSwaggerUI)
+}
+
+func serveSwaggerUI(c *gin.Context) {
+	switch path := c.Param("filepath"); path {
+	case "/swagger-initializer.js":
+		c.Data(http.StatusOK, "text/javascript; charset=utf-8", []byte(swaggerInitializer))
+	default:
+		c.FileFromFS(path, http.FS(swaggerFiles.FS))
+	}
+}
+
+var pathParamRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// Checks that every operation in api.yml is registered and every registered route is in api.yml
+func verifyRoutes(routes gin.RoutesInfo) error {
+	documented := map[string]bool{}
+	for key := range specRoutes {
+		documented[key] = true
+	}
+
+	var problems []string
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		if !documented[key] && !undocumentedRoutes[key] {
+			problems = append(problems, key+" is not documented in api.yml")
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		problems = append(problems, key+" is documented in api.yml but not registered")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New(strings.Join(problems, "\n"))
+}
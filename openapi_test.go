@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecMatchesRoutes(t *testing.T) {
+	assert.NoError(t, apiSpec.Validate(context.Background()))
+	assert.NoError(t, verifyRoutes(router.Routes()))
+}
+
+func TestVerifyRoutesReportsDrift(t *testing.T) {
+	routes := append(router.Routes()[1:], router.Routes()[0])
+	assert.NoError(t, verifyRoutes(routes))
+
+	// Dropping a route leaves its operation unregistered
+	err := verifyRoutes(router.Routes()[1:])
+	assert.ErrorContains(t, err, "documented in api.yml but not registered")
+
+	// An extra route isn't documented
+	extra := append(router.Routes(), router.Routes()[0])
+	extra[len(extra)-1].Path = "/undocumented"
+	assert.ErrorContains(t, verifyRoutes(extra), "/undocumented is not documented in api.yml")
+}
+
+func TestServeSpec(t *testing.T) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.yml", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, apiSpecYAML, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var spec struct {
+		Paths map[string]any `json:"paths"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+	assert.Contains(t, spec.Paths, "/receipts/{id}/points")
+	assert.Contains(t, spec.Paths, "/v1/receipts/{id}/points")
+}
+
+func TestSwaggerUI(t *testing.T) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/docs/", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "swagger-ui-bundle.js")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs/swagger-initializer.js", nil))
+	assert.Contains(t, w.Body.String(), `url: "/openapi.json"`)
+}
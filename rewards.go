@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	orderPlaced    = "placed"
+	orderCancelled = "cancelled"
+)
+
+// A reward customers can order with points while it is in stock and within its validity window, either end of
+// which may be open
+type reward struct {
+	Id          string     `json:"id" xml:"id" yaml:"id"`
+	Name        string     `json:"name" xml:"name" yaml:"name"`
+	Description string     `json:"description,omitempty" xml:"description,omitempty" yaml:"description,omitempty"`
+	Cost        int        `json:"cost" xml:"cost" yaml:"cost"`
+	Stock       int        `json:"stock" xml:"stock" yaml:"stock"`
+	ValidFrom   *time.Time `json:"validFrom,omitempty" xml:"validFrom,omitempty" yaml:"validFrom,omitempty"`
+	ValidUntil  *time.Time `json:"validUntil,omitempty" xml:"validUntil,omitempty" yaml:"validUntil,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+}
+
+func (r reward) available(now time.Time) bool {
+	return r.Stock > 0 && (r.ValidFrom == nil || !now.Before(*r.ValidFrom)) && (r.ValidUntil == nil || now.Before(*r.ValidUntil))
+}
+
+// An order of a reward, paid for by a redemption entry and refunded by reversing it
+type rewardOrder struct {
+	Id            string     `json:"id" xml:"id" yaml:"id"`
+	CustomerId    string     `json:"customerId" xml:"customerId" yaml:"customerId"`
+	RewardId      string     `json:"rewardId" xml:"rewardId" yaml:"rewardId"`
+	Quantity      int        `json:"quantity" xml:"quantity" yaml:"quantity"`
+	Points        int        `json:"points" xml:"points" yaml:"points"`
+	Status        string     `json:"status" xml:"status" yaml:"status"`
+	EntryId       string     `json:"entryId" xml:"entryId" yaml:"entryId"`
+	RefundEntryId string     `json:"refundEntryId,omitempty" xml:"refundEntryId,omitempty" yaml:"refundEntryId,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+	CancelledAt   *time.Time `json:"cancelledAt,omitempty" xml:"cancelledAt,omitempty" yaml:"cancelledAt,omitempty"`
+}
+
+var (
+	errRewardNotFound    = errors.New("reward not found")
+	errRewardUnavailable = errors.New("reward is not available")
+	errOutOfStock        = errors.New("reward is out of stock")
+	errOrderNotFound     = errors.New("order not found")
+	errOrderCancelled    = errors.New("order has already been cancelled")
+)
+
+// Rewards and orders under one lock, so stock is reserved in the same step as the points are redeemed
+type rewardCatalog struct {
+	mu      sync.Mutex
+	rewards map[string]*reward
+	orders  map[string]*rewardOrder
+	ledger  *ledger
+}
+
+func newRewardCatalog(pointsLedger *ledger) *rewardCatalog {
+	return &rewardCatalog{rewards: map[string]*reward{}, orders: map[string]*rewardOrder{}, ledger: pointsLedger}
+}
+
+func (r *rewardCatalog) add(created reward) reward {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	created.Id = uuid.New().String()
+	created.CreatedAt = time.Now().UTC()
+	r.rewards[created.Id] = &created
+	return created
+}
+
+func (r *rewardCatalog) get(id string) (reward, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, ok := r.rewards[id]
+	if !ok {
+		return reward{}, false
+	}
+	return *found, true
+}
+
+// Applies the change to the reward, false if there is no such reward
+func (r *rewardCatalog) update(id string, change func(*reward)) (reward, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, ok := r.rewards[id]
+	if !ok {
+		return reward{}, false
+	}
+	change(found)
+	return *found, true
+}
+
+// Removes the reward from the catalog, orders for it are kept
+func (r *rewardCatalog) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.rewards[id]
+	delete(r.rewards, id)
+	return ok
+}
+
+// Rewards matching keep, oldest first
+func (r *rewardCatalog) list(keep func(reward) bool) []reward {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := []reward{}
+	for _, found := range r.rewards {
+		if keep(*found) {
+			list = append(list, *found)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Redeems the points for the order and reserves its stock, or does neither
+func (r *rewardCatalog) order(customerId string, rewardId string, quantity int) (rewardOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, ok := r.rewards[rewardId]
+	switch {
+	case !ok:
+		return rewardOrder{}, errRewardNotFound
+	case !found.available(time.Now()):
+		return rewardOrder{}, errRewardUnavailable
+	case found.Stock < quantity:
+		return rewardOrder{}, errOutOfStock
+	}
+
+	order := rewardOrder{
+		Id:         uuid.New().String(),
+		CustomerId: customerId,
+		RewardId:   rewardId,
+		Quantity:   quantity,
+		Points:     found.Cost * quantity,
+		Status:     orderPlaced,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	entry := customerEntry(entryRedemption, customerId, accountRedeemed, -order.Points)
+	entry.OrderId = order.Id
+	entry.Memo = fmt.Sprintf("%d x %s", quantity, found.Name)
+	posted, err := r.ledger.post(entry)
+	if err != nil {
+		return rewardOrder{}, err
+	}
+
+	order.EntryId = posted.Id
+	found.Stock -= quantity
+	r.orders[order.Id] = &order
+	return order, nil
+}
+
+// Refunds the order's points and puts its stock back, if the reward is still in the catalog
+func (r *rewardCatalog) cancel(customerId string, orderId string) (rewardOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[orderId]
+	switch {
+	case !ok || order.CustomerId != customerId:
+		return rewardOrder{}, errOrderNotFound
+	case order.Status == orderCancelled:
+		return rewardOrder{}, errOrderCancelled
+	}
+
+	refund, err := r.ledger.reverse(order.EntryId, "Order cancelled")
+	if err != nil {
+		return rewardOrder{}, err
+	}
+
+	now := time.Now().UTC()
+	order.Status = orderCancelled
+	order.RefundEntryId = refund.Id
+	order.CancelledAt = &now
+	if found, ok := r.rewards[order.RewardId]; ok {
+		found.Stock += order.Quantity
+	}
+	return *order, nil
+}
+
+// The customer's orders, newest first
+func (r *rewardCatalog) ordersFor(customerId string) []rewardOrder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	orders := []rewardOrder{}
+	for _, order := range r.orders {
+		if order.CustomerId == customerId {
+			orders = append(orders, *order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreatedAt.After(orders[j].CreatedAt) })
+	return orders
+}
+
+func (r *rewardCatalog) getOrder(customerId string, orderId string) (rewardOrder, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[orderId]
+	if !ok || order.CustomerId != customerId {
+		return rewardOrder{}, false
+	}
+	return *order, true
+}
+
+var (
+	invalidRewardV2  = apiErrorV2{Code: "invalid_request", Message: "The reward is invalid."}
+	rewardNotFoundV2 = apiErrorV2{Code: "reward_not_found", Message: "No reward found for that ID."}
+)
+
+func setupRewardsAdminAPI(group *gin.RouterGroup) {
+	admin := group.Group("/rewards", validateRequests(func(c *gin.Context, err error) {
+		respondErrorV2(c, http.StatusBadRequest, invalidRewardV2)
+	}))
+	admin.POST("", createReward)
+	admin.GET("", listRewards)
+	admin.GET("/:id", getReward)
+	admin.PATCH("/:id", updateReward)
+	admin.DELETE("/:id", deleteReward)
+}
+
+func setupRewardsAPI(group *gin.RouterGroup) {
+	group.GET("/customers/:id/rewards", listCustomerRewards)
+	group.POST("/customers/:id/orders", placeOrder)
+	group.GET("/customers/:id/orders", listOrders)
+	group.GET("/customers/:id/orders/:orderId", getOrder)
+	group.POST("/customers/:id/orders/:orderId/cancel", cancelOrder)
+}
+
+// Fields of a reward an admin can set, nil ones are left as they are when updating
+type rewardRequest struct {
+	Name        *string    `json:"name"`
+	Description *string    `json:"description"`
+	Cost        *int       `json:"cost"`
+	Stock       *int       `json:"stock"`
+	ValidFrom   *time.Time `json:"validFrom"`
+	ValidUntil  *time.Time `json:"validUntil"`
+}
+
+func (request rewardRequest) apply(r *reward) {
+	if request.Name != nil {
+		r.Name = *request.Name
+	}
+	if request.Description != nil {
+		r.Description = *request.Description
+	}
+	if request.Cost != nil {
+		r.Cost = *request.Cost
+	}
+	if request.Stock != nil {
+		r.Stock = *request.Stock
+	}
+	if request.ValidFrom != nil {
+		r.ValidFrom = request.ValidFrom
+	}
+	if request.ValidUntil != nil {
+		r.ValidUntil = request.ValidUntil
+	}
+}
+
+func createReward(c *gin.Context) {
+	var request rewardRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Name == nil || request.Cost == nil || request.Stock == nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidRewardV2)
+		return
+	}
+
+	var created reward
+	request.apply(&created)
+	respond(c, http.StatusCreated, tenantOf(c).rewards.add(created))
+}
+
+func listRewards(c *gin.Context) {
+	respond(c, http.StatusOK, tenantOf(c).rewards.list(func(reward) bool { return true }))
+}
+
+func getReward(c *gin.Context) {
+	found, ok := tenantOf(c).rewards.get(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, rewardNotFoundV2)
+		return
+	}
+
+	respond(c, http.StatusOK, found)
+}
+
+func updateReward(c *gin.Context) {
+	var request rewardRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidRewardV2)
+		return
+	}
+
+	updated, ok := tenantOf(c).rewards.update(c.Param("id"), request.apply)
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, rewardNotFoundV2)
+		return
+	}
+
+	respond(c, http.StatusOK, updated)
+}
+
+func deleteReward(c *gin.Context) {
+	if !tenantOf(c).rewards.remove(c.Param("id")) {
+		respondErrorV2(c, http.StatusNotFound, rewardNotFoundV2)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type customerReward struct {
+	reward
+	Affordable bool `json:"affordable" xml:"affordable" yaml:"affordable"`
+}
+
+// GET /v2/customers/{id}/rewards lists the rewards available now, only those the balance covers with ?affordable=true
+func listCustomerRewards(c *gin.Context) {
+	t := tenantOf(c)
+	found, ok := t.loadCustomer(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+
+	balance := t.ledger.balance(customerLedgerAccount(found.Id))
+	onlyAffordable := c.Query("affordable") == "true"
+	now := time.Now()
+
+	list := []customerReward{}
+	for _, available := range t.rewards.list(func(r reward) bool { return r.available(now) }) {
+		affordable := available.Cost <= balance
+		if affordable || !onlyAffordable {
+			list = append(list, customerReward{reward: available, Affordable: affordable})
+		}
+	}
+
+	respond(c, http.StatusOK, gin.H{"balance": balance, "rewards": list})
+}
+
+var orderNotFoundV2 = apiErrorV2{Code: "order_not_found", Message: "No order found for that ID."}
+
+func respondOrderError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errRewardNotFound):
+		respondErrorV2(c, http.StatusNotFound, rewardNotFoundV2)
+	case errors.Is(err, errRewardUnavailable):
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "reward_unavailable", Message: "The reward is not available."})
+	case errors.Is(err, errOutOfStock):
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "out_of_stock", Message: "Not enough of the reward is in stock."})
+	case errors.Is(err, errOrderNotFound):
+		respondErrorV2(c, http.StatusNotFound, orderNotFoundV2)
+	case errors.Is(err, errOrderCancelled):
+		respondErrorV2(c, http.StatusConflict, apiErrorV2{Code: "already_cancelled", Message: "The order has already been cancelled."})
+	default:
+		respondLedgerError(c, err)
+	}
+}
+
+// POST /v2/customers/{id}/orders redeems points for a reward
+func placeOrder(c *gin.Context) {
+	var request struct {
+		RewardId string `json:"rewardId" binding:"required"`
+		Quantity int    `json:"quantity"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.Quantity < 0 {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+		return
+	}
+	t := tenantOf(c)
+	if _, ok := t.loadCustomer(c.Param("id")); !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+
+	order, err := t.rewards.order(c.Param("id"), request.RewardId, max(request.Quantity, 1))
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	c.Header("Location", "/v2/customers/"+order.CustomerId+"/orders/"+order.Id)
+	respond(c, http.StatusCreated, order)
+}
+
+func listOrders(c *gin.Context) {
+	t := tenantOf(c)
+	if _, ok := t.loadCustomer(c.Param("id")); !ok {
+		respondErrorV2(c, http.StatusNotFound, customerNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"orders": t.rewards.ordersFor(c.Param("id"))})
+}
+
+func getOrder(c *gin.Context) {
+	order, ok := tenantOf(c).rewards.getOrder(c.Param("id"), c.Param("orderId"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, orderNotFoundV2)
+		return
+	}
+	respond(c, http.StatusOK, order)
+}
+
+// POST /v2/customers/{id}/orders/{orderId}/cancel refunds the order's points and returns its stock
+func cancelOrder(c *gin.Context) {
+	order, err := tenantOf(c).rewards.cancel(c.Param("id"), c.Param("orderId"))
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+	respond(c, http.StatusOK, order)
+}
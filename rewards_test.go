@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReward(t *testing.T, body string) reward {
+	w := sendAdmin(t, "POST", "/admin/rewards", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created reward
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	return created
+}
+
+// A new customer with the given balance
+func newFundedCustomer(t *testing.T, points int) string {
+	customerId := newTestCustomer(t)
+	_, err := defaultTenant().ledger.post(customerEntry(entryAdjustment, customerId, accountIssued, points))
+	assert.NoError(t, err)
+	return customerId
+}
+
+func TestRewardsAdmin(t *testing.T) {
+	created := newTestReward(t, `{"name": "Tote bag", "cost": 100, "stock": 5}`)
+	assert.Equal(t, "Tote bag", created.Name)
+	assert.NotEmpty(t, created.Id)
+
+	w := sendAdmin(t, "PATCH", "/admin/rewards/"+created.Id, `{"stock": 10, "validUntil": "2030-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var updated reward
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, 10, updated.Stock)
+	assert.Equal(t, 100, updated.Cost)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), *updated.ValidUntil)
+
+	for _, body := range []string{`{"name": "Free", "cost": 0, "stock": 1}`, `{"name": "No stock", "cost": 1}`, `{"cost": 1, "stock": 1}`} {
+		w = sendAdmin(t, "POST", "/admin/rewards", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		assert.Contains(t, w.Body.String(), "The reward is invalid.")
+	}
+
+	w = sendAdmin(t, "DELETE", "/admin/rewards/"+created.Id, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = sendAdmin(t, "GET", "/admin/rewards/"+created.Id, "", "Accept", "application/xml")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "<code>reward_not_found</code>")
+}
+
+func TestCustomerRewardsByBalance(t *testing.T) {
+	cheap := newTestReward(t, `{"name": "Sticker", "cost": 10, "stock": 1}`)
+	pricey := newTestReward(t, `{"name": "Hoodie", "cost": 1000000, "stock": 1}`)
+	expired := newTestReward(t, `{"name": "Calendar", "cost": 1, "stock": 1, "validUntil": "2020-01-01T00:00:00Z"}`)
+	soldOut := newTestReward(t, `{"name": "Mug", "cost": 1, "stock": 0}`)
+	customerId := newFundedCustomer(t, 50)
+
+	list := func(query string) map[string]bool {
+		w := sendJSON("GET", "/v2/customers/"+customerId+"/rewards"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var body struct {
+			Balance int
+			Rewards []customerReward
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, 50, body.Balance)
+
+		affordable := map[string]bool{}
+		for _, listed := range body.Rewards {
+			affordable[listed.Id] = listed.Affordable
+		}
+		return affordable
+	}
+
+	all := list("")
+	assert.Equal(t, true, all[cheap.Id])
+	assert.Contains(t, all, pricey.Id)
+	assert.Equal(t, false, all[pricey.Id])
+	assert.NotContains(t, all, expired.Id)
+	assert.NotContains(t, all, soldOut.Id)
+
+	affordable := list("?affordable=true")
+	assert.Contains(t, affordable, cheap.Id)
+	assert.NotContains(t, affordable, pricey.Id)
+}
+
+func TestRewardOrders(t *testing.T) {
+	mug := newTestReward(t, `{"name": "Mug", "cost": 40, "stock": 3}`)
+	customerId := newFundedCustomer(t, 100)
+	orders := "/v2/customers/" + customerId + "/orders"
+
+	w := sendJSON("POST", orders, `{"rewardId": "`+mug.Id+`", "quantity": 3}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "insufficient_balance")
+
+	w = sendJSON("POST", orders, `{"rewardId": "`+mug.Id+`", "quantity": 2}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var order rewardOrder
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+	assert.Equal(t, 80, order.Points)
+	assert.Equal(t, orderPlaced, order.Status)
+	assert.Equal(t, 20, customerBalance(t, customerId))
+	stocked, _ := defaultTenant().rewards.get(mug.Id)
+	assert.Equal(t, 1, stocked.Stock)
+
+	entry, ok := defaultTenant().ledger.entry(order.EntryId)
+	assert.True(t, ok)
+	assert.Equal(t, order.Id, entry.OrderId)
+
+	// Only cancelling refunds an order, so that its stock comes back
+	w = sendJSON("POST", "/v2/ledger/entries/"+order.EntryId+"/reversal", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "order_entry")
+	assert.Equal(t, 20, customerBalance(t, customerId))
+
+	w = sendJSON("POST", orders+"/"+order.Id+"/cancel", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+	assert.Equal(t, orderCancelled, order.Status)
+	assert.NotEmpty(t, order.RefundEntryId)
+	assert.Equal(t, 100, customerBalance(t, customerId))
+	stocked, _ = defaultTenant().rewards.get(mug.Id)
+	assert.Equal(t, 3, stocked.Stock)
+
+	w = sendJSON("POST", "/v2/ledger/entries/"+order.RefundEntryId+"/reversal", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = sendJSON("POST", orders+"/"+order.Id+"/cancel", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "already_cancelled")
+
+	// Orders belong to their customer
+	w = sendJSON("GET", "/v2/customers/"+newTestCustomer(t)+"/orders/"+order.Id, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = sendJSON("GET", orders, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), order.Id)
+
+	w = sendJSON("POST", orders, `{"rewardId": "missing"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRewardOrdersNeverOversell(t *testing.T) {
+	mug := newTestReward(t, `{"name": "Mug", "cost": 1, "stock": 3}`)
+	customerId := newFundedCustomer(t, 100)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 20)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = sendJSON("POST", "/v2/customers/"+customerId+"/orders", `{"rewardId": "`+mug.Id+`"}`).Code
+		}()
+	}
+	wg.Wait()
+
+	placed := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			placed++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 3, placed)
+	assert.Equal(t, 97, customerBalance(t, customerId))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the scoring rules used in points breakdowns
+const (
+	ruleRetailerName    = "retailer-name"
+	ruleRoundDollar     = "round-dollar"
+	ruleQuarterMultiple = "quarter-multiple"
+	ruleItemPairs       = "item-pairs"
+	ruleItemDescription = "item-description"
+	ruleOddDay          = "odd-day"
+	ruleAfternoon       = "afternoon"
+)
+
+// Points awarded to a receipt by a single rule
+type pointsAward struct {
+	Rule        string `json:"rule" xml:"rule" yaml:"rule"`
+	Points      int    `json:"points" xml:"points" yaml:"points"`
+	Description string `json:"description" xml:"description" yaml:"description"`
+}
+
+var errInvalidReceipt = errors.New("receipt is invalid")
+
+// Names the receipt field that failed validation, matches errInvalidReceipt with errors.Is
+type invalidFieldError struct {
+	Field string
+}
+
+func invalidField(field string) error {
+	return &invalidFieldError{Field: field}
+}
+
+func (e *invalidFieldError) Error() string {
+	return "receipt field " + e.Field + " is invalid"
+}
+
+func (e *invalidFieldError) Is(target error) bool {
+	return target == errInvalidReceipt
+}
+
+// Points each rule awards, tenants can tune them and zero turns a rule off
+type scoringRules struct {
+	RetailerCharacter      int `json:"retailerCharacter"`
+	RoundDollar            int `json:"roundDollar"`
+	QuarterMultiple        int `json:"quarterMultiple"`
+	ItemPair               int `json:"itemPair"`
+	ItemDescriptionPercent int `json:"itemDescriptionPercent"`
+	OddDay                 int `json:"oddDay"`
+	Afternoon              int `json:"afternoon"`
+}
+
+// The rules from the spec
+var defaultScoringRules = scoringRules{
+	RetailerCharacter:      1,
+	RoundDollar:            50,
+	QuarterMultiple:        25,
+	ItemPair:               5,
+	ItemDescriptionPercent: 20,
+	OddDay:                 6,
+	Afternoon:              10,
+}
+
+// Points awarded to a receipt and the rules that awarded them
+type Result struct {
+	Points    int           `json:"points"`
+	Breakdown []pointsAward `json:"breakdown"`
+}
+
+// Validates the receipt against the schema and returns the points it is awarded with a breakdown by rule, or the invalid field.
+// Nothing is stored or published, so it is safe to call from anywhere
+func Score(receipt Receipt) (Result, error) {
+	// Validate against the Receipt schema or Bad Request
+	if err := validateReceipt(receipt); err != nil {
+		return Result{}, err
+	}
+	return defaultScoringRules.score(receipt)
+}
+
+// Scores a receipt that has already been validated
+func (rules scoringRules) score(receipt Receipt) (Result, error) {
+	// Points awarded by each rule, summed for the total
+	var breakdown []pointsAward
+
+	// 1 point per alphanumeric char in retailer name
+	alphanumeric := 0
+	for _, char := range receipt.Retailer {
+		if isAlphanumeric(char) {
+			alphanumeric += 1
+		}
+	}
+	if alphanumeric > 0 && rules.RetailerCharacter > 0 {
+		breakdown = append(breakdown, pointsAward{Rule: ruleRetailerName, Points: alphanumeric * rules.RetailerCharacter,
+			Description: fmt.Sprintf("retailer name (%s) has %d alphanumeric characters", receipt.Retailer, alphanumeric)})
+	}
+
+	// Parse receipt total or Bad Request
+	receiptTotal, err := strconv.ParseFloat(receipt.Total, 64)
+	if err != nil {
+		return Result{}, invalidField("total")
+	}
+
+	// 50 points if total is a round dollar amount, 25 points if total is a 25 cent amount
+	if getChange(receiptTotal) == 0 {
+		// 50 points + 25 points because round dollar around and is a multiple of 0.25
+		if rules.RoundDollar > 0 {
+			breakdown = append(breakdown, pointsAward{Rule: ruleRoundDollar, Points: rules.RoundDollar, Description: "total is a round dollar amount"})
+		}
+		if rules.QuarterMultiple > 0 {
+			breakdown = append(breakdown, pointsAward{Rule: ruleQuarterMultiple, Points: rules.QuarterMultiple, Description: "total is a multiple of 0.25"})
+		}
+	} else if getChange(receiptTotal) == 25 && rules.QuarterMultiple > 0 {
+		breakdown = append(breakdown, pointsAward{Rule: ruleQuarterMultiple, Points: rules.QuarterMultiple, Description: "total is a multiple of 0.25"})
+	}
+
+	// 5 points for every two items
+	if pairs := len(receipt.Items) / 2; pairs > 0 && rules.ItemPair > 0 {
+		breakdown = append(breakdown, pointsAward{Rule: ruleItemPairs, Points: pairs * rules.ItemPair,
+			Description: fmt.Sprintf("%d items (%d pairs @ %d points each)", len(receipt.Items), pairs, rules.ItemPair)})
+	}
+
+	// If the trimmed length of the item description is a multiple of 3, multiply the price by `0.2` and round up to the nearest integer. The result is the number of points earned.
+	for i, item := range receipt.Items {
+
+		// Reduce nesting, continue if short description is not a multiple of 3
+		trimmed := strings.TrimSpace(item.ShortDescription)
+		if len(trimmed)%3 != 0 {
+			continue
+		}
+
+		// Parse item price or Bad Request
+		itemPrice, err := strconv.ParseFloat(item.Price, 64)
+		if err != nil {
+			return Result{}, invalidField(fmt.Sprintf("items[%d].price", i))
+		}
+
+		if rules.ItemDescriptionPercent == 0 {
+			continue
+		}
+
+		// Round up item price * 0.2, add to points
+		multiplier := float64(rules.ItemDescriptionPercent) / 100
+		roundUp := math.Ceil(itemPrice * multiplier)
+		breakdown = append(breakdown, pointsAward{Rule: ruleItemDescription, Points: int(roundUp),
+			Description: fmt.Sprintf("%q is %d characters (a multiple of 3), item price of %s * %s = %s, rounded up is %d points",
+				trimmed, len(trimmed), item.Price, strconv.FormatFloat(multiplier, 'f', -1, 64),
+				formatProduct(itemPrice*multiplier), int(roundUp))})
+	}
+
+	// Validate date on its own first so the bad field can be reported
+	if _, err := time.Parse("2006-01-02", receipt.PurcahseDate); err != nil {
+		return Result{}, invalidField("purchaseDate")
+	}
+
+	// Parse date and time as combined string with datetime
+	timeString := receipt.PurcahseDate + "T" + receipt.PurchaseTime
+	dateTime, err := time.Parse("2006-01-02T15:04", timeString)
+	if err != nil {
+		return Result{}, invalidField("purchaseTime")
+	}
+
+	// 6 points if the day in the purchase date is odd.
+	if dateTime.Day()%2 == 1 && rules.OddDay > 0 {
+		breakdown = append(breakdown, pointsAward{Rule: ruleOddDay, Points: rules.OddDay, Description: "purchase day is odd"})
+	}
+
+	// 10 points if the time of purchase is after 2:00pm and before 4:00pm.
+	// [2:01pm, 3:59pm], description as after 2pm & before 4pm, interprating as exclusive range
+	if dateTime.Hour() >= 14 && dateTime.Hour() < 16 && (dateTime.Hour() > 14 || dateTime.Minute() > 0) && rules.Afternoon > 0 {
+		breakdown = append(breakdown, pointsAward{Rule: ruleAfternoon, Points: rules.Afternoon,
+			Description: dateTime.Format("3:04pm") + " is between 2:00pm and 4:00pm"})
+	}
+
+	// Total receipt points
+	var points int = 0
+	for _, award := range breakdown {
+		points += award.Points
+	}
+
+	return Result{Points: points, Breakdown: breakdown}, nil
+}
+
+func isAlphanumeric(char rune) bool {
+	return char >= 'A' && char <= 'Z' || char >= 'a' && char <= 'z' || char >= '0' && char <= '9'
+}
+
+// For a dollar amounted represented as a float, returns the change in cents as an integer
+func getChange(dollars float64) int {
+	return int((dollars * 100)) % 100
+}
+
+// A price times a whole percent has at most four decimal places, shown without the float's representation error
+func formatProduct(product float64) string {
+	formatted := strings.TrimRight(strconv.FormatFloat(product, 'f', 4, 64), "0")
+	return strings.TrimSuffix(formatted, ".")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreWithoutServer(t *testing.T) {
+	result, err := Score(Receipt{
+		Retailer:     "Target",
+		PurcahseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 28, result.Points)
+	assert.Equal(t, []string{ruleRetailerName, ruleItemPairs, ruleItemDescription, ruleItemDescription, ruleOddDay}, rules(result.Breakdown))
+	assert.Contains(t, result.Breakdown[3].Description, "item price of 12.00 * 0.2 = 2.4, rounded up is 3 points")
+
+	_, err = Score(Receipt{Retailer: "Target"})
+	assert.ErrorIs(t, err, errInvalidReceipt)
+}
+
+func TestItemPriceRoundsUp(t *testing.T) {
+	// 15.00 * 0.2 is exactly 3 in floating point, 15.01 * 0.2 is 3.0020000000000002
+	result, err := Score(Receipt{
+		Retailer:     "A",
+		PurcahseDate: "2022-01-02",
+		PurchaseTime: "10:00",
+		Items:        []Item{{ShortDescription: "abc", Price: "15.00"}, {ShortDescription: "def", Price: "15.01"}},
+		Total:        "30.01",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Breakdown[2].Points)
+	assert.Equal(t, 4, result.Breakdown[3].Points)
+	assert.Contains(t, result.Breakdown[3].Description, "item price of 15.01 * 0.2 = 3.002, rounded up is 4 points")
+}
+
+func TestQuarterTotals(t *testing.T) {
+	// Only totals ending in .00 or .25 are a quarter multiple, as they always were
+	for total, points := range map[string]int{"1.00": 75, "1.25": 25, "1.50": 0, "1.75": 0} {
+		result, err := Score(Receipt{
+			Retailer:     "&",
+			PurcahseDate: "2022-01-02",
+			PurchaseTime: "10:00",
+			Items:        []Item{{ShortDescription: "ab", Price: total}},
+			Total:        total,
+		})
+		assert.NoError(t, err, total)
+		assert.Equal(t, points, result.Points, total)
+	}
+}
+
+func rules(breakdown []pointsAward) []string {
+	var names []string
+	for _, award := range breakdown {
+		names = append(names, award.Rule)
+	}
+	return names
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Width in points of histogram buckets unless ?bucket says otherwise
+const defaultHistogramBucket = 25
+
+// Retailers listed by /stats/retailers unless ?limit says otherwise
+const defaultTopRetailers = 10
+
+// Aggregates of the receipts purchased on one day
+type dayStats struct {
+	receipts  int
+	points    int
+	byPoints  map[int]int
+	retailers map[string]*retailerStats
+	rules     map[string]*ruleStats
+	hours     [24]int
+}
+
+type retailerStats struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// Fired counts every award, a rule can fire more than once per receipt
+type ruleStats struct {
+	Rule     string `json:"rule"`
+	Fired    int    `json:"fired"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// Every scored receipt aggregated by purchase date as it is stored, so queries only ever walk days and never the
+// receipts themselves. Deleting a receipt doesn't take it out, the stats are of what was scored
+type receiptStats struct {
+	mu   sync.RWMutex
+	days map[string]*dayStats
+}
+
+func newReceiptStats() *receiptStats {
+	return &receiptStats{days: map[string]*dayStats{}}
+}
+
+func (s *receiptStats) record(receipt Receipt, points int, breakdown []pointsAward) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day, ok := s.days[receipt.PurcahseDate]
+	if !ok {
+		day = &dayStats{byPoints: map[int]int{}, retailers: map[string]*retailerStats{}, rules: map[string]*ruleStats{}}
+		s.days[receipt.PurcahseDate] = day
+	}
+
+	day.receipts++
+	day.points += points
+	day.byPoints[points]++
+
+	retailer, ok := day.retailers[receipt.Retailer]
+	if !ok {
+		retailer = &retailerStats{Retailer: receipt.Retailer}
+		day.retailers[receipt.Retailer] = retailer
+	}
+	retailer.Receipts++
+	retailer.Points += points
+
+	fired := map[string]bool{}
+	for _, award := range breakdown {
+		rule, ok := day.rules[award.Rule]
+		if !ok {
+			rule = &ruleStats{Rule: award.Rule}
+			day.rules[award.Rule] = rule
+		}
+		rule.Fired++
+		rule.Points += award.Points
+		if !fired[award.Rule] {
+			fired[award.Rule] = true
+			rule.Receipts++
+		}
+	}
+
+	// Valid receipts always have an HH:MM purchase time
+	if hour, err := strconv.Atoi(strings.SplitN(receipt.PurchaseTime, ":", 2)[0]); err == nil && hour >= 0 && hour < 24 {
+		day.hours[hour]++
+	}
+}
+
+// Calls visit with every day from through to, either may be empty for no bound. Dates are YYYY-MM-DD so they
+// compare as strings
+func (s *receiptStats) each(from string, to string, visit func(date string, day *dayStats)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for date, day := range s.days {
+		if (from == "" || date >= from) && (to == "" || date <= to) {
+			visit(date, day)
+		}
+	}
+}
+
+type statsSummary struct {
+	Receipts      int     `json:"receipts"`
+	TotalPoints   int     `json:"totalPoints"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+func (s *receiptStats) summary(from string, to string) statsSummary {
+	var summary statsSummary
+	s.each(from, to, func(_ string, day *dayStats) {
+		summary.Receipts += day.receipts
+		summary.TotalPoints += day.points
+	})
+	if summary.Receipts > 0 {
+		summary.AveragePoints = math.Round(float64(summary.TotalPoints)/float64(summary.Receipts)*100) / 100
+	}
+	return summary
+}
+
+type histogramBucket struct {
+	Min      int `json:"min"`
+	Max      int `json:"max"`
+	Receipts int `json:"receipts"`
+}
+
+// Buckets of the given width that have receipts, lowest first. Empty ones are left out, so one very high score can't
+// make a narrow histogram huge
+func (s *receiptStats) histogram(from string, to string, width int) []histogramBucket {
+	counts := map[int]int{}
+	s.each(from, to, func(_ string, day *dayStats) {
+		for points, receipts := range day.byPoints {
+			counts[points/width] += receipts
+		}
+	})
+
+	buckets := make([]histogramBucket, 0, len(counts))
+	for i, receipts := range counts {
+		buckets = append(buckets, histogramBucket{Min: i * width, Max: i*width + width - 1, Receipts: receipts})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Min < buckets[j].Min })
+	return buckets
+}
+
+// Retailers with the most points, ties broken by name
+func (s *receiptStats) topRetailers(from string, to string, limit int) []retailerStats {
+	totals := map[string]*retailerStats{}
+	s.each(from, to, func(_ string, day *dayStats) {
+		for name, retailer := range day.retailers {
+			total, ok := totals[name]
+			if !ok {
+				total = &retailerStats{Retailer: name}
+				totals[name] = total
+			}
+			total.Receipts += retailer.Receipts
+			total.Points += retailer.Points
+		}
+	})
+
+	retailers := make([]retailerStats, 0, len(totals))
+	for _, total := range totals {
+		retailers = append(retailers, *total)
+	}
+	sort.Slice(retailers, func(i, j int) bool {
+		if retailers[i].Points != retailers[j].Points {
+			return retailers[i].Points > retailers[j].Points
+		}
+		return retailers[i].Retailer < retailers[j].Retailer
+	})
+	return retailers[:min(limit, len(retailers))]
+}
+
+// Rules by how often they fired, most first
+func (s *receiptStats) rules(from string, to string) []ruleStats {
+	totals := map[string]*ruleStats{}
+	s.each(from, to, func(_ string, day *dayStats) {
+		for name, rule := range day.rules {
+			total, ok := totals[name]
+			if !ok {
+				total = &ruleStats{Rule: name}
+				totals[name] = total
+			}
+			total.Fired += rule.Fired
+			total.Receipts += rule.Receipts
+			total.Points += rule.Points
+		}
+	})
+
+	rules := make([]ruleStats, 0, len(totals))
+	for _, total := range totals {
+		rules = append(rules, *total)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Fired != rules[j].Fired {
+			return rules[i].Fired > rules[j].Fired
+		}
+		return rules[i].Rule < rules[j].Rule
+	})
+	return rules
+}
+
+type dailyVolume struct {
+	Date     string `json:"date"`
+	Receipts int    `json:"receipts"`
+}
+
+type hourlyVolume struct {
+	Hour     int `json:"hour"`
+	Receipts int `json:"receipts"`
+}
+
+// Receipts per purchase date in order, and per hour of the day across the range
+func (s *receiptStats) volume(from string, to string) ([]dailyVolume, []hourlyVolume) {
+	daily := []dailyVolume{}
+	hourly := make([]hourlyVolume, 24)
+	for hour := range hourly {
+		hourly[hour].Hour = hour
+	}
+
+	s.each(from, to, func(date string, day *dayStats) {
+		daily = append(daily, dailyVolume{Date: date, Receipts: day.receipts})
+		for hour, receipts := range day.hours {
+			hourly[hour].Receipts += receipts
+		}
+	})
+	sort.Slice(daily, func(i, j int) bool { return daily[i].Date < daily[j].Date })
+	return daily, hourly
+}
+
+func setupStatsAPI(router *gin.Engine) {
+	stats := router.Group("/stats", validateRequests(invalidStatsQuery), statsRange)
+	stats.GET("", getStatsSummary)
+	stats.GET("/histogram", getStatsHistogram)
+	stats.GET("/retailers", getStatsRetailers)
+	stats.GET("/rules", getStatsRules)
+	stats.GET("/volume", getStatsVolume)
+}
+
+func invalidStatsQuery(c *gin.Context, err error) {
+	respond(c, http.StatusBadRequest, gin.H{"description": "The stats query is invalid."})
+}
+
+// Rejects ranges that end before they start, api.yml has already checked the dates themselves
+func statsRange(c *gin.Context) {
+	if from, to := c.Query("from"), c.Query("to"); from != "" && to != "" && from > to {
+		invalidStatsQuery(c, nil)
+		c.Abort()
+	}
+}
+
+func getStatsSummary(c *gin.Context) {
+	respond(c, http.StatusOK, tenantOf(c).stats.summary(c.Query("from"), c.Query("to")))
+}
+
+func getStatsHistogram(c *gin.Context) {
+	width := defaultHistogramBucket
+	if bucket := c.Query("bucket"); bucket != "" {
+		width, _ = strconv.Atoi(bucket)
+	}
+	respond(c, http.StatusOK, gin.H{"bucket": width, "buckets": tenantOf(c).stats.histogram(c.Query("from"), c.Query("to"), width)})
+}
+
+func getStatsRetailers(c *gin.Context) {
+	limit := defaultTopRetailers
+	if value := c.Query("limit"); value != "" {
+		limit, _ = strconv.Atoi(value)
+	}
+	respond(c, http.StatusOK, gin.H{"retailers": tenantOf(c).stats.topRetailers(c.Query("from"), c.Query("to"), limit)})
+}
+
+func getStatsRules(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{"rules": tenantOf(c).stats.rules(c.Query("from"), c.Query("to"))})
+}
+
+func getStatsVolume(c *gin.Context) {
+	daily, hourly := tenantOf(c).stats.volume(c.Query("from"), c.Query("to"))
+	respond(c, http.StatusOK, gin.H{"daily": daily, "hourly": hourly})
+}
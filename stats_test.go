@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiptStatsAggregates(t *testing.T) {
+	stats := newReceiptStats()
+	record := func(retailer string, date string, time string, total string) {
+		receipt := Receipt{Retailer: retailer, PurcahseDate: date, PurchaseTime: time, Total: total,
+			Items: []Item{{ShortDescription: "abc", Price: total}}}
+		result, err := Score(receipt)
+		assert.NoError(t, err)
+		stats.record(receipt, result.Points, result.Breakdown)
+	}
+
+	record("Target", "2022-01-01", "13:01", "1.00")    // 6 + 50 + 25 + 1 + 6 = 88
+	record("Target", "2022-01-02", "14:30", "1.25")    // 6 + 25 + 1 + 10 = 42
+	record("Walgreens", "2022-01-02", "08:13", "2.65") // 9 + 1 = 10
+	record("Target", "2022-02-01", "09:00", "3.10")    // 6 + 1 + 6 = 13
+
+	assert.Equal(t, statsSummary{Receipts: 4, TotalPoints: 153, AveragePoints: 38.25}, stats.summary("", ""))
+	assert.Equal(t, statsSummary{Receipts: 2, TotalPoints: 52, AveragePoints: 26}, stats.summary("2022-01-02", "2022-01-31"))
+	assert.Equal(t, statsSummary{}, stats.summary("2023-01-01", ""))
+
+	assert.Equal(t, []histogramBucket{
+		{Min: 0, Max: 49, Receipts: 3},
+		{Min: 50, Max: 99, Receipts: 1},
+	}, stats.histogram("", "", 50))
+	assert.Equal(t, []histogramBucket{
+		{Min: 10, Max: 19, Receipts: 2},
+		{Min: 40, Max: 49, Receipts: 1},
+		{Min: 80, Max: 89, Receipts: 1},
+	}, stats.histogram("", "", 10))
+
+	assert.Equal(t, []retailerStats{
+		{Retailer: "Target", Receipts: 3, Points: 143},
+		{Retailer: "Walgreens", Receipts: 1, Points: 10},
+	}, stats.topRetailers("", "", 10))
+	assert.Equal(t, []retailerStats{{Retailer: "Walgreens", Receipts: 1, Points: 10}}, stats.topRetailers("", "2022-01-31", 10)[1:])
+	assert.Len(t, stats.topRetailers("", "", 1), 1)
+
+	rules := stats.rules("", "")
+	assert.Equal(t, ruleStats{Rule: ruleItemDescription, Fired: 4, Receipts: 4, Points: 4}, rules[0])
+	assert.Equal(t, ruleStats{Rule: ruleRetailerName, Fired: 4, Receipts: 4, Points: 27}, rules[1])
+
+	daily, hourly := stats.volume("2022-01-01", "2022-01-31")
+	assert.Equal(t, []dailyVolume{{Date: "2022-01-01", Receipts: 1}, {Date: "2022-01-02", Receipts: 2}}, daily)
+	assert.Len(t, hourly, 24)
+	assert.Equal(t, hourlyVolume{Hour: 14, Receipts: 1}, hourly[14])
+	assert.Equal(t, hourlyVolume{Hour: 9, Receipts: 0}, hourly[9])
+}
+
+func TestStatsEndpoints(t *testing.T) {
+	// A date no other test uses keeps the range to these receipts
+	receipt := Receipt{Retailer: "Stats Shop", PurcahseDate: "1999-03-03", PurchaseTime: "15:00", Total: "2.00",
+		Items: []Item{{ShortDescription: "abc", Price: "2.00"}}}
+	for range 2 {
+		_, _, err := defaultTenant().processNewReceipt(receipt, "")
+		assert.NoError(t, err)
+	}
+
+	get := func(path string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var body map[string]any
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	code, body := get("/stats?from=1999-03-01&to=1999-03-31")
+	assert.Equal(t, http.StatusOK, code)
+	// 9 + 50 + 25 + 1 + 6 + 10
+	assert.Equal(t, map[string]any{"receipts": 2.0, "totalPoints": 202.0, "averagePoints": 101.0}, body)
+
+	code, body = get("/stats/retailers?from=1999-03-03&to=1999-03-03&limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{map[string]any{"retailer": "Stats Shop", "receipts": 2.0, "points": 202.0}}, body["retailers"])
+
+	code, body = get("/stats/volume?from=1999-03-03&to=1999-03-03")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{map[string]any{"date": "1999-03-03", "receipts": 2.0}}, body["daily"])
+
+	for _, path := range []string{"/stats/histogram?bucket=100&from=1999-03-03", "/stats/rules?from=1999-03-03"} {
+		code, _ = get(path)
+		assert.Equal(t, http.StatusOK, code, path)
+	}
+
+	for _, path := range []string{"/stats?from=1999-13-01", "/stats?from=1999-03-02&to=1999-03-01", "/stats/histogram?bucket=0"} {
+		code, body = get(path)
+		assert.Equal(t, http.StatusBadRequest, code, path)
+		assert.Equal(t, "The stats query is invalid.", body["description"], path)
+	}
+}
+
+func TestHistogramOfHighScore(t *testing.T) {
+	// Narrow buckets up to a huge score would take more memory than there is
+	stats := newReceiptStats()
+	stats.record(Receipt{Retailer: "Big Spender", PurcahseDate: "2022-01-01", PurchaseTime: "10:00", Total: "1.00"}, 10, nil)
+	stats.record(Receipt{Retailer: "Big Spender", PurcahseDate: "2022-01-01", PurchaseTime: "10:00", Total: "1.00"}, 1<<40, nil)
+
+	assert.Equal(t, []histogramBucket{
+		{Min: 10, Max: 10, Receipts: 1},
+		{Min: 1 << 40, Max: 1 << 40, Receipts: 1},
+	}, stats.histogram("", "", 1))
+}
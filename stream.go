@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Number of most recent events kept for clients resuming with Last-Event-ID
+const StreamReplaySize = 256
+
+// Events buffered per listener before it is considered too slow and disconnected
+const streamListenerBuffer = 64
+
+const streamHeartbeat = 15 * time.Second
+
+type feedEvent struct {
+	Sequence uint64 `json:"-"`
+	Id       string `json:"id"`
+	Retailer string `json:"retailer"`
+	Points   int    `json:"points"`
+}
+
+// Fan-out of scored receipts to stream listeners with a bounded replay buffer
+type feed struct {
+	mu        sync.Mutex
+	sequence  uint64
+	replay    []feedEvent
+	listeners map[chan feedEvent]struct{}
+}
+
+func newFeed() *feed {
+	return &feed{listeners: map[chan feedEvent]struct{}{}}
+}
+
+func (f *feed) publish(id string, retailer string, points int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sequence++
+	event := feedEvent{Sequence: f.sequence, Id: id, Retailer: retailer, Points: points}
+
+	f.replay = append(f.replay, event)
+	if len(f.replay) > StreamReplaySize {
+		f.replay = f.replay[len(f.replay)-StreamReplaySize:]
+	}
+
+	for listener := range f.listeners {
+		select {
+		case listener <- event:
+		default:
+			// Drop slow listeners rather than block scoring, they can resume with Last-Event-ID
+			delete(f.listeners, listener)
+			close(listener)
+		}
+	}
+}
+
+// Registers a listener, returning buffered events after lastSequence when resuming and a function to unregister
+func (f *feed) subscribe(lastSequence uint64, resume bool) ([]feedEvent, chan feedEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var missed []feedEvent
+	for _, event := range f.replay {
+		if resume && event.Sequence > lastSequence {
+			missed = append(missed, event)
+		}
+	}
+
+	listener := make(chan feedEvent, streamListenerBuffer)
+	f.listeners[listener] = struct{}{}
+
+	unsubscribe := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.listeners[listener]; ok {
+			delete(f.listeners, listener)
+			close(listener)
+		}
+	}
+
+	return missed, listener, unsubscribe
+}
+
+func (event feedEvent) sse() sse.Event {
+	return sse.Event{Event: "receipt", Id: strconv.FormatUint(event.Sequence, 10), Data: event}
+}
+
+func streamReceipts(c *gin.Context) {
+	// Missing or malformed Last-Event-ID starts from live events only
+	lastSequence, err := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+
+	missed, events, unsubscribe := tenantOf(c).feed.subscribe(lastSequence, err == nil)
+	defer unsubscribe()
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	for _, event := range missed {
+		c.Render(-1, event.sse())
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.Render(-1, event.sse())
+			return true
+		case <-heartbeat.C:
+			// Comment line keeps proxies from timing out idle connections
+			io.WriteString(w, ": heartbeat\n\n")
+			return true
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type streamedEvent struct {
+	id   string
+	data feedEvent
+}
+
+// Reads SSE frames from the response body onto a channel
+func readStream(res *http.Response) chan streamedEvent {
+	events := make(chan streamedEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		var event streamedEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id:"):
+				event.id = strings.TrimPrefix(line, "id:")
+			case strings.HasPrefix(line, "data:"):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event.data)
+			case line == "" && event.id != "":
+				events <- event
+				event = streamedEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func submitReceipt(t *testing.T, payload string) string {
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response postResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Id
+}
+
+func nextStreamedEvent(t *testing.T, events chan streamedEvent) streamedEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event streamed")
+		return streamedEvent{}
+	}
+}
+
+func TestStreamReceiptsLiveAndResume(t *testing.T) {
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/receipts/stream")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream;charset=utf-8", res.Header.Get("Content-Type"))
+	events := readStream(res)
+
+	firstId := submitReceipt(t, `{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-02",
+  "purchaseTime": "13:13",
+  "total": "1.25",
+  "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]
+}`)
+	first := nextStreamedEvent(t, events)
+	assert.Equal(t, firstId, first.data.Id)
+	assert.Equal(t, "Target", first.data.Retailer)
+	assert.Equal(t, 31, first.data.Points)
+
+	secondId := submitReceipt(t, `{
+  "retailer": "Walgreens",
+  "purchaseDate": "2022-01-02",
+  "purchaseTime": "08:13",
+  "total": "2.65",
+  "items": [
+    {"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+    {"shortDescription": "Dasani", "price": "1.40"}
+  ]
+}`)
+	assert.Equal(t, secondId, nextStreamedEvent(t, events).data.Id)
+
+	// Resuming after the first event replays the second from the buffer
+	req, _ := http.NewRequest("GET", server.URL+"/receipts/stream", nil)
+	req.Header.Set("Last-Event-ID", first.id)
+	resumed, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resumed.Body.Close()
+
+	replayed := nextStreamedEvent(t, readStream(resumed))
+	assert.Equal(t, secondId, replayed.data.Id)
+	assert.Equal(t, 15, replayed.data.Points)
+}
+
+func TestFeedReplayIsBounded(t *testing.T) {
+	f := newFeed()
+	for i := 0; i < StreamReplaySize+10; i++ {
+		f.publish("id", "retailer", i)
+	}
+
+	missed, _, unsubscribe := f.subscribe(0, true)
+	defer unsubscribe()
+
+	assert.Len(t, missed, StreamReplaySize)
+	assert.Equal(t, uint64(11), missed[0].Sequence)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Requests that don't name a tenant belong to the default one, which scores by the rules in the spec
+const defaultTenantId = "default"
+
+// Receipt fields a tenant can give its own pattern. The amounts, date and time are parsed when scoring and keep theirs
+var tenantPatternFields = []string{"retailer", "shortDescription"}
+
+// A tenant as configured in TENANTS_FILE, rules left out keep their default points
+type tenantConfig struct {
+	Id       string            `json:"id"`
+	Rules    json.RawMessage   `json:"rules"`
+	Patterns map[string]string `json:"patterns"`
+}
+
+// A brand the service is hosted for. Everything its requests store lives here, so no request can reach another
+// tenant's receipts, customers or points whatever IDs it tries
+type tenant struct {
+	id    string
+	rules scoringRules
+
+	// Receipt schema with the tenant's patterns, nil for the one in api.yml
+	receiptSchema *openapi3.Schema
+
+	receipts             sync.Map
+	idempotencyKeys      sync.Map
+	customers            sync.Map
+	ledger               *ledger
+	loyalty              *loyaltyProgram
+	groups               *groupDirectory
+	rewards              *rewardCatalog
+	stats                *receiptStats
+	feed                 *feed
+	webhookSubscriptions sync.Map
+	webhookDeadLetters   sync.Map
+
+	// Held to update a receipt only if it is still stored, and to delete one
+	receiptsMu sync.Mutex
+	// Serializes claims so a receipt can't be credited to two customers
+	claimMu sync.Mutex
+}
+
+func newTenant(id string, rules scoringRules, receiptSchema *openapi3.Schema) *tenant {
+	pointsLedger := newLedger()
+	groups := newGroupDirectory(pointsLedger)
+	return &tenant{
+		id:            id,
+		rules:         rules,
+		receiptSchema: receiptSchema,
+		ledger:        pointsLedger,
+		loyalty:       newLoyaltyProgram(pointsLedger, groups),
+		groups:        groups,
+		rewards:       newRewardCatalog(pointsLedger),
+		stats:         newReceiptStats(),
+		feed:          newFeed(),
+	}
+}
+
+// Validates the receipt against the tenant's patterns and scores it by the tenant's rules
+func (t *tenant) score(receipt Receipt) (Result, error) {
+	var err error
+	if t.receiptSchema != nil {
+		err = validateReceiptSchema(t.receiptSchema, receipt)
+	} else {
+		err = validateReceipt(receipt)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return t.rules.score(receipt)
+}
+
+type tenantRegistry struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+	policy  expirationPolicy
+}
+
+var tenants = &tenantRegistry{tenants: map[string]*tenant{defaultTenantId: newTenant(defaultTenantId, defaultScoringRules, nil)}}
+
+func (r *tenantRegistry) get(id string) (*tenant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	found, ok := r.tenants[id]
+	return found, ok
+}
+
+// Adds the tenant, replacing any with the same ID and everything stored for it
+func (r *tenantRegistry) add(added *tenant) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added.ledger.setPolicy(r.policy)
+	r.tenants[added.id] = added
+}
+
+func (r *tenantRegistry) each(do func(*tenant)) {
+	r.mu.RLock()
+	all := make([]*tenant, 0, len(r.tenants))
+	for _, found := range r.tenants {
+		all = append(all, found)
+	}
+	r.mu.RUnlock()
+
+	for _, found := range all {
+		do(found)
+	}
+}
+
+// Expires points by the policy in every tenant's ledger, including tenants added later
+func (r *tenantRegistry) setPolicy(policy expirationPolicy) {
+	r.mu.Lock()
+	r.policy = policy
+	r.mu.Unlock()
+
+	r.each(func(found *tenant) { found.ledger.setPolicy(policy) })
+}
+
+func defaultTenant() *tenant {
+	found, _ := tenants.get(defaultTenantId)
+	return found
+}
+
+// Adds the tenants configured in the file, a JSON array of tenant configs. Any mistake in it fails the whole file
+func loadTenants(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []tenantConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var loaded []*tenant
+	for _, config := range configs {
+		configured, err := newConfiguredTenant(config)
+		if err != nil {
+			return fmt.Errorf("%s: tenant %q: %w", path, config.Id, err)
+		}
+		loaded = append(loaded, configured)
+	}
+	for _, configured := range loaded {
+		tenants.add(configured)
+	}
+	return nil
+}
+
+func newConfiguredTenant(config tenantConfig) (*tenant, error) {
+	if config.Id == "" {
+		return nil, errors.New("id is required")
+	}
+
+	rules := defaultScoringRules
+	if len(config.Rules) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(config.Rules))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rules); err != nil {
+			return nil, fmt.Errorf("rules: %w", err)
+		}
+	}
+	if rules.RetailerCharacter < 0 || rules.RoundDollar < 0 || rules.QuarterMultiple < 0 || rules.ItemPair < 0 ||
+		rules.ItemDescriptionPercent < 0 || rules.OddDay < 0 || rules.Afternoon < 0 {
+		return nil, errors.New("rules: points can't be negative")
+	}
+
+	var schema *openapi3.Schema
+	if len(config.Patterns) > 0 {
+		var err error
+		if schema, err = receiptSchemaWithPatterns(config.Patterns); err != nil {
+			return nil, fmt.Errorf("patterns: %w", err)
+		}
+	}
+	return newTenant(config.Id, rules, schema), nil
+}
+
+// A copy of the Receipt schema in api.yml with the patterns of some fields replaced
+func receiptSchemaWithPatterns(patterns map[string]string) (*openapi3.Schema, error) {
+	loadAPISpec()
+
+	// Parsed again so changing it leaves the shared spec alone
+	doc, err := openapi3.NewLoader().LoadFromData(apiSpecYAML)
+	if err != nil {
+		return nil, err
+	}
+	receipt := doc.Components.Schemas["Receipt"].Value
+	fields := map[string]*openapi3.Schema{
+		"retailer":         receipt.Properties["retailer"].Value,
+		"shortDescription": receipt.Properties["items"].Value.Items.Value.Properties["shortDescription"].Value,
+	}
+
+	for field, pattern := range patterns {
+		schema, ok := fields[field]
+		if !ok {
+			return nil, fmt.Errorf("%s can't have its own pattern, only %s can", field, strings.Join(tenantPatternFields, " and "))
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		schema.Pattern = pattern
+	}
+	return receipt, nil
+}
+
+var (
+	unknownTenantV2 = apiErrorV2{Code: "unknown_tenant", Message: "No tenant found for that tenant ID."}
+	otherTenantV2   = apiErrorV2{Code: "forbidden", Message: "The credentials belong to another tenant."}
+)
+
+// Looks up the tenant of the request's API key or token, or named by the Tenant-Id header, for the handlers. Refuses
+// tenants that don't exist and tenants other than the key's or token's
+func selectTenant(c *gin.Context) {
+	id := c.GetHeader("Tenant-Id")
+	if key, ok := requestAPIKey(c); ok {
+		if id, ok = key.tenantFor(id); !ok {
+			abortWithError(c, http.StatusForbidden, otherTenantV2)
+			return
+		}
+	}
+	if caller, ok := requestToken(c); ok {
+		if id, ok = caller.tenantFor(id); !ok {
+			abortWithError(c, http.StatusForbidden, otherTenantV2)
+			return
+		}
+	}
+	if id == "" {
+		id = defaultTenantId
+	}
+
+	found, ok := tenants.get(id)
+	if !ok {
+		abortWithError(c, http.StatusBadRequest, unknownTenantV2)
+		return
+	}
+	c.Set(tenantContextKey, found)
+}
+
+const tenantContextKey = "tenant"
+
+// The tenant selectTenant found for the request
+func tenantOf(c *gin.Context) *tenant {
+	return c.MustGet(tenantContextKey).(*tenant)
+}
+
+type tenantKey struct{}
+
+// Carries the tenant to code that only gets a context, like GraphQL resolvers
+func withTenant(ctx context.Context, found *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, found)
+}
+
+func tenantFromContext(ctx context.Context) *tenant {
+	return ctx.Value(tenantKey{}).(*tenant)
+}
+
+// The tenant of a gRPC call's API key or token, or named by its tenant-id metadata, like selectTenant
+func grpcTenant(ctx context.Context) (*tenant, error) {
+	var id string
+	if values := metadata.ValueFromIncomingContext(ctx, "tenant-id"); len(values) > 0 {
+		id = values[0]
+	}
+	if key, ok := grpcAPIKey(ctx); ok {
+		if id, ok = key.tenantFor(id); !ok {
+			return nil, status.Error(codes.PermissionDenied, otherTenantV2.Message)
+		}
+	}
+	if caller, ok := tokenFromContext(ctx); ok {
+		if id, ok = caller.tenantFor(id); !ok {
+			return nil, status.Error(codes.PermissionDenied, otherTenantV2.Message)
+		}
+	}
+	if id == "" {
+		id = defaultTenantId
+	}
+
+	found, ok := tenants.get(id)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, unknownTenantV2.Message)
+	}
+	return found, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	receiptsv1 "receipt-processor-api/proto/receipts/v1"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Adds a tenant configured like TENANTS_FILE would, with a unique ID
+func newTestTenant(t *testing.T, config string) *tenant {
+	var parsed tenantConfig
+	assert.NoError(t, json.Unmarshal([]byte(config), &parsed))
+	parsed.Id = t.Name()
+
+	configured, err := newConfiguredTenant(parsed)
+	assert.NoError(t, err)
+	tenants.add(configured)
+	return configured
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	other := newTestTenant(t, `{}`)
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var submitted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &submitted))
+
+	// The ID is no use to any other tenant
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("GET", "/receipts/"+submitted.Id+"/points", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("DELETE", "/v2/receipts/"+submitted.Id, "", "Tenant-Id", defaultTenantId)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("GET", "/v2/receipts/"+submitted.Id, "", "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Nor are customers shared
+	customerId := newTestCustomer(t)
+	w = sendJSON("GET", "/v2/customers/"+customerId, "", "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON("POST", "/v2/receipts/"+submitted.Id+"/claim", `{"customerId": "`+customerId+`"}`, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown_customer")
+
+	w = sendJSON("POST", "/graphql", `{"query": "{ receipt(id: \"`+submitted.Id+`\") { id } }"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data": {"receipt": null}}`, w.Body.String())
+}
+
+func TestTenantRules(t *testing.T) {
+	other := newTestTenant(t, `{"rules": {"retailerCharacter": 2, "quarterMultiple": 0}}`)
+
+	w := sendJSON("POST", "/v2/receipts/score", simpleReceiptPayload, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var score scoreV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &score))
+	assert.Equal(t, 12, score.Points)
+	assert.Equal(t, []pointsAward{{Rule: ruleRetailerName, Points: 12, Description: "retailer name (Target) has 6 alphanumeric characters"}}, score.Breakdown)
+
+	w = sendJSON("POST", "/v2/receipts/score", simpleReceiptPayload)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &score))
+	assert.Equal(t, 31, score.Points)
+}
+
+func TestTenantPatterns(t *testing.T) {
+	other := newTestTenant(t, `{"patterns": {"retailer": "^Corner Store .+$"}}`)
+
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, apiErrorV2{Code: "invalid_receipt", Message: "The receipt is invalid.", Field: "retailer"}, body.Error)
+
+	cornerStore := `{"retailer": "Corner Store #12", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25",
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]}`
+	w = sendJSON("POST", "/v2/receipts/process", cornerStore, "Tenant-Id", other.id)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// Other tenants keep the patterns in api.yml
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = sendJSON("POST", "/v2/receipts/process", cornerStore)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUnknownTenant(t *testing.T) {
+	w := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Tenant-Id", "missing")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "unknown_tenant", body.Error.Code)
+
+	w = sendJSON("POST", "/receipts/process", simpleReceiptPayload, "Tenant-Id", "missing")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"description": "No tenant found for that tenant ID."}`, w.Body.String())
+
+	client := newGrpcClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant-id", "missing")
+	_, err := client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: "missing"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGrpcTenant(t *testing.T) {
+	other := newTestTenant(t, `{}`)
+	client := newGrpcClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant-id", other.id)
+
+	processed, err := client.ProcessReceipt(ctx, &receiptsv1.ProcessReceiptRequest{Receipt: &receiptsv1.Receipt{
+		Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "13:13", Total: "1.25",
+		Items: []*receiptsv1.Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+	}})
+	assert.NoError(t, err)
+
+	_, err = client.GetPoints(context.Background(), &receiptsv1.GetPointsRequest{Id: processed.GetId()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	points, err := client.GetPoints(ctx, &receiptsv1.GetPointsRequest{Id: processed.GetId()})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(31), points.GetPoints())
+}
+
+func TestLoadTenants(t *testing.T) {
+	for name, config := range map[string]string{
+		"not json":        `{`,
+		"missing id":      `[{"rules": {"oddDay": 1}}]`,
+		"unknown rule":    `[{"id": "a", "rules": {"evenDay": 1}}]`,
+		"negative points": `[{"id": "a", "rules": {"oddDay": -1}}]`,
+		"unknown field":   `[{"id": "a", "patterns": {"total": "^.*$"}}]`,
+		"bad pattern":     `[{"id": "a", "patterns": {"retailer": "("}}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "tenants.json")
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+		assert.Error(t, loadTenants(path), name)
+	}
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"id": "`+t.Name()+`", "rules": {"oddDay": 7}}]`), 0o600))
+	assert.NoError(t, loadTenants(path))
+	loaded, ok := tenants.get(t.Name())
+	assert.True(t, ok)
+	assert.Equal(t, 7, loaded.rules.OddDay)
+	assert.Equal(t, defaultScoringRules.RetailerCharacter, loaded.rules.RetailerCharacter)
+
+	assert.NoError(t, loadTenants(""))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const receiptSchemaRef = "#/components/schemas/Receipt"
+
+// Largest bodies accepted by routes that take files rather than a receipt, larger ones answer 413
+var requestBodyLimits = map[string]int64{
+	"POST /v2/receipts/import": maxImportBytes,
+	"POST /v2/receipts/parse":  maxReceiptTextBytes,
+}
+
+var requestTooLargeV2 = apiErrorV2{Code: "too_large", Message: "The request body is too large."}
+
+// Caps the bodies of routes in requestBodyLimits before validation or the handler reads them
+func limitRequestBodies(c *gin.Context) {
+	if limit, ok := requestBodyLimits[c.Request.Method+" "+c.FullPath()]; ok {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+}
+
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+func invalidPathParameter(err error) bool {
+	var requestErr *openapi3filter.RequestError
+	return errors.As(err, &requestErr) && requestErr.Parameter != nil && requestErr.Parameter.In == openapi3.ParameterInPath
+}
+
+// Validates requests against their operation in api.yml, calling invalid to answer those that don't match.
+// Receipt bodies are left to Score, which checks them against the same schema in whatever format they were sent
+func validateRequests(invalid func(c *gin.Context, err error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := specRoutes[c.Request.Method+" "+c.FullPath()]
+		if route == nil {
+			return
+		}
+
+		err := openapi3filter.ValidateRequest(c.Request.Context(), requestValidationInput(c, route))
+		if bodyTooLarge(err) {
+			abortWithError(c, http.StatusRequestEntityTooLarge, requestTooLargeV2)
+			return
+		}
+		if err != nil {
+			invalid(c, err)
+			c.Abort()
+		}
+	}
+}
+
+func requestValidationInput(c *gin.Context, route *routers.Route) *openapi3filter.RequestValidationInput {
+	pathParams := map[string]string{}
+	for _, param := range c.Params {
+		pathParams[param.Key] = param.Value
+	}
+
+	return &openapi3filter.RequestValidationInput{
+		Request:    c.Request,
+		PathParams: pathParams,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			ExcludeRequestBody: takesReceipt(route.Operation),
+			// authenticate has checked the key before any request gets here
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		},
+	}
+}
+
+func takesReceipt(operation *openapi3.Operation) bool {
+	if operation.RequestBody == nil || operation.RequestBody.Value == nil {
+		return false
+	}
+	media := operation.RequestBody.Value.Content.Get(gin.MIMEJSON)
+	return media != nil && media.Schema != nil && media.Schema.Ref == receiptSchemaRef
+}
+
+// Checks JSON responses against api.yml in debug mode, logging any that don't match.
+// Other negotiated formats and event streams are not documented and go unchecked
+func validateResponses(c *gin.Context) {
+	route := specRoutes[c.Request.Method+" "+c.FullPath()]
+	if route == nil || !gin.IsDebugging() {
+		return
+	}
+
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+
+	// Every route refuses requests without a valid key or tenant the same way, as the description in api.yml says
+	if c.GetBool(refusedContextKey) {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(writer.Header().Get("Content-Type"))
+	if !writer.Written() || (writer.Size() > 0 && mediaType != gin.MIMEJSON) {
+		return
+	}
+
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: requestValidationInput(c, route),
+		Status:                 writer.Status(),
+		Header:                 writer.Header(),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	}
+	input.SetBodyBytes(writer.body.Bytes())
+
+	if err := openapi3filter.ValidateResponse(c.Request.Context(), input); err != nil {
+		log.Printf("!!! RESPONSE DOES NOT MATCH api.yml: %s %s answered %d: %v", c.Request.Method, c.Request.URL.Path, writer.Status(), err)
+	}
+}
+
+// Keeps a copy of the response body for validation, except for event streams which never end
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if !w.streaming() {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(data string) (int, error) {
+	if !w.streaming() {
+		w.body.WriteString(data)
+	}
+	return w.ResponseWriter.WriteString(data)
+}
+
+func (w *recordingWriter) streaming() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), sse.ContentType)
+}
+
+// Validates the receipt against the Receipt schema in api.yml, naming the first field that doesn't match
+func validateReceipt(receipt Receipt) error {
+	// Scoring doesn't need the server, so the spec may not be loaded yet
+	loadAPISpec()
+	return validateReceiptSchema(apiSpec.Components.Schemas["Receipt"].Value, receipt)
+}
+
+// Validates the receipt against a Receipt schema, which tenants may have changed the patterns of
+func validateReceiptSchema(schema *openapi3.Schema, receipt Receipt) error {
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	err = schema.VisitJSON(value)
+
+	var schemaError *openapi3.SchemaError
+	if errors.As(err, &schemaError) {
+		return invalidField(fieldPath(schemaError.JSONPointer()))
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidReceipt, err)
+	}
+	return nil
+}
+
+// Formats a JSON pointer into the receipt like ["items", "1", "price"] as items[1].price
+func fieldPath(pointer []string) string {
+	var path strings.Builder
+	for _, segment := range pointer {
+		if _, err := strconv.Atoi(segment); err == nil {
+			path.WriteString("[" + segment + "]")
+			continue
+		}
+		if path.Len() > 0 {
+			path.WriteString(".")
+		}
+		path.WriteString(segment)
+	}
+	return path.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateReceiptNamesField(t *testing.T) {
+	receipt := Receipt{
+		Retailer:     "Target",
+		PurcahseDate: "2022-01-02",
+		PurchaseTime: "13:13",
+		Items:        []Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}, {ShortDescription: "Dasani!", Price: "1.40"}},
+		Total:        "2.65",
+	}
+
+	var fieldError *invalidFieldError
+	err := validateReceipt(receipt)
+	assert.ErrorAs(t, err, &fieldError)
+	assert.Equal(t, "items[1].shortDescription", fieldError.Field)
+	assert.True(t, errors.Is(err, errInvalidReceipt))
+
+	receipt.Items[1].ShortDescription = "Dasani"
+	assert.NoError(t, validateReceipt(receipt))
+
+	receipt.Items = nil
+	assert.ErrorAs(t, validateReceipt(receipt), &fieldError)
+	assert.Equal(t, "items", fieldError.Field)
+}
+
+func TestInvalidRequestParameters(t *testing.T) {
+	// Receipt IDs can't contain whitespace, though v1 only ever answers that no receipt has the ID
+	for _, path := range []string{"/v1/receipts/a%20b/points", "/receipts/a%20b/points"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+		assert.JSONEq(t, `{"description": "No receipt found for that ID."}`, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/receipts/a%20b", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/receipts/a%20b", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "invalid_request", response.Error.Code)
+
+	// Subscriptions are checked against their schema before the handler binds them
+	w = sendAdmin(t, "POST", "/admin/webhooks", `{"url": "https://example.com", "events": ["receipt.lost"], "secret": "s"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestResponseMismatchIsLogged(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	engine := gin.New()
+	engine.Use(validateResponses)
+	engine.GET("/receipts/:id/points", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"points": "many"})
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/abc/points", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, logs.String(), "RESPONSE DOES NOT MATCH api.yml: GET /receipts/abc/points answered 200")
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// When the unversioned paths were deprecated and when they stop being served
+var unversionedDeprecation = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+var unversionedSunset = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+
+func setupV1(group *gin.RouterGroup) {
+	group.Use(validateRequests(func(c *gin.Context, err error) {
+		// The spec only answers 404 for receipt IDs, whatever they look like
+		if invalidPathParameter(err) {
+			respond(c, http.StatusNotFound, gin.H{"description": "No receipt found for that ID."})
+			return
+		}
+		respond(c, http.StatusBadRequest, gin.H{"description": "The request is invalid."})
+	}))
+	group.POST("/receipts/process", processReceipt)
+	group.GET("/receipts/:id/points", getReceiptPoints)
+	group.GET("/receipts/stream", streamReceipts)
+	group.DELETE("/receipts/:id", deleteReceipt)
+}
+
+func setupV2(group *gin.RouterGroup) {
+	group.Use(validateRequests(func(c *gin.Context, err error) {
+		respondErrorV2(c, http.StatusBadRequest, apiErrorV2{Code: "invalid_request", Message: "The request is invalid."})
+	}))
+	group.POST("/receipts/process", processReceiptV2)
+	group.POST("/receipts/score", scoreReceiptV2)
+	group.POST("/receipts/import", importReceiptsV2)
+	group.POST("/receipts/parse", parseReceiptV2)
+	group.GET("/receipts/:id", getReceiptV2)
+	group.GET("/receipts/:id/points", getReceiptPointsV2)
+	group.DELETE("/receipts/:id", deleteReceiptV2)
+	setupCustomerAPI(group)
+}
+
+// Marks responses with Deprecation (RFC 9745) and Sunset (RFC 8594) headers and links the versioned successor
+func deprecatedAlias(successorPrefix string) gin.HandlerFunc {
+	deprecation := "@" + strconv.FormatInt(unversionedDeprecation.Unix(), 10)
+	sunset := unversionedSunset.Format(http.TimeFormat)
+
+	return func(c *gin.Context) {
+		c.Header("Deprecation", deprecation)
+		c.Header("Sunset", sunset)
+		c.Header("Link", "<"+successorPrefix+c.Request.URL.Path+">; rel=\"successor-version\"")
+		c.Next()
+	}
+}
+
+// v2 representation of a stored receipt
+type receiptV2 struct {
+	XMLName     xml.Name      `json:"-" xml:"receipt" yaml:"-"`
+	Id          string        `json:"id" xml:"id" yaml:"id"`
+	Status      receiptStatus `json:"status" xml:"status" yaml:"status"`
+	Points      *int          `json:"points,omitempty" xml:"points,omitempty" yaml:"points,omitempty"`
+	Breakdown   []pointsAward `json:"breakdown,omitempty" xml:"breakdown>award,omitempty" yaml:"breakdown,omitempty"`
+	Error       *apiErrorV2   `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+	Receipt     *Receipt      `json:"receipt,omitempty" xml:"receipt,omitempty" yaml:"receipt,omitempty"`
+	SubmittedAt time.Time     `json:"submittedAt" xml:"submittedAt" yaml:"submittedAt"`
+	CustomerId  string        `json:"customerId,omitempty" xml:"customerId,omitempty" yaml:"customerId,omitempty"`
+}
+
+// Points and breakdown for a receipt scored without storing it
+type scoreV2 struct {
+	XMLName   xml.Name      `json:"-" xml:"score" yaml:"-"`
+	Points    int           `json:"points" xml:"points" yaml:"points"`
+	Breakdown []pointsAward `json:"breakdown" xml:"breakdown>award" yaml:"breakdown"`
+}
+
+type apiErrorV2 struct {
+	Code    string `json:"code" xml:"code" yaml:"code"`
+	Message string `json:"message" xml:"message" yaml:"message"`
+	Field   string `json:"field,omitempty" xml:"field,omitempty" yaml:"field,omitempty"`
+}
+
+func newReceiptV2(id string, stored storedReceipt, withReceipt bool) receiptV2 {
+	representation := receiptV2{Id: id, Status: stored.Status, SubmittedAt: stored.SubmittedAt, CustomerId: stored.CustomerId}
+	if stored.Status == statusDone {
+		points := stored.Points
+		representation.Points = &points
+		representation.Breakdown = stored.Breakdown
+	}
+	if stored.Status == statusFailed {
+		apiError := invalidReceiptV2(stored.Err)
+		if errors.Is(stored.Err, errCreditFailed) {
+			apiError = creditFailedV2
+		}
+		representation.Error = &apiError
+	}
+	if withReceipt {
+		receipt := stored.Receipt
+		representation.Receipt = &receipt
+	}
+	return representation
+}
+
+func respondErrorV2(c *gin.Context, code int, apiError apiErrorV2) {
+	respond(c, code, gin.H{"error": apiError})
+}
+
+const refusedContextKey = "refused"
+
+// Refuses a request before it reaches its handler, in the error format of its API version. The admin APIs share v2's
+func abortWithError(c *gin.Context, code int, apiError apiErrorV2) {
+	c.Set(refusedContextKey, true)
+	if strings.HasPrefix(c.Request.URL.Path, "/v2/") || strings.HasPrefix(c.Request.URL.Path, "/admin/") {
+		respondErrorV2(c, code, apiError)
+	} else {
+		respond(c, code, gin.H{"description": apiError.Message})
+	}
+	c.Abort()
+}
+
+// Structured error for a receipt that failed validation, naming the field when known
+func invalidReceiptV2(err error) apiErrorV2 {
+	apiError := apiErrorV2{Code: "invalid_receipt", Message: "The receipt is invalid."}
+
+	var fieldError *invalidFieldError
+	if errors.As(err, &fieldError) {
+		apiError.Field = fieldError.Field
+	}
+	return apiError
+}
+
+// Names the format the body was decoded as, which isn't always JSON
+func malformedReceiptV2(c *gin.Context) apiErrorV2 {
+	return apiErrorV2{Code: "malformed_receipt", Message: "The receipt is not valid " + receiptFormatName(c) + "."}
+}
+
+var receiptNotFoundV2 = apiErrorV2{Code: "receipt_not_found", Message: "No receipt found for that ID."}
+
+var creditFailedV2 = apiErrorV2{Code: "credit_failed", Message: "The receipt's points could not be credited."}
+
+func processReceiptV2(c *gin.Context) {
+	var newReceipt Receipt
+
+	if err := bindReceipt(c, &newReceipt); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, malformedReceiptV2(c))
+		return
+	}
+
+	// A retried submission gets the receipt created by the first attempt. The key is reserved before processing, so
+	// concurrent retries can't both store and credit the receipt. Reusing the key for a different receipt, or for one
+	// the caller can't see, is a mistake rather than a retry
+	t := tenantOf(c)
+	idempotencyKey := requestIdempotencyKey(c)
+	hash := receiptHash(newReceipt)
+	submission, stored, reserved := t.reserveIdempotencyKey(idempotencyKey, hash, time.Now())
+	if !reserved {
+		switch {
+		case submission.receiptId == "":
+			respondErrorV2(c, http.StatusConflict, idempotencyKeyInUseV2)
+		case submission.receiptHash != hash:
+			respondErrorV2(c, http.StatusUnprocessableEntity, idempotencyKeyReusedV2)
+		case !canSeeReceipt(c, stored):
+			respondErrorV2(c, http.StatusUnprocessableEntity, idempotencyKeyUnavailableV2)
+		default:
+			code := http.StatusCreated
+			if stored.Async {
+				code = http.StatusAccepted
+			}
+			c.Header("Location", "/v2/receipts/"+submission.receiptId)
+			respond(c, code, newReceiptV2(submission.receiptId, stored, true))
+		}
+		return
+	}
+
+	// The receipt's points go to the customer, if it names one
+	customerId := requestCustomerId(c)
+	if !t.knownCustomer(customerId) {
+		t.releaseIdempotencyKey(idempotencyKey, submission)
+		respondErrorV2(c, http.StatusBadRequest, unknownCustomerV2)
+		return
+	}
+
+	if prefersAsync(c.GetHeader("Prefer")) {
+		receiptGuid := uuid.New().String()
+		pending, ok := t.enqueueReceipt(receiptGuid, newReceipt, customerId)
+		if !ok {
+			t.releaseIdempotencyKey(idempotencyKey, submission)
+			respondErrorV2(c, http.StatusServiceUnavailable, apiErrorV2{Code: "busy", Message: "The server is too busy to accept the receipt."})
+			return
+		}
+		t.rememberIdempotencyKey(idempotencyKey, receiptGuid, hash, time.Now())
+
+		c.Header("Preference-Applied", "respond-async")
+		c.Header("Location", "/v2/receipts/"+receiptGuid)
+		respond(c, http.StatusAccepted, newReceiptV2(receiptGuid, pending, true))
+		return
+	}
+
+	receiptGuid, stored, err := t.processNewReceipt(newReceipt, customerId)
+	if err != nil {
+		t.releaseIdempotencyKey(idempotencyKey, submission)
+	}
+	if errors.Is(err, errCreditFailed) {
+		respondErrorV2(c, http.StatusInternalServerError, creditFailedV2)
+		return
+	}
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidReceiptV2(err))
+		return
+	}
+	t.rememberIdempotencyKey(idempotencyKey, receiptGuid, hash, time.Now())
+
+	c.Header("Location", "/v2/receipts/"+receiptGuid)
+	respond(c, http.StatusCreated, newReceiptV2(receiptGuid, stored, true))
+}
+
+// Scores the receipt like processReceiptV2 without storing it or notifying anyone
+func scoreReceiptV2(c *gin.Context) {
+	var newReceipt Receipt
+
+	if err := bindReceipt(c, &newReceipt); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, malformedReceiptV2(c))
+		return
+	}
+
+	result, err := tenantOf(c).score(newReceipt)
+	if err != nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidReceiptV2(err))
+		return
+	}
+
+	respond(c, http.StatusOK, scoreV2{Points: result.Points, Breakdown: result.Breakdown})
+}
+
+// How long a retry can reuse an Idempotency-Key
+const idempotencyKeyTTL = 24 * time.Hour
+
+var idempotencyKeyReusedV2 = apiErrorV2{Code: "idempotency_key_reused", Message: "The Idempotency-Key was already used for a different receipt."}
+
+var idempotencyKeyUnavailableV2 = apiErrorV2{Code: "idempotency_key_reused", Message: "The Idempotency-Key was already used for a receipt you can't see."}
+
+var idempotencyKeyInUseV2 = apiErrorV2{Code: "idempotency_key_in_use", Message: "A request with the Idempotency-Key is still being processed."}
+
+// An Idempotency-Key is the caller's own: their API key's, or their customer's when signed in with a token or naming
+// one in Customer-Id, so callers can't replay each other's receipts by guessing keys
+type idempotencyKey struct {
+	apiKeyId   string
+	customerId string
+	key        string
+}
+
+func requestIdempotencyKey(c *gin.Context) idempotencyKey {
+	scoped := idempotencyKey{customerId: requestCustomerId(c), key: c.GetHeader("Idempotency-Key")}
+	if key, ok := requestAPIKey(c); ok {
+		scoped.apiKeyId = key.Id
+	}
+	return scoped
+}
+
+// A receipt remembered under its Idempotency-Key, with the hash of what was submitted to tell retries from reuse. The
+// receipt ID is empty while the submission that reserved the key is still being processed
+type idempotentSubmission struct {
+	receiptId   string
+	receiptHash [sha256.Size]byte
+	expiresAt   time.Time
+}
+
+// Hashes the receipt as decoded, so a retry matches whatever format it was sent in
+func receiptHash(receipt Receipt) [sha256.Size]byte {
+	data, _ := json.Marshal(receipt)
+	return sha256.Sum256(data)
+}
+
+// The submission previously made with the key and its receipt, if the key hasn't expired and the receipt is still
+// stored
+func (t *tenant) idempotentReceipt(key idempotencyKey, now time.Time) (idempotentSubmission, storedReceipt, bool) {
+	if key.key == "" {
+		return idempotentSubmission{}, storedReceipt{}, false
+	}
+	value, ok := t.idempotencyKeys.Load(key)
+	if !ok {
+		return idempotentSubmission{}, storedReceipt{}, false
+	}
+	return t.liveSubmission(value.(idempotentSubmission), now)
+}
+
+// The submission and its receipt, unless the key expired or the receipt was deleted. A reservation has no receipt yet
+func (t *tenant) liveSubmission(submission idempotentSubmission, now time.Time) (idempotentSubmission, storedReceipt, bool) {
+	if !now.Before(submission.expiresAt) {
+		return idempotentSubmission{}, storedReceipt{}, false
+	}
+	if submission.receiptId == "" {
+		return submission, storedReceipt{}, true
+	}
+	stored, ok := t.receipts.Load(submission.receiptId)
+	if !ok {
+		return idempotentSubmission{}, storedReceipt{}, false
+	}
+	return submission, stored.(storedReceipt), true
+}
+
+// Reserves the key for a new submission of the receipt, returning the reservation. When the key is taken, returns
+// the submission holding it instead, with its receipt if it has finished
+func (t *tenant) reserveIdempotencyKey(key idempotencyKey, hash [sha256.Size]byte, now time.Time) (idempotentSubmission, storedReceipt, bool) {
+	reservation := idempotentSubmission{receiptHash: hash, expiresAt: now.Add(idempotencyKeyTTL)}
+	if key.key == "" {
+		return reservation, storedReceipt{}, true
+	}
+	for {
+		value, loaded := t.idempotencyKeys.LoadOrStore(key, reservation)
+		if !loaded {
+			return reservation, storedReceipt{}, true
+		}
+		if submission, stored, ok := t.liveSubmission(value.(idempotentSubmission), now); ok {
+			return submission, stored, false
+		}
+		// Expired or its receipt is gone, so the key is free again unless another request just took it
+		if t.idempotencyKeys.CompareAndSwap(key, value, reservation) {
+			return reservation, storedReceipt{}, true
+		}
+	}
+}
+
+// Frees a key reserved for a submission that failed, so it can be retried
+func (t *tenant) releaseIdempotencyKey(key idempotencyKey, reservation idempotentSubmission) {
+	if key.key != "" {
+		t.idempotencyKeys.CompareAndDelete(key, reservation)
+	}
+}
+
+func (t *tenant) rememberIdempotencyKey(key idempotencyKey, receiptGuid string, hash [sha256.Size]byte, now time.Time) {
+	if key.key != "" {
+		t.idempotencyKeys.Store(key, idempotentSubmission{receiptId: receiptGuid, receiptHash: hash, expiresAt: now.Add(idempotencyKeyTTL)})
+	}
+}
+
+// Drops keys that expired, so they don't pile up
+func (t *tenant) forgetExpiredIdempotencyKeys(now time.Time) {
+	t.idempotencyKeys.Range(func(key, value any) bool {
+		if !now.Before(value.(idempotentSubmission).expiresAt) {
+			t.idempotencyKeys.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
+var startIdempotencySweeperOnce sync.Once
+
+// Forgets expired Idempotency-Keys every hour
+func startIdempotencySweeper() {
+	startIdempotencySweeperOnce.Do(func() {
+		go func() {
+			for now := range time.Tick(time.Hour) {
+				tenants.each(func(t *tenant) { t.forgetExpiredIdempotencyKeys(now) })
+			}
+		}()
+	})
+}
+
+func getReceiptV2(c *gin.Context) {
+	stored, ok := tenantOf(c).visibleReceipt(c, c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, receiptNotFoundV2)
+		return
+	}
+
+	respond(c, http.StatusOK, newReceiptV2(c.Param("id"), stored, true))
+}
+
+func getReceiptPointsV2(c *gin.Context) {
+	stored, ok := tenantOf(c).visibleReceipt(c, c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, receiptNotFoundV2)
+		return
+	}
+
+	if notModified(c, stored) {
+		return
+	}
+
+	// The job itself was found, so failures are reported in the representation rather than as a 4xx
+	code := http.StatusOK
+	if stored.Status == statusPending || stored.Status == statusProcessing {
+		code = http.StatusAccepted
+	}
+
+	respond(c, code, newReceiptV2(c.Param("id"), stored, false))
+}
+
+func deleteReceiptV2(c *gin.Context) {
+	t := tenantOf(c)
+	if !t.deleteVisibleReceipt(c, c.Param("id")) {
+		respondErrorV2(c, http.StatusNotFound, receiptNotFoundV2)
+		return
+	}
+
+	t.publishWebhookEvent(eventReceiptDeleted, gin.H{"id": c.Param("id")})
+	c.Status(http.StatusNoContent)
+}
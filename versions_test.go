@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const simpleReceiptPayload = `{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-02",
+  "purchaseTime": "13:13",
+  "total": "1.25",
+  "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]
+}`
+
+type errorResponseV2 struct {
+	Error apiErrorV2 `json:"error"`
+}
+
+func TestV1MatchesUnversionedContract(t *testing.T) {
+	for _, prefix := range []string{"", "/v1"} {
+		req := httptest.NewRequest("POST", prefix+"/receipts/process", bytes.NewBufferString(simpleReceiptPayload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var posted map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &posted))
+		assert.Len(t, posted, 1)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/receipts/"+posted["id"].(string)+"/points", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"points": 31}`, w.Body.String())
+
+		// Only the unversioned aliases are deprecated
+		if prefix == "" {
+			assert.NotEmpty(t, w.Header().Get("Deprecation"))
+			assert.Equal(t, "Fri, 30 Apr 2027 00:00:00 GMT", w.Header().Get("Sunset"))
+			assert.Equal(t, `</v1/receipts/`+posted["id"].(string)+`/points>; rel="successor-version"`, w.Header().Get("Link"))
+		} else {
+			assert.Empty(t, w.Header().Get("Deprecation"))
+			assert.Empty(t, w.Header().Get("Sunset"))
+		}
+	}
+}
+
+func TestV2ProcessReturnsFullReceipt(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v2/receipts/process", bytes.NewBufferString(simpleReceiptPayload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "/v2/receipts/"+created.Id, w.Header().Get("Location"))
+	assert.Equal(t, statusDone, created.Status)
+	assert.Equal(t, 31, *created.Points)
+	assert.Equal(t, []pointsAward{
+		{Rule: ruleRetailerName, Points: 6, Description: "retailer name (Target) has 6 alphanumeric characters"},
+		{Rule: ruleQuarterMultiple, Points: 25, Description: "total is a multiple of 0.25"},
+	}, created.Breakdown)
+	assert.Equal(t, "Target", created.Receipt.Retailer)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/receipts/"+created.Id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var fetched receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &fetched))
+	assert.Equal(t, created.Id, fetched.Id)
+	assert.Len(t, fetched.Receipt.Items, 1)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/receipts/"+created.Id+"/points", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var points receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &points))
+	assert.Equal(t, 31, *points.Points)
+	assert.Nil(t, points.Receipt)
+}
+
+func TestV2StructuredErrors(t *testing.T) {
+	payloads := map[string]string{
+		"retailer":       `{"retailer": "!!!", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "A", "price": "1.25"}]}`,
+		"items[1].price": `{"retailer": "A", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "A", "price": "1.25"}, {"shortDescription": "B", "price": "1"}]}`,
+		"purchaseDate":   `{"retailer": "A", "purchaseDate": "2022-1-2", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "A", "price": "1.25"}]}`,
+		"purchaseTime":   `{"retailer": "A", "purchaseDate": "2022-01-02", "purchaseTime": "1 PM", "total": "1.25", "items": [{"shortDescription": "A", "price": "1.25"}]}`,
+		"items":          `{"retailer": "A", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25", "items": []}`,
+		"":               `{"retailer": "A",`,
+		"total":          `{"retailer": "A", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.2", "items": [{"shortDescription": "A", "price": "1.25"}]}`,
+	}
+
+	for field, payload := range payloads {
+		req := httptest.NewRequest("POST", "/v2/receipts/process", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		var response errorResponseV2
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, field, response.Error.Field)
+		assert.NotEmpty(t, response.Error.Code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/receipts/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var response errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "receipt_not_found", response.Error.Code)
+}
+
+func TestV2AsyncFailureReportsField(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v2/receipts/process", bytes.NewBufferString(`{"retailer": "!!!", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "A", "price": "1.25"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var accepted receiptV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+	assert.Equal(t, statusPending, accepted.Status)
+
+	var points receiptV2
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/receipts/"+accepted.Id+"/points", nil))
+		json.Unmarshal(w.Body.Bytes(), &points)
+		return w.Code == http.StatusOK
+	}, 2*time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, statusFailed, points.Status)
+	assert.Equal(t, "retailer", points.Error.Field)
+}
+
+func TestIdempotencyKeyReplaysReceipt(t *testing.T) {
+	req := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v2/receipts/process", bytes.NewBufferString(simpleReceiptPayload))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Idempotency-Key", "replay-me")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	first, second := req(), req()
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, first.Header().Get("Location"), second.Header().Get("Location"))
+}
+
+func TestIdempotencyKeyMisuse(t *testing.T) {
+	otherReceipt := strings.Replace(simpleReceiptPayload, `"total": "1.25"`, `"total": "1.26"`, 1)
+	assert.NotEqual(t, simpleReceiptPayload, otherReceipt)
+	key := "Idempotency-Key"
+
+	first := sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, key, t.Name())
+	assert.Equal(t, http.StatusCreated, first.Code)
+
+	// The same key for a different receipt is refused rather than answered with the first one
+	w := sendJSON("POST", "/v2/receipts/process", otherReceipt, key, t.Name())
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, idempotencyKeyReusedV2, body.Error)
+
+	// Keys are each customer's own
+	customerId := newTestCustomer(t)
+	w = sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, key, t.Name(), "Customer-Id", customerId)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEqual(t, first.Header().Get("Location"), w.Header().Get("Location"))
+
+	// Keys expire, and are forgotten once they have
+	scoped := idempotencyKey{key: t.Name()}
+	_, _, ok := defaultTenant().idempotentReceipt(scoped, time.Now())
+	assert.True(t, ok)
+	later := time.Now().Add(idempotencyKeyTTL)
+	_, _, ok = defaultTenant().idempotentReceipt(scoped, later)
+	assert.False(t, ok)
+	defaultTenant().forgetExpiredIdempotencyKeys(later)
+	_, ok = defaultTenant().idempotencyKeys.Load(scoped)
+	assert.False(t, ok)
+}
+
+func TestIdempotencyKeyConcurrentRetries(t *testing.T) {
+	customerId := newTestCustomer(t)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- sendJSON("POST", "/v2/receipts/process", simpleReceiptPayload, "Idempotency-Key", t.Name(), "Customer-Id", customerId).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	// Retries that arrive while the first is still processing are told so rather than processed again
+	for code := range codes {
+		assert.Contains(t, []int{http.StatusCreated, http.StatusConflict}, code)
+	}
+
+	stored := 0
+	defaultTenant().receipts.Range(func(_, value any) bool {
+		if value.(storedReceipt).CustomerId == customerId {
+			stored++
+		}
+		return true
+	})
+	assert.Equal(t, 1, stored)
+	assert.Len(t, defaultTenant().ledger.entriesFor(customerLedgerAccount(customerId)), 1)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	eventReceiptScored   = "receipt.scored"
+	eventReceiptRejected = "receipt.rejected"
+	eventReceiptDeleted  = "receipt.deleted"
+)
+
+var webhookEventTypes = []string{eventReceiptScored, eventReceiptRejected, eventReceiptDeleted}
+
+const WebhookMaxAttempts = 5
+
+// Delay before the first retry, doubled for every retry after that. A variable so tests can shorten it
+var webhookBackoff = time.Second
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type webhookSubscription struct {
+	Id        string    `json:"id" xml:"id" yaml:"id"`
+	Url       string    `json:"url" xml:"url" yaml:"url"`
+	Events    []string  `json:"events" xml:"events>event" yaml:"events"`
+	Secret    string    `json:"-" xml:"-" yaml:"-"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+}
+
+type webhookEvent struct {
+	Id        string    `json:"id" xml:"id" yaml:"id"`
+	Type      string    `json:"type" xml:"type" yaml:"type"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt" yaml:"createdAt"`
+	Data      gin.H     `json:"data" xml:"data" yaml:"data"`
+}
+
+// A delivery that exhausted its retries, kept until it is redelivered
+type deadLetter struct {
+	Id             string       `json:"id" xml:"id" yaml:"id"`
+	SubscriptionId string       `json:"subscriptionId" xml:"subscriptionId" yaml:"subscriptionId"`
+	Event          webhookEvent `json:"event" xml:"event" yaml:"event"`
+	Attempts       int          `json:"attempts" xml:"attempts" yaml:"attempts"`
+	LastError      string       `json:"lastError" xml:"lastError" yaml:"lastError"`
+	FailedAt       time.Time    `json:"failedAt" xml:"failedAt" yaml:"failedAt"`
+}
+
+var (
+	invalidWebhookV2     = apiErrorV2{Code: "invalid_request", Message: "The webhook subscription is invalid."}
+	webhookNotFoundV2    = apiErrorV2{Code: "webhook_not_found", Message: "No webhook found for that ID."}
+	deadLetterNotFoundV2 = apiErrorV2{Code: "dead_letter_not_found", Message: "No dead letter found for that ID."}
+)
+
+func setupWebhookAPI(group *gin.RouterGroup) {
+	admin := group.Group("/webhooks", validateRequests(func(c *gin.Context, err error) {
+		respondErrorV2(c, http.StatusBadRequest, invalidWebhookV2)
+	}))
+	admin.POST("", createWebhook)
+	admin.GET("", listWebhooks)
+	admin.GET("/:id", getWebhook)
+	admin.DELETE("/:id", deleteWebhook)
+	admin.GET("/dead-letters", listDeadLetters)
+	admin.POST("/dead-letters/:id/redeliver", redeliverDeadLetter)
+}
+
+func createWebhook(c *gin.Context) {
+	var request struct {
+		Url    string   `json:"url" binding:"required"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondErrorV2(c, http.StatusBadRequest, invalidWebhookV2)
+		return
+	}
+
+	// Only absolute http(s) URLs can be delivered to
+	target, err := url.Parse(request.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		respondErrorV2(c, http.StatusBadRequest, invalidWebhookV2)
+		return
+	}
+
+	// No events means every event
+	if len(request.Events) == 0 {
+		request.Events = webhookEventTypes
+	}
+	for _, event := range request.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			respondErrorV2(c, http.StatusBadRequest, invalidWebhookV2)
+			return
+		}
+	}
+
+	subscription := webhookSubscription{
+		Id:        uuid.New().String(),
+		Url:       request.Url,
+		Events:    request.Events,
+		Secret:    request.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	tenantOf(c).webhookSubscriptions.Store(subscription.Id, subscription)
+
+	respond(c, http.StatusCreated, subscription)
+}
+
+func listWebhooks(c *gin.Context) {
+	subscriptions := []webhookSubscription{}
+	tenantOf(c).webhookSubscriptions.Range(func(_, value any) bool {
+		subscriptions = append(subscriptions, value.(webhookSubscription))
+		return true
+	})
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt) })
+
+	respond(c, http.StatusOK, subscriptions)
+}
+
+func getWebhook(c *gin.Context) {
+	subscription, ok := tenantOf(c).webhookSubscriptions.Load(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, webhookNotFoundV2)
+		return
+	}
+
+	respond(c, http.StatusOK, subscription)
+}
+
+func deleteWebhook(c *gin.Context) {
+	if _, ok := tenantOf(c).webhookSubscriptions.LoadAndDelete(c.Param("id")); !ok {
+		respondErrorV2(c, http.StatusNotFound, webhookNotFoundV2)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func listDeadLetters(c *gin.Context) {
+	deadLetters := []deadLetter{}
+	tenantOf(c).webhookDeadLetters.Range(func(_, value any) bool {
+		deadLetters = append(deadLetters, value.(deadLetter))
+		return true
+	})
+	sort.Slice(deadLetters, func(i, j int) bool { return deadLetters[i].FailedAt.Before(deadLetters[j].FailedAt) })
+
+	respond(c, http.StatusOK, deadLetters)
+}
+
+func redeliverDeadLetter(c *gin.Context) {
+	t := tenantOf(c)
+	value, ok := t.webhookDeadLetters.Load(c.Param("id"))
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, deadLetterNotFoundV2)
+		return
+	}
+	letter := value.(deadLetter)
+
+	// The subscription may have been removed since the delivery failed
+	subscription, ok := t.webhookSubscriptions.Load(letter.SubscriptionId)
+	if !ok {
+		respondErrorV2(c, http.StatusNotFound, webhookNotFoundV2)
+		return
+	}
+
+	t.webhookDeadLetters.Delete(letter.Id)
+	go t.deliverWebhook(subscription.(webhookSubscription), letter.Event)
+
+	c.Status(http.StatusAccepted)
+}
+
+// Sends the event to every subscription interested in it, in the background
+func (t *tenant) publishWebhookEvent(eventType string, data gin.H) {
+	event := webhookEvent{
+		Id:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	t.webhookSubscriptions.Range(func(_, value any) bool {
+		subscription := value.(webhookSubscription)
+		if slices.Contains(subscription.Events, eventType) {
+			go t.deliverWebhook(subscription, event)
+		}
+		return true
+	})
+}
+
+// POSTs the signed event, retrying with exponential backoff before giving up to the dead letter list
+func (t *tenant) deliverWebhook(subscription webhookSubscription, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	var lastError string
+	for attempt := 1; attempt <= WebhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(webhookBackoff << (attempt - 2))
+		}
+
+		err := postWebhook(subscription, event, body)
+		if err == nil {
+			return
+		}
+		lastError = err.Error()
+	}
+
+	letter := deadLetter{
+		Id:             uuid.New().String(),
+		SubscriptionId: subscription.Id,
+		Event:          event,
+		Attempts:       WebhookMaxAttempts,
+		LastError:      lastError,
+		FailedAt:       time.Now().UTC(),
+	}
+	t.webhookDeadLetters.Store(letter.Id, letter)
+}
+
+func postWebhook(subscription webhookSubscription, event webhookEvent, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Delivery", event.Id)
+	req.Header.Set("X-Webhook-Signature-256", "sha256="+signWebhook(subscription.Secret, body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Anything outside 2xx is treated as a failed delivery
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Hex encoded HMAC-SHA256 of the body keyed with the subscription secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
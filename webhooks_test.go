@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookResponse struct {
+	Id string `json:"id"`
+}
+
+// Subscribes the receiver URL to the events and returns the subscription ID
+func subscribeWebhook(t *testing.T, receiverUrl string, events ...string) string {
+	payload, _ := json.Marshal(map[string]any{"url": receiverUrl, "events": events, "secret": "shh"})
+	w := sendAdmin(t, "POST", "/admin/webhooks", string(payload))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response webhookResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	// Unsubscribe so other tests don't deliver to this receiver
+	t.Cleanup(func() {
+		sendAdmin(t, "DELETE", "/admin/webhooks/"+response.Id, "")
+	})
+
+	return response.Id
+}
+
+func TestWebhookDeliveredSigned(t *testing.T) {
+	deliveries := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	subscribeWebhook(t, receiver.URL, "receipt.deleted")
+
+	// Store a receipt then delete it to trigger the event
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewBufferString(`{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-02",
+  "purchaseTime": "13:13",
+  "total": "1.25",
+  "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]
+}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var receipt postResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/receipts/"+receipt.Id, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	select {
+	case delivery := <-deliveries:
+		body := <-bodies
+		assert.Equal(t, "receipt.deleted", delivery.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, "sha256="+signWebhook("shh", body), delivery.Header.Get("X-Webhook-Signature-256"))
+
+		var event webhookEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, receipt.Id, event.Data["id"])
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	// Deleted receipts are gone
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/receipts/"+receipt.Id+"/points", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebhookDeadLetterAndRedelivery(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	// Receiver fails until it is switched healthy
+	var attempts atomic.Int32
+	var healthy atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	subscriptionId := subscribeWebhook(t, receiver.URL, "receipt.rejected")
+
+	req := httptest.NewRequest("POST", "/receipts/process", bytes.NewBufferString(`{
+  "retailer": "!!!",
+  "purchaseDate": "2022-01-02",
+  "purchaseTime": "13:13",
+  "total": "1.25",
+  "items": [{"shortDescription": "Pepsi", "price": "1.25"}]
+}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Wait for retries to exhaust into the dead letter list
+	var letters []deadLetter
+	assert.Eventually(t, func() bool {
+		w := sendAdmin(t, "GET", "/admin/webhooks/dead-letters", "")
+		letters = nil
+		json.Unmarshal(w.Body.Bytes(), &letters)
+		for _, letter := range letters {
+			if letter.SubscriptionId == subscriptionId {
+				letters = []deadLetter{letter}
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(WebhookMaxAttempts), attempts.Load())
+	assert.Equal(t, "receipt.rejected", letters[0].Event.Type)
+
+	healthy.Store(true)
+
+	w := sendAdmin(t, "POST", "/admin/webhooks/dead-letters/"+letters[0].Id+"/redeliver", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	assert.Eventually(t, func() bool { return attempts.Load() == WebhookMaxAttempts+1 }, 2*time.Second, 5*time.Millisecond)
+
+	// Redelivered letters leave the list
+	w = sendAdmin(t, "POST", "/admin/webhooks/dead-letters/"+letters[0].Id+"/redeliver", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var body errorResponseV2
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, deadLetterNotFoundV2, body.Error)
+}
+
+func TestInvalidWebhookSubscription(t *testing.T) {
+	payloads := []string{
+		`{"url": "ftp://example.com", "secret": "shh"}`,
+		`{"url": "https://example.com", "events": ["receipt.unknown"], "secret": "shh"}`,
+		`{"url": "https://example.com"}`,
+	}
+
+	for _, payload := range payloads {
+		w := sendAdmin(t, "POST", "/admin/webhooks", payload)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var body errorResponseV2
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, invalidWebhookV2, body.Error)
+	}
+
+	// The admin API answers in the negotiated format like v2
+	w := sendAdmin(t, "GET", "/admin/webhooks/missing", "", "Accept", "application/yaml")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "code: webhook_not_found")
+}